@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	bencodetorrent "github.com/TheLox95/go-torrent-client/pkg/bencodeTorrent"
+	peermanager2 "github.com/TheLox95/go-torrent-client/pkg/peerManager2"
+)
+
+// torrentInfo is what the info command prints about a torrent file
+type torrentInfo struct {
+	Name         string     `json:"name"`
+	InfoHash     string     `json:"info_hash"`
+	Private      bool       `json:"private"`
+	Source       string     `json:"source,omitempty"`
+	Size         int64      `json:"size"`
+	PieceLength  int        `json:"piece_length"`
+	PieceCount   int        `json:"piece_count"`
+	Comment      string     `json:"comment,omitempty"`
+	CreatedBy    string     `json:"created_by,omitempty"`
+	CreationDate *time.Time `json:"creation_date,omitempty"`
+	Encoding     string     `json:"encoding,omitempty"`
+	Trackers     [][]string `json:"trackers"`
+	WebSeeds     []string   `json:"web_seeds,omitempty"`
+	HTTPSeeds    []string   `json:"http_seeds,omitempty"`
+	Nodes        []string   `json:"nodes,omitempty"`
+	Files        []fileInfo `json:"files"`
+}
+
+type fileInfo struct {
+	Path    string `json:"path"`
+	Length  int64  `json:"length"`
+	Md5sum  string `json:"md5sum,omitempty"`
+	Attr    string `json:"attr,omitempty"`
+	Symlink string `json:"symlink,omitempty"`
+}
+
+// runInfo prints a summary of torrent files: info [-json] <file>...
+func runInfo(args []string) error {
+	flags := flag.NewFlagSet("info", flag.ContinueOnError)
+	asJSON := flags.Bool("json", false, "print JSON instead of text")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if flags.NArg() == 0 {
+		return errors.New("usage: info [-json] <torrent file>...")
+	}
+	infos := make([]torrentInfo, 0, flags.NArg())
+	for _, torrentPath := range flags.Args() {
+		info, err := readTorrentInfo(torrentPath)
+		if err != nil {
+			return fmt.Errorf("%s: %w", torrentPath, err)
+		}
+		infos = append(infos, info)
+	}
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if len(infos) == 1 {
+			return encoder.Encode(infos[0])
+		}
+		return encoder.Encode(infos)
+	}
+	for i, info := range infos {
+		if i > 0 {
+			fmt.Println()
+		}
+		printTorrentInfo(info)
+	}
+	return nil
+}
+
+func readTorrentInfo(torrentPath string) (torrentInfo, error) {
+	meta, err := bencodetorrent.Open(torrentPath)
+	if err != nil {
+		return torrentInfo{}, err
+	}
+	infoHash, err := meta.InfoHash()
+	if err != nil {
+		return torrentInfo{}, err
+	}
+	hashes, err := meta.Info.SplitPieceHashes()
+	if err != nil {
+		return torrentInfo{}, err
+	}
+	info := torrentInfo{
+		Name:        meta.Info.Name,
+		InfoHash:    hex.EncodeToString(infoHash[:]),
+		Private:     meta.Info.IsPrivate(),
+		Source:      meta.Info.Source,
+		Size:        int64(meta.Info.TotalLength()),
+		PieceLength: meta.Info.PieceLength,
+		PieceCount:  len(hashes),
+		Comment:     meta.Comment,
+		CreatedBy:   meta.CreatedBy,
+		Encoding:    meta.Encoding,
+		Trackers:    meta.AnnounceList,
+		WebSeeds:    meta.WebSeeds(),
+		HTTPSeeds:   meta.HTTPSeeds,
+		Nodes:       meta.DHTNodes(),
+	}
+	if created := meta.CreatedAt(); !created.IsZero() {
+		info.CreationDate = &created
+	}
+	if len(info.Trackers) == 0 {
+		info.Trackers = [][]string{}
+		if meta.Announce != "" {
+			info.Trackers = [][]string{{meta.Announce}}
+		}
+	}
+	// summaries get pasted around, passkeys stay out of them
+	for _, tier := range info.Trackers {
+		for i, url := range tier {
+			tier[i] = peermanager2.RedactURL(url)
+		}
+	}
+	if len(meta.Info.Files) == 0 {
+		info.Files = []fileInfo{{
+			Path:    meta.Info.Name,
+			Length:  int64(meta.Info.Length),
+			Md5sum:  meta.Info.Md5sum,
+			Attr:    meta.Info.Attr,
+			Symlink: path.Join(meta.Info.SymlinkPath...),
+		}}
+	}
+	for _, f := range meta.Info.Files {
+		info.Files = append(info.Files, fileInfo{
+			Path:    path.Join(append([]string{meta.Info.Name}, f.Path...)...),
+			Length:  int64(f.Length),
+			Md5sum:  f.Md5sum,
+			Attr:    f.Attr,
+			Symlink: path.Join(f.SymlinkPath...),
+		})
+	}
+	return info, nil
+}
+
+func printTorrentInfo(info torrentInfo) {
+	fmt.Println("name:         ", info.Name)
+	fmt.Println("info hash:    ", info.InfoHash)
+	fmt.Println("private:      ", info.Private)
+	if info.Source != "" {
+		fmt.Println("source:       ", info.Source)
+	}
+	fmt.Printf("size:          %s (%d bytes)\n", formatSize(info.Size), info.Size)
+	fmt.Printf("pieces:        %d of %s\n", info.PieceCount, formatSize(int64(info.PieceLength)))
+	if info.Comment != "" {
+		fmt.Println("comment:      ", info.Comment)
+	}
+	if info.CreatedBy != "" {
+		fmt.Println("created by:   ", info.CreatedBy)
+	}
+	if info.CreationDate != nil {
+		fmt.Println("created:      ", info.CreationDate.Format(time.RFC3339))
+	}
+	if info.Encoding != "" {
+		fmt.Println("encoding:     ", info.Encoding)
+	}
+	for tier, urls := range info.Trackers {
+		for _, url := range urls {
+			fmt.Printf("tracker:       [%d] %s\n", tier, url)
+		}
+	}
+	for _, url := range info.WebSeeds {
+		fmt.Println("web seed:     ", url)
+	}
+	for _, url := range info.HTTPSeeds {
+		fmt.Println("http seed:    ", url)
+	}
+	for _, node := range info.Nodes {
+		fmt.Println("dht node:     ", node)
+	}
+	fmt.Println("files:")
+	printFileTree(info.Files)
+}
+
+// printFileTree prints the files under the folders they are in, every
+// folder once
+func printFileTree(files []fileInfo) {
+	sorted := slices.Clone(files)
+	slices.SortFunc(sorted, func(a, b fileInfo) int {
+		return strings.Compare(a.Path, b.Path)
+	})
+	printed := map[string]bool{}
+	for _, f := range sorted {
+		parts := strings.Split(f.Path, "/")
+		for depth := range len(parts) - 1 {
+			dir := strings.Join(parts[:depth+1], "/")
+			if !printed[dir] {
+				printed[dir] = true
+				fmt.Printf("  %s%s/\n", strings.Repeat("  ", depth), parts[depth])
+			}
+		}
+		line := fmt.Sprintf("  %s%s  %s", strings.Repeat("  ", len(parts)-1), parts[len(parts)-1], formatSize(f.Length))
+		if f.Attr != "" {
+			line += " [" + f.Attr + "]"
+		}
+		if f.Symlink != "" {
+			line += " -> " + f.Symlink
+		}
+		fmt.Println(line)
+	}
+}
+
+func formatSize(n int64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	size := float64(n)
+	unit := 0
+	for size >= 1024 && unit < len(units)-1 {
+		size /= 1024
+		unit++
+	}
+	if unit == 0 {
+		return fmt.Sprintf("%d B", n)
+	}
+	return fmt.Sprintf("%.1f %s", size, units[unit])
+}
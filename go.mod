@@ -1,5 +1,3 @@
 module github.com/TheLox95/go-torrent-client
 
 go 1.23.4
-
-require github.com/jackpal/bencode-go v1.0.2 // indirect
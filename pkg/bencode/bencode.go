@@ -0,0 +1,95 @@
+// Package bencode reads and writes the bencoding of BitTorrent metainfo,
+// tracker responses and peer messages.
+//
+// Values map to Go types as follows: integers to any int, uint or bool,
+// byte strings to string, []byte or a byte array of the same length,
+// lists to slices and arrays, dictionaries to structs and maps with string
+// keys. Decoding into an interface gives int64, string, []any and
+// map[string]any. Struct fields are named by their bencode tag, fields
+// without one match their name in any case, "-" skips a field and
+// omitempty leaves zero values out when encoding.
+package bencode
+
+import (
+	"errors"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// RawMessage is a value kept exactly as it was encoded, to decode it
+// later or to hash it as the info dictionary is
+type RawMessage []byte
+
+var rawMessageType = reflect.TypeOf(RawMessage(nil))
+
+// DefaultMaxStringLength bounds byte strings, a lying length prefix fails
+// instead of allocating it
+const DefaultMaxStringLength = 64 * 1024 * 1024
+
+// DefaultMaxDepth bounds how deep lists and dictionaries nest
+const DefaultMaxDepth = 128
+
+var ErrNotCanonical = errors.New("bencode is not canonical")
+
+// field is how a struct field is encoded
+type field struct {
+	key       string
+	index     int
+	omitEmpty bool
+	// tagged fields only match their exact key
+	tagged bool
+}
+
+var fieldCache sync.Map
+
+// fields lists the encoded fields of a struct type sorted by key, the
+// order dictionaries are written in
+func fields(t reflect.Type) []field {
+	if cached, ok := fieldCache.Load(t); ok {
+		return cached.([]field)
+	}
+	list := []field{}
+	for i := range t.NumField() {
+		sf := t.Field(i)
+		if !sf.IsExported() {
+			continue
+		}
+		tag := sf.Tag.Get("bencode")
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		f := field{key: name, index: i, tagged: name != ""}
+		if name == "" {
+			f.key = sf.Name
+		}
+		for _, opt := range strings.Split(opts, ",") {
+			if opt == "omitempty" {
+				f.omitEmpty = true
+			}
+		}
+		list = append(list, f)
+	}
+	slices.SortFunc(list, func(a, b field) int {
+		return strings.Compare(a.key, b.key)
+	})
+	fieldCache.Store(t, list)
+	return list
+}
+
+// fieldFor finds the field a dictionary key decodes into
+func fieldFor(list []field, key string) (field, bool) {
+	for _, f := range list {
+		if f.key == key {
+			return f, true
+		}
+	}
+	for _, f := range list {
+		if !f.tagged && strings.EqualFold(f.key, key) {
+			return f, true
+		}
+	}
+	return field{}, false
+}
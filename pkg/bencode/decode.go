@@ -0,0 +1,433 @@
+package bencode
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+)
+
+// maxNumberLength fits every int64 and uint64 with its sign
+const maxNumberLength = 20
+
+// Decoder reads bencoded values one after the other from a stream
+type Decoder struct {
+	r *bufio.Reader
+	// Strict refuses anything but the canonical encoding: dictionary keys
+	// sorted and unique, no leading zeros and no negative zero. Input
+	// from peers should be read strictly.
+	Strict bool
+	// MaxStringLength and MaxDepth bound what a value can make us
+	// allocate
+	MaxStringLength int
+	MaxDepth        int
+	depth           int
+	offset          int64
+	// recorded keeps the bytes read since the outermost RawMessage being
+	// decoded started
+	recording bool
+	recorded  []byte
+}
+
+func NewDecoder(r io.Reader) *Decoder {
+	buffered, ok := r.(*bufio.Reader)
+	if !ok {
+		buffered = bufio.NewReader(r)
+	}
+	return &Decoder{r: buffered, MaxStringLength: DefaultMaxStringLength, MaxDepth: DefaultMaxDepth}
+}
+
+// Unmarshal decodes the first value of r into v, which must be a pointer
+func Unmarshal(r io.Reader, v any) error {
+	return NewDecoder(r).Decode(v)
+}
+
+// UnmarshalStrict decodes data that must hold exactly one value in its
+// canonical encoding
+func UnmarshalStrict(data []byte, v any) error {
+	d := NewDecoder(bytes.NewReader(data))
+	d.Strict = true
+	err := d.Decode(v)
+	if err != nil {
+		return err
+	}
+	if _, err := d.r.ReadByte(); err != io.EOF {
+		return fmt.Errorf("bencode: data after the value at offset %d", d.offset)
+	}
+	return nil
+}
+
+// Decode reads the next value into v, io.EOF when the stream ended before
+// it
+func (d *Decoder) Decode(v any) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() {
+		return errors.New("bencode: Decode needs a non nil pointer")
+	}
+	if _, err := d.r.Peek(1); err != nil {
+		return err
+	}
+	d.depth = 0
+	return d.value(rv.Elem())
+}
+
+func (d *Decoder) errorf(format string, args ...any) error {
+	return fmt.Errorf("bencode: "+format+" at offset %d", append(args, d.offset)...)
+}
+
+func (d *Decoder) notCanonical(what string) error {
+	return fmt.Errorf("%w: %s at offset %d", ErrNotCanonical, what, d.offset)
+}
+
+func (d *Decoder) peek() (byte, error) {
+	b, err := d.r.Peek(1)
+	if err != nil {
+		return 0, eofIsUnexpected(err)
+	}
+	return b[0], nil
+}
+
+func (d *Decoder) readByte() (byte, error) {
+	b, err := d.r.ReadByte()
+	if err != nil {
+		return 0, eofIsUnexpected(err)
+	}
+	d.offset++
+	if d.recording {
+		d.recorded = append(d.recorded, b)
+	}
+	return b, nil
+}
+
+func eofIsUnexpected(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// readNumber reads the digits of an integer or a string length up to end
+func (d *Decoder) readNumber(end byte, signed bool) (string, error) {
+	text := make([]byte, 0, maxNumberLength)
+	for {
+		b, err := d.readByte()
+		if err != nil {
+			return "", err
+		}
+		if b == end {
+			break
+		}
+		if len(text) == maxNumberLength {
+			return "", d.errorf("number too long")
+		}
+		text = append(text, b)
+	}
+	digits := text
+	negative := signed && len(text) > 0 && text[0] == '-'
+	if negative {
+		digits = text[1:]
+	}
+	if len(digits) == 0 {
+		return "", d.errorf("empty number")
+	}
+	for _, b := range digits {
+		if b < '0' || b > '9' {
+			return "", d.errorf("invalid number %q", text)
+		}
+	}
+	if d.Strict && len(digits) > 1 && digits[0] == '0' {
+		return "", d.notCanonical("leading zero")
+	}
+	if d.Strict && negative && string(digits) == "0" {
+		return "", d.notCanonical("negative zero")
+	}
+	return string(text), nil
+}
+
+// readString reads a length prefixed byte string, what it holds is
+// copied as it arrives so a bogus length cannot allocate more than the
+// stream has
+func (d *Decoder) readString() ([]byte, error) {
+	text, err := d.readNumber(':', false)
+	if err != nil {
+		return nil, err
+	}
+	length, err := strconv.ParseInt(text, 10, 64)
+	if err != nil || length > int64(d.MaxStringLength) {
+		return nil, d.errorf("string of length %s is too long", text)
+	}
+	var buf bytes.Buffer
+	n, err := io.CopyN(&buf, d.r, length)
+	d.offset += n
+	if err != nil {
+		return nil, eofIsUnexpected(err)
+	}
+	if d.recording {
+		d.recorded = append(d.recorded, buf.Bytes()...)
+	}
+	return buf.Bytes(), nil
+}
+
+func (d *Decoder) enter() error {
+	d.depth++
+	if d.depth > d.MaxDepth {
+		return d.errorf("values nested too deep")
+	}
+	return nil
+}
+
+func (d *Decoder) leave() {
+	d.depth--
+}
+
+var (
+	genericInt  = reflect.TypeOf(int64(0))
+	genericStr  = reflect.TypeOf("")
+	genericList = reflect.TypeOf([]any(nil))
+	genericDict = reflect.TypeOf(map[string]any(nil))
+)
+
+// value decodes the next value into v, an invalid v skips it
+func (d *Decoder) value(v reflect.Value) error {
+	if v.IsValid() && v.Type() == rawMessageType {
+		return d.raw(v)
+	}
+	if v.IsValid() && v.Kind() == reflect.Pointer {
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return d.value(v.Elem())
+	}
+	c, err := d.peek()
+	if err != nil {
+		return err
+	}
+	if v.IsValid() && v.Kind() == reflect.Interface && v.NumMethod() == 0 {
+		var generic reflect.Value
+		switch {
+		case c == 'i':
+			generic = reflect.New(genericInt).Elem()
+		case c >= '0' && c <= '9':
+			generic = reflect.New(genericStr).Elem()
+		case c == 'l':
+			generic = reflect.New(genericList).Elem()
+		case c == 'd':
+			generic = reflect.New(genericDict).Elem()
+		default:
+			return d.errorf("unexpected %q", c)
+		}
+		err := d.value(generic)
+		if err != nil {
+			return err
+		}
+		v.Set(generic)
+		return nil
+	}
+	switch {
+	case c == 'i':
+		d.readByte()
+		text, err := d.readNumber('e', true)
+		if err != nil {
+			return err
+		}
+		return d.setInt(v, text)
+	case c >= '0' && c <= '9':
+		s, err := d.readString()
+		if err != nil {
+			return err
+		}
+		return d.setString(v, s)
+	case c == 'l':
+		return d.list(v)
+	case c == 'd':
+		return d.dict(v)
+	}
+	return d.errorf("unexpected %q", c)
+}
+
+// raw keeps the bytes of the next value, nested raw messages share the
+// recording of the outermost one
+func (d *Decoder) raw(v reflect.Value) error {
+	outer := d.recording
+	start := len(d.recorded)
+	if !outer {
+		d.recording = true
+		d.recorded = d.recorded[:0]
+		start = 0
+	}
+	err := d.value(reflect.Value{})
+	raw := append(RawMessage(nil), d.recorded[start:]...)
+	if !outer {
+		d.recording = false
+		d.recorded = nil
+	}
+	if err != nil {
+		return err
+	}
+	v.Set(reflect.ValueOf(raw))
+	return nil
+}
+
+func (d *Decoder) typeError(what string, v reflect.Value) error {
+	return d.errorf("cannot decode %s into %s", what, v.Type())
+}
+
+func (d *Decoder) setInt(v reflect.Value, text string) error {
+	if !v.IsValid() {
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(text, 10, v.Type().Bits())
+		if err != nil {
+			return d.errorf("integer %s out of range for %s", text, v.Type())
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(text, 10, v.Type().Bits())
+		if err != nil {
+			return d.errorf("integer %s out of range for %s", text, v.Type())
+		}
+		v.SetUint(n)
+	case reflect.Bool:
+		v.SetBool(text != "0" && text != "-0")
+	default:
+		return d.typeError("integer", v)
+	}
+	return nil
+}
+
+func (d *Decoder) setString(v reflect.Value, s []byte) error {
+	if !v.IsValid() {
+		return nil
+	}
+	switch {
+	case v.Kind() == reflect.String:
+		v.SetString(string(s))
+	case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8:
+		v.SetBytes(bytes.Clone(s))
+	case v.Kind() == reflect.Array && v.Type().Elem().Kind() == reflect.Uint8:
+		if len(s) != v.Len() {
+			return d.errorf("string of length %d does not fit %s", len(s), v.Type())
+		}
+		reflect.Copy(v, reflect.ValueOf(s))
+	default:
+		return d.typeError("string", v)
+	}
+	return nil
+}
+
+func (d *Decoder) list(v reflect.Value) error {
+	if v.IsValid() && v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+		return d.typeError("list", v)
+	}
+	d.readByte()
+	err := d.enter()
+	if err != nil {
+		return err
+	}
+	defer d.leave()
+
+	var slice reflect.Value
+	if v.IsValid() && v.Kind() == reflect.Slice {
+		slice = reflect.MakeSlice(v.Type(), 0, 0)
+	}
+	count := 0
+	for {
+		c, err := d.peek()
+		if err != nil {
+			return err
+		}
+		if c == 'e' {
+			d.readByte()
+			break
+		}
+		var elem reflect.Value
+		switch {
+		case slice.IsValid():
+			elem = reflect.New(v.Type().Elem()).Elem()
+		case v.IsValid() && count < v.Len():
+			elem = v.Index(count)
+		}
+		err = d.value(elem)
+		if err != nil {
+			return err
+		}
+		if slice.IsValid() {
+			slice = reflect.Append(slice, elem)
+		}
+		count++
+	}
+	if slice.IsValid() {
+		v.Set(slice)
+	}
+	return nil
+}
+
+func (d *Decoder) dict(v reflect.Value) error {
+	var structFields []field
+	switch {
+	case !v.IsValid():
+	case v.Kind() == reflect.Struct:
+		structFields = fields(v.Type())
+	case v.Kind() == reflect.Map && v.Type().Key().Kind() == reflect.String:
+		if v.IsNil() {
+			v.Set(reflect.MakeMap(v.Type()))
+		}
+	default:
+		return d.typeError("dictionary", v)
+	}
+	d.readByte()
+	err := d.enter()
+	if err != nil {
+		return err
+	}
+	defer d.leave()
+
+	var previous []byte
+	for first := true; ; first = false {
+		c, err := d.peek()
+		if err != nil {
+			return err
+		}
+		if c == 'e' {
+			d.readByte()
+			return nil
+		}
+		if c < '0' || c > '9' {
+			return d.errorf("dictionary key is not a string")
+		}
+		key, err := d.readString()
+		if err != nil {
+			return err
+		}
+		if d.Strict && !first && bytes.Compare(previous, key) >= 0 {
+			return d.notCanonical(fmt.Sprintf("key %q unsorted or repeated", key))
+		}
+		previous = key
+
+		switch {
+		case !v.IsValid():
+			err = d.value(reflect.Value{})
+		case v.Kind() == reflect.Struct:
+			f, ok := fieldFor(structFields, string(key))
+			target := reflect.Value{}
+			if ok {
+				target = v.Field(f.index)
+			}
+			err = d.value(target)
+		default:
+			elem := reflect.New(v.Type().Elem()).Elem()
+			err = d.value(elem)
+			if err == nil {
+				v.SetMapIndex(reflect.ValueOf(string(key)).Convert(v.Type().Key()), elem)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package bencode
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func FuzzDecode(f *testing.F) {
+	for _, seed := range []string{
+		"i42e",
+		"i-7e",
+		"4:spam",
+		"0:",
+		"le",
+		"l4:spami42ee",
+		"de",
+		"d3:cow3:moo4:spam4:eggse",
+		"d4:infod6:lengthi10e4:name1:aee",
+		"d1:ad1:bd1:cleeee",
+		"i03e",
+		"d1:bi1e1:ai2ee",
+	} {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var loose any
+		NewDecoder(bytes.NewReader(data)).Decode(&loose)
+		var meta struct {
+			Announce string     `bencode:"announce"`
+			Info     RawMessage `bencode:"info"`
+			List     [][]string `bencode:"announce-list"`
+			Length   int64      `bencode:"length"`
+			Private  bool       `bencode:"private"`
+			Hash     [20]byte   `bencode:"hash"`
+		}
+		NewDecoder(bytes.NewReader(data)).Decode(&meta)
+
+		var v any
+		if err := UnmarshalStrict(data, &v); err != nil {
+			return
+		}
+		var buf bytes.Buffer
+		if err := Marshal(&buf, v); err != nil {
+			t.Fatalf("strict input %q does not encode again: %v", data, err)
+		}
+		if !bytes.Equal(buf.Bytes(), data) {
+			t.Fatalf("strict input %q encodes to %q", data, buf.Bytes())
+		}
+		var raw RawMessage
+		if err := UnmarshalStrict(data, &raw); err != nil {
+			t.Fatalf("strict input %q not read as RawMessage: %v", data, err)
+		}
+		if !bytes.Equal(raw, data) {
+			t.Fatalf("RawMessage of %q is %q", data, raw)
+		}
+	})
+}
+
+func TestUnmarshalStrict(t *testing.T) {
+	tests := []struct {
+		name      string
+		data      string
+		canonical bool
+	}{
+		{"integer", "i42e", true},
+		{"negative integer", "i-42e", true},
+		{"zero", "i0e", true},
+		{"leading zero", "i03e", false},
+		{"negative zero", "i-0e", false},
+		{"string length with leading zero", "04:spam", false},
+		{"sorted keys", "d1:ai1e1:bi2ee", true},
+		{"unsorted keys", "d1:bi1e1:ai2ee", false},
+		{"repeated key", "d1:ai1e1:ai2ee", false},
+		{"unsorted keys deep down", "l" + "d1:bi1e1:ai2ee" + "e", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var v any
+			err := UnmarshalStrict([]byte(tt.data), &v)
+			if tt.canonical && err != nil {
+				t.Fatalf("UnmarshalStrict(%q): %v", tt.data, err)
+			}
+			if !tt.canonical && !errors.Is(err, ErrNotCanonical) {
+				t.Fatalf("UnmarshalStrict(%q) returned %v, want ErrNotCanonical", tt.data, err)
+			}
+			// the lenient decoder takes what strict mode refuses
+			var loose any
+			err = Unmarshal(strings.NewReader(tt.data), &loose)
+			if err != nil {
+				t.Fatalf("Unmarshal(%q): %v", tt.data, err)
+			}
+		})
+	}
+}
+
+func TestUnmarshalStrictTrailingData(t *testing.T) {
+	var v any
+	err := UnmarshalStrict([]byte("i1ei2e"), &v)
+	if err == nil {
+		t.Fatal("data after the value was accepted")
+	}
+}
+
+func TestDecodeStream(t *testing.T) {
+	d := NewDecoder(strings.NewReader("i1e4:spamle"))
+	var n int
+	var s string
+	var l []int
+	for _, v := range []any{&n, &s, &l} {
+		if err := d.Decode(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n != 1 || s != "spam" || len(l) != 0 {
+		t.Fatalf("decoded %d %q %v", n, s, l)
+	}
+	var rest any
+	if err := d.Decode(&rest); err != io.EOF {
+		t.Fatalf("Decode at the end returned %v, want io.EOF", err)
+	}
+}
+
+func TestMaxStringLength(t *testing.T) {
+	d := NewDecoder(strings.NewReader("5:hello"))
+	d.MaxStringLength = 4
+	var s string
+	if err := d.Decode(&s); err == nil {
+		t.Fatal("string over MaxStringLength was accepted")
+	}
+
+	d = NewDecoder(strings.NewReader("4:hell"))
+	d.MaxStringLength = 4
+	if err := d.Decode(&s); err != nil || s != "hell" {
+		t.Fatalf("string at MaxStringLength: %q %v", s, err)
+	}
+
+	// a length prefix bigger than the input fails without allocating it
+	var huge string
+	err := Unmarshal(strings.NewReader("60000000:x"), &huge)
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("truncated string returned %v, want io.ErrUnexpectedEOF", err)
+	}
+}
+
+func TestMaxDepth(t *testing.T) {
+	nested := func(depth int) string {
+		return strings.Repeat("l", depth) + strings.Repeat("e", depth)
+	}
+	d := NewDecoder(strings.NewReader(nested(4)))
+	d.MaxDepth = 4
+	var v any
+	if err := d.Decode(&v); err != nil {
+		t.Fatalf("nesting at MaxDepth: %v", err)
+	}
+
+	d = NewDecoder(strings.NewReader(nested(5)))
+	d.MaxDepth = 4
+	if err := d.Decode(&v); err == nil {
+		t.Fatal("nesting over MaxDepth was accepted")
+	}
+
+	// the default keeps hostile input from exhausting the stack
+	if err := Unmarshal(strings.NewReader(nested(DefaultMaxDepth+1)), &v); err == nil {
+		t.Fatal("nesting over DefaultMaxDepth was accepted")
+	}
+}
+
+func TestRawMessageKeepsInfoBytes(t *testing.T) {
+	// keys out of order and a zero padded integer, as some torrent makers
+	// write them, re-encoding would change the info hash
+	info := "d4:name4:data12:piece lengthi016384e6:lengthi10ee"
+	data := "d8:announce14:http://tracker4:info" + info + "e"
+
+	var meta struct {
+		Announce string     `bencode:"announce"`
+		Info     RawMessage `bencode:"info"`
+	}
+	if err := Unmarshal(strings.NewReader(data), &meta); err != nil {
+		t.Fatal(err)
+	}
+	if string(meta.Info) != info {
+		t.Fatalf("info kept as %q, want %q", meta.Info, info)
+	}
+	if sha1.Sum(meta.Info) != sha1.Sum([]byte(info)) {
+		t.Fatal("info hash does not match the bytes of the file")
+	}
+
+	var fields struct {
+		Name        string `bencode:"name"`
+		PieceLength int    `bencode:"piece length"`
+		Length      int    `bencode:"length"`
+	}
+	if err := Unmarshal(bytes.NewReader(meta.Info), &fields); err != nil {
+		t.Fatal(err)
+	}
+	if fields.Name != "data" || fields.PieceLength != 16384 || fields.Length != 10 {
+		t.Fatalf("info decoded as %+v", fields)
+	}
+
+	// written back untouched
+	var buf bytes.Buffer
+	if err := Marshal(&buf, meta); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != data {
+		t.Fatalf("encoded as %q, want %q", buf.String(), data)
+	}
+}
@@ -0,0 +1,156 @@
+package bencode
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Encoder writes bencoded values, each one in a single write so a failed
+// encoding leaves nothing behind
+type Encoder struct {
+	w io.Writer
+}
+
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w: w}
+}
+
+// Marshal writes the encoding of v to w
+func Marshal(w io.Writer, v any) error {
+	return NewEncoder(w).Encode(v)
+}
+
+func (e *Encoder) Encode(v any) error {
+	var buf bytes.Buffer
+	err := encode(&buf, reflect.ValueOf(v))
+	if err != nil {
+		return err
+	}
+	_, err = e.w.Write(buf.Bytes())
+	return err
+}
+
+func writeString(buf *bytes.Buffer, s []byte) {
+	buf.WriteString(strconv.Itoa(len(s)))
+	buf.WriteByte(':')
+	buf.Write(s)
+}
+
+func encode(buf *bytes.Buffer, v reflect.Value) error {
+	if !v.IsValid() {
+		return errors.New("bencode: cannot encode nil")
+	}
+	if v.Type() == rawMessageType {
+		if v.Len() == 0 {
+			return errors.New("bencode: empty RawMessage")
+		}
+		buf.Write(v.Bytes())
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			return errors.New("bencode: cannot encode nil")
+		}
+		return encode(buf, v.Elem())
+	case reflect.String:
+		writeString(buf, []byte(v.String()))
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		buf.WriteByte('i')
+		buf.WriteString(strconv.FormatInt(v.Int(), 10))
+		buf.WriteByte('e')
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		buf.WriteByte('i')
+		buf.WriteString(strconv.FormatUint(v.Uint(), 10))
+		buf.WriteByte('e')
+	case reflect.Bool:
+		if v.Bool() {
+			buf.WriteString("i1e")
+		} else {
+			buf.WriteString("i0e")
+		}
+	case reflect.Slice, reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			if v.Kind() == reflect.Slice {
+				writeString(buf, v.Bytes())
+				return nil
+			}
+			s := make([]byte, v.Len())
+			reflect.Copy(reflect.ValueOf(s), v)
+			writeString(buf, s)
+			return nil
+		}
+		buf.WriteByte('l')
+		for i := range v.Len() {
+			err := encode(buf, v.Index(i))
+			if err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('e')
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return fmt.Errorf("bencode: cannot encode %s, keys must be strings", v.Type())
+		}
+		keys := v.MapKeys()
+		slices.SortFunc(keys, func(a, b reflect.Value) int {
+			return strings.Compare(a.String(), b.String())
+		})
+		buf.WriteByte('d')
+		for _, key := range keys {
+			writeString(buf, []byte(key.String()))
+			err := encode(buf, v.MapIndex(key))
+			if err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('e')
+	case reflect.Struct:
+		buf.WriteByte('d')
+		for _, f := range fields(v.Type()) {
+			fv := v.Field(f.index)
+			if (f.omitEmpty && isEmpty(fv)) || isNil(fv) {
+				continue
+			}
+			writeString(buf, []byte(f.key))
+			err := encode(buf, fv)
+			if err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('e')
+	default:
+		return fmt.Errorf("bencode: cannot encode %s", v.Type())
+	}
+	return nil
+}
+
+func isNil(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		return v.IsNil()
+	}
+	return false
+}
+
+func isEmpty(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return v.Uint() == 0
+	case reflect.Pointer, reflect.Interface:
+		return v.IsNil()
+	}
+	return false
+}
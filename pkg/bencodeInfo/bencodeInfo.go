@@ -1,10 +1,22 @@
 package bencodeinfo
 
-import "fmt"
+import (
+	"fmt"
+	"strings"
+)
 
 type File struct {
 	Length int      `bencode:"length"`
 	Path   []string `bencode:"path"`
+	Md5sum string   `bencode:"md5sum,omitempty"`
+	// Attr flags the file as executable (x), hidden (h), padding (p) or a
+	// symlink (l) to SymlinkPath, see BEP 47
+	Attr        string   `bencode:"attr,omitempty"`
+	SymlinkPath []string `bencode:"symlink path,omitempty"`
+}
+
+func (f *File) IsPadding() bool {
+	return strings.Contains(f.Attr, "p")
 }
 
 type BencodeInfo struct {
@@ -13,6 +25,20 @@ type BencodeInfo struct {
 	Length      int    `bencode:"length,omitempty"`
 	Name        string `bencode:"name"`
 	Files       []File `bencode:"files,omitempty"`
+	// Private is 1 for torrents whose peers only come from their trackers,
+	// see BEP 27
+	Private int `bencode:"private,omitempty"`
+	// Source tells apart the copies of a torrent uploaded to different
+	// private trackers
+	Source string `bencode:"source,omitempty"`
+	Md5sum string `bencode:"md5sum,omitempty"`
+	// Attr and SymlinkPath are for single file torrents what File has
+	Attr        string   `bencode:"attr,omitempty"`
+	SymlinkPath []string `bencode:"symlink path,omitempty"`
+}
+
+func (i *BencodeInfo) IsPrivate() bool {
+	return i.Private == 1
 }
 
 func (i *BencodeInfo) SplitPieceHashes() ([][20]byte, error) {
@@ -30,3 +56,16 @@ func (i *BencodeInfo) SplitPieceHashes() ([][20]byte, error) {
 	}
 	return hashes, nil
 }
+
+// TotalLength is the size of the whole payload, for multi file torrents
+// the sum of every file
+func (i *BencodeInfo) TotalLength() int {
+	if len(i.Files) == 0 {
+		return i.Length
+	}
+	total := 0
+	for _, f := range i.Files {
+		total += f.Length
+	}
+	return total
+}
@@ -1,12 +1,147 @@
 package bencodetorrent
 
 import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/TheLox95/go-torrent-client/pkg/bencode"
 	bencodeinfo "github.com/TheLox95/go-torrent-client/pkg/bencodeInfo"
 )
 
 type BencodeTorrent struct {
-	Announce     string                  `bencode:"announce"`
-	AnnounceList [][]string              `bencode:"announce-list"`
-	Info         bencodeinfo.BencodeInfo `bencode:"info"`
-	RawInfo      []byte                  `bencode:"info"`
+	Announce     string     `bencode:"announce"`
+	AnnounceList [][]string `bencode:"announce-list"`
+	Comment      string     `bencode:"comment,omitempty"`
+	CreatedBy    string     `bencode:"created by,omitempty"`
+	// CreationDate is in seconds since the epoch, see CreatedAt
+	CreationDate int64 `bencode:"creation date,omitempty"`
+	// Encoding is the character set of the strings, UTF-8 when empty
+	Encoding string `bencode:"encoding,omitempty"`
+	// URLList are the web seeds of BEP 19, a single url or a list of them,
+	// see WebSeeds
+	URLList bencode.RawMessage `bencode:"url-list,omitempty"`
+	// HTTPSeeds are the web seeds of BEP 17
+	HTTPSeeds []string `bencode:"httpseeds,omitempty"`
+	// Nodes are DHT nodes to bootstrap from as [host, port] pairs, see
+	// DHTNodes
+	Nodes bencode.RawMessage      `bencode:"nodes,omitempty"`
+	Info  bencodeinfo.BencodeInfo `bencode:"-"`
+	// RawInfo is the info dictionary as the file has it, the info hash is
+	// computed from it
+	RawInfo bencode.RawMessage `bencode:"info"`
+}
+
+func Open(path string) (*BencodeTorrent, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read torrent file: %w", err)
+	}
+	return Parse(data)
+}
+
+func Parse(data []byte) (*BencodeTorrent, error) {
+	bto := &BencodeTorrent{}
+	err := bencode.Unmarshal(bytes.NewReader(data), bto)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse torrent file: %w", err)
+	}
+	if len(bto.RawInfo) == 0 {
+		return nil, errors.New("torrent file has no info dictionary")
+	}
+	err = bencode.Unmarshal(bytes.NewReader(bto.RawInfo), &bto.Info)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse torrent info: %w", err)
+	}
+	return bto, nil
+}
+
+// InfoHash hashes the info dictionary as it was read, keys this client
+// does not know about included. Torrents built in memory have their Info
+// encoded instead.
+func (b *BencodeTorrent) InfoHash() ([20]byte, error) {
+	if len(b.RawInfo) > 0 {
+		return sha1.Sum(b.RawInfo), nil
+	}
+	var buf bytes.Buffer
+	err := bencode.Marshal(&buf, b.Info)
+	if err != nil {
+		return [20]byte{}, fmt.Errorf("could not Marshal encodeInfo: %w", err)
+	}
+	return sha1.Sum(buf.Bytes()), nil
+}
+
+// Trackers merges announce and announce-list without duplicates
+func (b *BencodeTorrent) Trackers() []string {
+	trackers := make([]string, 0, len(b.AnnounceList)+1)
+	for _, tier := range b.AnnounceList {
+		for _, url := range tier {
+			if url != "" {
+				trackers = append(trackers, url)
+			}
+		}
+	}
+	if b.Announce != "" {
+		trackers = append(trackers, b.Announce)
+	}
+	slices.Sort(trackers)
+	return slices.Compact(trackers)
+}
+
+// CreatedAt is the creation date, the zero time when the torrent has none
+func (b *BencodeTorrent) CreatedAt() time.Time {
+	if b.CreationDate <= 0 {
+		return time.Time{}
+	}
+	return time.Unix(b.CreationDate, 0)
+}
+
+// WebSeeds are the urls of url-list, which can be a single string or a
+// list of them
+func (b *BencodeTorrent) WebSeeds() []string {
+	if len(b.URLList) == 0 {
+		return nil
+	}
+	var single string
+	if bencode.Unmarshal(bytes.NewReader(b.URLList), &single) == nil {
+		if single == "" {
+			return nil
+		}
+		return []string{single}
+	}
+	var list []string
+	if bencode.Unmarshal(bytes.NewReader(b.URLList), &list) != nil {
+		return nil
+	}
+	return slices.DeleteFunc(list, func(url string) bool {
+		return url == ""
+	})
+}
+
+// DHTNodes are the nodes as host:port, entries that are not a host and a
+// port are skipped
+func (b *BencodeTorrent) DHTNodes() []string {
+	var entries [][]any
+	if len(b.Nodes) == 0 || bencode.Unmarshal(bytes.NewReader(b.Nodes), &entries) != nil {
+		return nil
+	}
+	nodes := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if len(entry) != 2 {
+			continue
+		}
+		host, ok := entry[0].(string)
+		port, okPort := entry[1].(int64)
+		if !ok || !okPort || port <= 0 || port > 0xffff {
+			continue
+		}
+		nodes = append(nodes, net.JoinHostPort(host, strconv.FormatInt(port, 10)))
+	}
+	return nodes
 }
@@ -11,6 +11,9 @@ func (bf Bitfield) Len() int {
 func (bf Bitfield) HasPiece(index int) bool {
 	byteIndex := index / 8
 	offset := index % 8
+	if index < 0 || byteIndex >= len(bf) {
+		return false
+	}
 	return bf[byteIndex]>>(7-offset)&1 != 0
 }
 
@@ -18,5 +21,8 @@ func (bf Bitfield) HasPiece(index int) bool {
 func (bf Bitfield) SetPiece(index int) {
 	byteIndex := index / 8
 	offset := index % 8
+	if index < 0 || byteIndex >= len(bf) {
+		return
+	}
 	bf[byteIndex] |= 1 << (7 - offset)
 }
@@ -0,0 +1,203 @@
+package choker
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"sort"
+	"time"
+
+	"github.com/TheLox95/go-torrent-client/pkg/peer"
+)
+
+const RechokeInterval = 10 * time.Second
+const OptimisticInterval = 30 * time.Second
+
+// SnubTimeout is how long a peer can keep us waiting for data before it
+// loses its regular upload slot
+const SnubTimeout = 60 * time.Second
+
+// NewPeerWindow gives recently connected peers a better chance at the
+// optimistic slot, they have no rate history to compete with yet
+const NewPeerWindow = 60 * time.Second
+
+const DefaultUploadSlots = 4
+
+// Choker implements the tit-for-tat upload policy. While leeching, the
+// peers that give us the most data get the regular slots; while seeding,
+// the peers that take data from us fastest do. One extra slot rotates
+// between choked peers so newcomers can prove themselves.
+type Choker struct {
+	// UploadSlots counts the regular slots plus the optimistic one
+	UploadSlots int
+	Peers       func() []*peer.Peer
+	Seeding     func() bool
+
+	optimistic     *peer.Peer
+	lastOptimistic time.Time
+	lastRechoke    time.Time
+	lastDownloaded map[*peer.Peer]int64
+	lastUploaded   map[*peer.Peer]int64
+	stop           chan struct{}
+}
+
+type candidate struct {
+	peer *peer.Peer
+	rate float64
+}
+
+func (c *Choker) Start() {
+	if c.stop != nil {
+		return
+	}
+	stop := make(chan struct{})
+	c.stop = stop
+	go func() {
+		ticker := time.NewTicker(RechokeInterval)
+		defer ticker.Stop()
+		c.Rechoke(time.Now())
+		for {
+			select {
+			case <-stop:
+				return
+			case now := <-ticker.C:
+				c.Rechoke(now)
+			}
+		}
+	}()
+}
+
+func (c *Choker) Stop() {
+	if c.stop != nil {
+		close(c.stop)
+		c.stop = nil
+	}
+}
+
+func IsSnubbed(p *peer.Peer, now time.Time) bool {
+	stats := p.Stats()
+	if !stats.AmInterested {
+		return false
+	}
+	last := stats.LastPieceAt
+	if last.IsZero() {
+		last = stats.ConnectedAt
+	}
+	return now.Sub(last) > SnubTimeout
+}
+
+func (c *Choker) seeding() bool {
+	return c.Seeding != nil && c.Seeding()
+}
+
+// rates returns bytes per second since the previous round, taken from
+// the peer towards us while leeching and from us towards the peer while
+// seeding
+func (c *Choker) rates(peers []*peer.Peer, now time.Time) map[*peer.Peer]float64 {
+	elapsed := now.Sub(c.lastRechoke).Seconds()
+	if c.lastRechoke.IsZero() || elapsed <= 0 {
+		elapsed = RechokeInterval.Seconds()
+	}
+	downloaded := make(map[*peer.Peer]int64, len(peers))
+	uploaded := make(map[*peer.Peer]int64, len(peers))
+	rates := make(map[*peer.Peer]float64, len(peers))
+	seeding := c.seeding()
+	for _, p := range peers {
+		stats := p.Stats()
+		downloaded[p] = stats.Downloaded
+		uploaded[p] = stats.Uploaded
+		if seeding {
+			rates[p] = float64(stats.Uploaded-c.lastUploaded[p]) / elapsed
+		} else {
+			rates[p] = float64(stats.Downloaded-c.lastDownloaded[p]) / elapsed
+		}
+	}
+	c.lastDownloaded = downloaded
+	c.lastUploaded = uploaded
+	c.lastRechoke = now
+	return rates
+}
+
+func (c *Choker) pickOptimistic(peers []*peer.Peer, now time.Time) {
+	if c.optimistic != nil && now.Sub(c.lastOptimistic) < OptimisticInterval && c.optimistic.HasConnection() {
+		return
+	}
+	c.lastOptimistic = now
+
+	// new peers are three times as likely to be picked
+	pool := make([]*peer.Peer, 0)
+	for _, p := range peers {
+		stats := p.Stats()
+		if !stats.PeerInterested || p == c.optimistic || !stats.AmChoking {
+			continue
+		}
+		pool = append(pool, p)
+		if now.Sub(stats.ConnectedAt) < NewPeerWindow {
+			pool = append(pool, p, p)
+		}
+	}
+	if len(pool) == 0 {
+		if c.optimistic != nil && !c.optimistic.HasConnection() {
+			c.optimistic = nil
+		}
+		return
+	}
+	c.optimistic = pool[rand.IntN(len(pool))]
+}
+
+func (c *Choker) Rechoke(now time.Time) {
+	if c.Peers == nil {
+		return
+	}
+	slots := c.UploadSlots
+	if slots <= 0 {
+		slots = DefaultUploadSlots
+	}
+
+	peers := make([]*peer.Peer, 0)
+	for _, p := range c.Peers() {
+		if p.HasConnection() {
+			peers = append(peers, p)
+		}
+	}
+	rates := c.rates(peers, now)
+	c.pickOptimistic(peers, now)
+	seeding := c.seeding()
+
+	candidates := make([]candidate, 0)
+	for _, p := range peers {
+		if !p.Stats().PeerInterested || p == c.optimistic {
+			continue
+		}
+		// anti-snubbing, a peer that stopped sending to us only keeps
+		// getting data through the optimistic slot
+		if !seeding && IsSnubbed(p, now) {
+			continue
+		}
+		candidates = append(candidates, candidate{peer: p, rate: rates[p]})
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].rate > candidates[j].rate
+	})
+
+	regular := slots - 1
+	unchoke := make(map[*peer.Peer]bool)
+	for i := 0; i < len(candidates) && i < regular; i++ {
+		unchoke[candidates[i].peer] = true
+	}
+	if c.optimistic != nil {
+		unchoke[c.optimistic] = true
+	}
+
+	for _, p := range peers {
+		var err error
+		amChoking := p.Stats().AmChoking
+		if unchoke[p] && amChoking {
+			err = p.Unchoke()
+		} else if !unchoke[p] && !amChoking {
+			err = p.Choke()
+		}
+		if err != nil {
+			fmt.Println("rechoke failed for", p.GetID(), err)
+		}
+	}
+}
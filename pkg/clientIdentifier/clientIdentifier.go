@@ -3,4 +3,7 @@ package clientidentifier
 type ClientIdentifier struct {
 	PeerID   [20]byte
 	InfoHash [20]byte
+	// UserAgent names us to trackers and in the BEP 10 handshake, left
+	// out when empty
+	UserAgent string
 }
@@ -0,0 +1,111 @@
+package controlserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Client talks to the ControlServer of a running session
+type Client struct {
+	Addr string
+	http http.Client
+}
+
+func NewClient(addr string) *Client {
+	return &Client{Addr: addr, http: http.Client{Timeout: 30 * time.Second}}
+}
+
+func (c *Client) url(path string) string {
+	addr := c.Addr
+	if strings.HasPrefix(addr, ":") {
+		addr = "127.0.0.1" + addr
+	}
+	return "http://" + addr + path
+}
+
+func (c *Client) List() ([]TorrentStatus, error) {
+	resp, err := c.http.Get(c.url("/torrents"))
+	if err != nil {
+		return nil, fmt.Errorf("could not reach the session: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, readError(resp)
+	}
+	list := make([]TorrentStatus, 0)
+	err = json.NewDecoder(resp.Body).Decode(&list)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse torrent list: %w", err)
+	}
+	return list, nil
+}
+
+func (c *Client) Pause(infoHash string) error {
+	return c.action(infoHash, "pause")
+}
+
+func (c *Client) Resume(infoHash string) error {
+	return c.action(infoHash, "resume")
+}
+
+// SetLimits changes the global rate limits of the session
+func (c *Client) SetLimits(limits Limits) error {
+	return c.post("/limits", limits)
+}
+
+func (c *Client) SetTorrentLimits(infoHash string, limits Limits) error {
+	if _, err := ParseInfoHash(infoHash); err != nil {
+		return err
+	}
+	return c.post("/torrents/"+infoHash+"/limits", limits)
+}
+
+// SetPeerLimits changes the limits of every peer of a torrent
+func (c *Client) SetPeerLimits(infoHash string, limits Limits) error {
+	if _, err := ParseInfoHash(infoHash); err != nil {
+		return err
+	}
+	return c.post("/torrents/"+infoHash+"/peer-limits", limits)
+}
+
+func (c *Client) action(infoHash string, action string) error {
+	if _, err := ParseInfoHash(infoHash); err != nil {
+		return err
+	}
+	return c.post("/torrents/"+infoHash+"/"+action, nil)
+}
+
+// post sends body as JSON, nil for none
+func (c *Client) post(path string, body any) error {
+	var reader io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(encoded)
+	}
+	resp, err := c.http.Post(c.url(path), "application/json", reader)
+	if err != nil {
+		return fmt.Errorf("could not reach the session: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		return readError(resp)
+	}
+	return nil
+}
+
+func readError(resp *http.Response) error {
+	body := errorResponse{}
+	err := json.NewDecoder(resp.Body).Decode(&body)
+	if err != nil || body.Error == "" {
+		return fmt.Errorf("session answered %s", resp.Status)
+	}
+	return fmt.Errorf("session answered %s: %s", resp.Status, body.Error)
+}
@@ -0,0 +1,209 @@
+package controlserver
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/TheLox95/go-torrent-client/pkg/session"
+)
+
+// ControlServer lets another process drive a running session:
+//
+//	GET  /torrents                    lists the torrents in queue order
+//	POST /torrents/<hash>/pause       pauses a torrent
+//	POST /torrents/<hash>/resume      queues it again
+//	POST /limits                      sets the global rate limits
+//	POST /torrents/<hash>/limits      sets the rate limits of a torrent
+//	POST /torrents/<hash>/peer-limits sets the limits of each of its peers
+//
+// Limits take a Limits body and apply to open connections right away. A
+// -schedule puts its own global limits back when its next rule starts.
+type ControlServer struct {
+	Addr    string
+	Session *session.Session
+	server  *http.Server
+}
+
+type TorrentStatus struct {
+	InfoHash      string       `json:"info_hash"`
+	Name          string       `json:"name"`
+	State         string       `json:"state"`
+	QueuePosition int          `json:"queue_position"`
+	DownloadRate  float64      `json:"download_rate"`
+	UploadRate    float64      `json:"upload_rate"`
+	Error         string       `json:"error,omitempty"`
+	Peers         []PeerStatus `json:"peers,omitempty"`
+}
+
+type PeerStatus struct {
+	Address string `json:"address"`
+	Client  string `json:"client"`
+}
+
+// Limits are in bytes per second, 0 for unlimited
+type Limits struct {
+	Download int `json:"download"`
+	Upload   int `json:"upload"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+func (s *ControlServer) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/torrents", s.serveList)
+	mux.HandleFunc("/torrents/", s.serveAction)
+	mux.HandleFunc("/limits", s.serveLimits)
+	return mux
+}
+
+// Start listens in the background, the error only covers binding
+func (s *ControlServer) Start() error {
+	listener, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		return fmt.Errorf("could not listen on %s: %w", s.Addr, err)
+	}
+	s.server = &http.Server{Handler: s.Handler(), ReadHeaderTimeout: 10 * time.Second}
+	fmt.Println("control server on", listener.Addr().String())
+	go func() {
+		err := s.server.Serve(listener)
+		if err != nil && err != http.ErrServerClosed {
+			fmt.Println("control server stopped:", err)
+		}
+	}()
+	return nil
+}
+
+func (s *ControlServer) Stop() error {
+	if s.server == nil {
+		return nil
+	}
+	return s.server.Close()
+}
+
+func (s *ControlServer) serveList(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, errorResponse{Error: "method not allowed"})
+		return
+	}
+	list := make([]TorrentStatus, 0)
+	for idx, t := range s.Session.Torrents() {
+		download, upload := t.Rates()
+		status := TorrentStatus{
+			InfoHash:      hex.EncodeToString(t.InfoHash[:]),
+			Name:          t.Name(),
+			State:         t.State().String(),
+			QueuePosition: idx,
+			DownloadRate:  download,
+			UploadRate:    upload,
+		}
+		if t.Err() != nil {
+			status.Error = t.Err().Error()
+		}
+		for _, p := range t.Peers.ConnectedPeers() {
+			status.Peers = append(status.Peers, PeerStatus{Address: p.GetID(), Client: p.Client()})
+		}
+		list = append(list, status)
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+func (s *ControlServer) serveAction(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, errorResponse{Error: "method not allowed"})
+		return
+	}
+	// /torrents/<hash>/<action>
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/torrents/"), "/")
+	if len(parts) != 2 {
+		writeJSON(w, http.StatusNotFound, errorResponse{Error: "not found"})
+		return
+	}
+	infoHash, err := ParseInfoHash(parts[0])
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, errorResponse{Error: err.Error()})
+		return
+	}
+	switch parts[1] {
+	case "pause":
+		err = s.Session.Pause(infoHash)
+	case "resume":
+		err = s.Session.Resume(infoHash)
+	case "limits", "peer-limits":
+		limits, ok := readLimits(w, r)
+		if !ok {
+			return
+		}
+		t := s.Session.Torrent(infoHash)
+		if t == nil {
+			err = session.ErrUnknownTorrent
+		} else if parts[1] == "limits" {
+			t.Limits.SetLimits(limits.Download, limits.Upload)
+		} else {
+			t.Peers.SetPeerRateLimits(limits.Download, limits.Upload)
+		}
+	default:
+		writeJSON(w, http.StatusNotFound, errorResponse{Error: "unknown action " + parts[1]})
+		return
+	}
+	if errors.Is(err, session.ErrUnknownTorrent) {
+		writeJSON(w, http.StatusNotFound, errorResponse{Error: err.Error()})
+		return
+	}
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, errorResponse{Error: err.Error()})
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *ControlServer) serveLimits(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, errorResponse{Error: "method not allowed"})
+		return
+	}
+	limits, ok := readLimits(w, r)
+	if !ok {
+		return
+	}
+	s.Session.GlobalLimits.SetLimits(limits.Download, limits.Upload)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// readLimits answers the request itself when the body is not valid
+func readLimits(w http.ResponseWriter, r *http.Request) (Limits, bool) {
+	limits := Limits{}
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1024)).Decode(&limits)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, errorResponse{Error: "invalid limits: " + err.Error()})
+		return limits, false
+	}
+	if limits.Download < 0 || limits.Upload < 0 {
+		writeJSON(w, http.StatusBadRequest, errorResponse{Error: "limits can not be negative"})
+		return limits, false
+	}
+	return limits, true
+}
+
+func writeJSON(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func ParseInfoHash(raw string) ([20]byte, error) {
+	var infoHash [20]byte
+	decoded, err := hex.DecodeString(raw)
+	if err != nil || len(decoded) != len(infoHash) {
+		return infoHash, fmt.Errorf("invalid info hash %q", raw)
+	}
+	copy(infoHash[:], decoded)
+	return infoHash, nil
+}
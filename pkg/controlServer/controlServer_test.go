@@ -0,0 +1,36 @@
+package controlserver
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/TheLox95/go-torrent-client/pkg/session"
+)
+
+func TestSetLimits(t *testing.T) {
+	s := session.New([20]byte{1})
+	defer s.Close()
+	server := httptest.NewServer((&ControlServer{Session: s}).Handler())
+	defer server.Close()
+	c := NewClient(strings.TrimPrefix(server.URL, "http://"))
+
+	err := c.SetLimits(Limits{Download: 4096, Upload: 2048})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.GlobalLimits.Download.Limit() != 4096 || s.GlobalLimits.Upload.Limit() != 2048 {
+		t.Fatalf("global limits %d/%d", s.GlobalLimits.Download.Limit(), s.GlobalLimits.Upload.Limit())
+	}
+
+	if err := c.SetLimits(Limits{Download: -1}); err == nil {
+		t.Fatal("negative limit was accepted")
+	}
+	unknown := strings.Repeat("ab", 20)
+	if err := c.SetTorrentLimits(unknown, Limits{}); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Fatalf("limits of an unknown torrent returned %v, want 404", err)
+	}
+	if err := c.SetPeerLimits(unknown, Limits{}); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Fatalf("peer limits of an unknown torrent returned %v, want 404", err)
+	}
+}
@@ -0,0 +1,410 @@
+// Package dht is a node of the mainline DHT (BEP 5), torrents use it to
+// find peers their trackers do not know about. Only IPv4 is spoken.
+package dht
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	ipfilter "github.com/TheLox95/go-torrent-client/pkg/ipFilter"
+)
+
+// DefaultBootstrap are well known nodes a table with nobody in it starts
+// from
+var DefaultBootstrap = []string{
+	"router.bittorrent.com:6881",
+	"dht.transmissionbt.com:6881",
+	"router.utorrent.com:6881",
+}
+
+// queryTimeout is how long a node has to answer
+const queryTimeout = 3 * time.Second
+
+// refreshInterval is how often the table is filled again around our id
+const refreshInterval = 15 * time.Minute
+
+// tokenRotation is how often the announce token secret changes, tokens of
+// the previous secret stay valid
+const tokenRotation = 5 * time.Minute
+
+// peerTTL is how long an announced peer is handed out
+const peerTTL = 30 * time.Minute
+
+// maxPeersPerTorrent and maxTorrents bound what announces can make us
+// store
+const maxPeersPerTorrent = 200
+const maxTorrents = 2000
+
+var ErrClosed = errors.New("dht: closed")
+
+// transaction is a query waiting for the node it was sent to
+type transaction struct {
+	addr   *net.UDPAddr
+	answer chan *message
+}
+
+type DHT struct {
+	// Port is the UDP port we listen on
+	Port int
+	ID   [20]byte
+	// Bootstrap nodes are asked when the table is empty
+	Bootstrap []string
+	// Filter keeps blocked addresses out of the table, nil to allow all
+	Filter *ipfilter.Filter
+
+	conn         net.PacketConn
+	table        table
+	transactions map[string]*transaction
+	nextTID      uint16
+	// peers are the ones announced to us, by info hash and compact address
+	peers          map[[20]byte]map[string]time.Time
+	secret         [20]byte
+	previousSecret [20]byte
+	secretAt       time.Time
+	ctx            context.Context
+	cancel         context.CancelFunc
+	mu             sync.Mutex
+}
+
+// New makes a node with a random id listening on port once started
+func New(port int) (*DHT, error) {
+	d := &DHT{Port: port, Bootstrap: DefaultBootstrap}
+	_, err := rand.Read(d.ID[:])
+	if err != nil {
+		return nil, fmt.Errorf("could not make a node id: %w", err)
+	}
+	return d, nil
+}
+
+// Start listens on Port and fills the table in the background, everything
+// stops with ctx or Close
+func (d *DHT) Start(ctx context.Context) error {
+	conn, err := net.ListenPacket("udp4", net.JoinHostPort("", strconv.Itoa(d.Port)))
+	if err != nil {
+		return fmt.Errorf("could not listen on udp port %d: %w", d.Port, err)
+	}
+	d.mu.Lock()
+	d.conn = conn
+	d.table.self = d.ID
+	d.transactions = make(map[string]*transaction)
+	d.peers = make(map[[20]byte]map[string]time.Time)
+	d.ctx, d.cancel = context.WithCancel(ctx)
+	d.rotateSecret(time.Now())
+	ctx = d.ctx
+	d.mu.Unlock()
+	context.AfterFunc(ctx, func() {
+		conn.Close()
+	})
+	fmt.Println("dht listening on", conn.LocalAddr().String())
+	go d.serve(conn)
+	go d.refresh(ctx)
+	return nil
+}
+
+func (d *DHT) Close() error {
+	d.mu.Lock()
+	cancel := d.cancel
+	d.mu.Unlock()
+	if cancel == nil {
+		return nil
+	}
+	cancel()
+	return nil
+}
+
+// Nodes is how many nodes the routing table holds
+func (d *DHT) Nodes() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.table.len()
+}
+
+// AddNode pings a node, it joins the table if it answers. Torrents pass
+// the nodes their metainfo lists.
+func (d *DHT) AddNode(hostPort string) {
+	d.mu.Lock()
+	ctx := d.ctx
+	d.mu.Unlock()
+	if ctx == nil {
+		return
+	}
+	go func() {
+		addr, err := net.ResolveUDPAddr("udp4", hostPort)
+		if err != nil {
+			return
+		}
+		d.query(ctx, addr, "ping", &arguments{})
+	}()
+}
+
+func (d *DHT) refresh(ctx context.Context) {
+	for {
+		_, _, err := d.lookup(ctx, d.ID, false)
+		if err != nil && ctx.Err() == nil {
+			fmt.Println("dht refresh failed:", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(refreshInterval):
+		}
+	}
+}
+
+func (d *DHT) blocked(addr *net.UDPAddr) bool {
+	return addr.Port == 0 || d.Filter.Blocked(addr.IP)
+}
+
+func (d *DHT) serve(conn net.PacketConn) {
+	buf := make([]byte, 64*1024)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		addr, ok := from.(*net.UDPAddr)
+		if !ok || d.blocked(addr) {
+			continue
+		}
+		msg, err := decodeMessage(buf[:n])
+		if err != nil {
+			continue
+		}
+		switch msg.Y {
+		case "q":
+			d.handleQuery(addr, msg)
+		case "r", "e":
+			d.mu.Lock()
+			waiting, ok := d.transactions[msg.T]
+			// answers from anyone but the node asked are ignored
+			ok = ok && waiting.addr.IP.Equal(addr.IP) && waiting.addr.Port == addr.Port
+			if ok {
+				delete(d.transactions, msg.T)
+			}
+			d.mu.Unlock()
+			if ok {
+				waiting.answer <- msg
+			}
+		}
+	}
+}
+
+func (d *DHT) send(addr *net.UDPAddr, msg *message) error {
+	packet, err := encodeMessage(msg)
+	if err != nil {
+		return err
+	}
+	d.mu.Lock()
+	conn := d.conn
+	d.mu.Unlock()
+	if conn == nil {
+		return ErrClosed
+	}
+	_, err = conn.WriteTo(packet, addr)
+	return err
+}
+
+// query sends a query and waits for its answer, the node that answered
+// is added to the table and one that did not loses standing
+func (d *DHT) query(ctx context.Context, addr *net.UDPAddr, method string, args *arguments) (*response, error) {
+	if d.blocked(addr) {
+		return nil, errors.New("dht: node is blocked")
+	}
+	args.ID = string(d.ID[:])
+	d.mu.Lock()
+	d.nextTID++
+	tid := string(binary.BigEndian.AppendUint16(nil, d.nextTID))
+	answer := make(chan *message, 1)
+	d.transactions[tid] = &transaction{addr: addr, answer: answer}
+	d.mu.Unlock()
+	defer func() {
+		d.mu.Lock()
+		delete(d.transactions, tid)
+		d.mu.Unlock()
+	}()
+
+	err := d.send(addr, &message{T: tid, Y: "q", Q: method, A: args})
+	if err != nil {
+		return nil, err
+	}
+	timeout := time.NewTimer(queryTimeout)
+	defer timeout.Stop()
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-timeout.C:
+		d.mu.Lock()
+		d.table.failed(addr)
+		d.mu.Unlock()
+		return nil, errors.New("dht: query timed out")
+	case msg := <-answer:
+		if msg.Y == "e" {
+			return nil, remoteError(msg.E)
+		}
+		if msg.R == nil || len(msg.R.ID) != 20 {
+			return nil, errors.New("dht: malformed response")
+		}
+		var id [20]byte
+		copy(id[:], msg.R.ID)
+		d.mu.Lock()
+		d.table.seen(id, addr, time.Now())
+		d.mu.Unlock()
+		return msg.R, nil
+	}
+}
+
+func (d *DHT) reply(addr *net.UDPAddr, tid string, r *response) {
+	r.ID = string(d.ID[:])
+	d.send(addr, &message{T: tid, Y: "r", R: r})
+}
+
+func (d *DHT) replyError(addr *net.UDPAddr, tid string, code int, text string) {
+	d.send(addr, &message{T: tid, Y: "e", E: []any{code, text}})
+}
+
+func (d *DHT) handleQuery(addr *net.UDPAddr, msg *message) {
+	if msg.A == nil || len(msg.A.ID) != 20 {
+		d.replyError(addr, msg.T, errorProtocol, "Protocol Error")
+		return
+	}
+	var id [20]byte
+	copy(id[:], msg.A.ID)
+	now := time.Now()
+	d.mu.Lock()
+	d.table.seen(id, addr, now)
+	d.mu.Unlock()
+
+	switch msg.Q {
+	case "ping":
+		d.reply(addr, msg.T, &response{})
+	case "find_node":
+		if len(msg.A.Target) != 20 {
+			d.replyError(addr, msg.T, errorProtocol, "Protocol Error")
+			return
+		}
+		d.reply(addr, msg.T, &response{Nodes: d.closestNodes(msg.A.Target)})
+	case "get_peers":
+		if len(msg.A.InfoHash) != 20 {
+			d.replyError(addr, msg.T, errorProtocol, "Protocol Error")
+			return
+		}
+		var infoHash [20]byte
+		copy(infoHash[:], msg.A.InfoHash)
+		d.reply(addr, msg.T, &response{
+			Nodes:  d.closestNodes(msg.A.InfoHash),
+			Values: d.storedPeers(infoHash, now),
+			Token:  d.token(addr.IP, now),
+		})
+	case "announce_peer":
+		if len(msg.A.InfoHash) != 20 || !d.validToken(addr.IP, msg.A.Token, now) {
+			d.replyError(addr, msg.T, errorProtocol, "Bad Token")
+			return
+		}
+		port := msg.A.Port
+		if msg.A.ImpliedPort != 0 {
+			port = addr.Port
+		}
+		if port <= 0 || port > 0xffff {
+			d.replyError(addr, msg.T, errorProtocol, "Bad Port")
+			return
+		}
+		var infoHash [20]byte
+		copy(infoHash[:], msg.A.InfoHash)
+		compact, ok := compactAddr(&net.UDPAddr{IP: addr.IP, Port: port})
+		if !ok || !d.storePeer(infoHash, string(compact), now) {
+			d.replyError(addr, msg.T, errorGeneric, "Server Error")
+			return
+		}
+		d.reply(addr, msg.T, &response{})
+	default:
+		d.replyError(addr, msg.T, errorMethod, "Method Unknown")
+	}
+}
+
+func (d *DHT) closestNodes(target string) string {
+	var id [20]byte
+	copy(id[:], target)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return encodeNodes(d.table.closest(id, K))
+}
+
+// rotateSecret changes the token secret when it is due, callers hold mu
+func (d *DHT) rotateSecret(now time.Time) {
+	if now.Sub(d.secretAt) < tokenRotation {
+		return
+	}
+	d.previousSecret = d.secret
+	rand.Read(d.secret[:])
+	d.secretAt = now
+}
+
+func tokenFor(secret [20]byte, ip net.IP) string {
+	sum := sha1.Sum(append(secret[:], ip.To16()...))
+	return string(sum[:8])
+}
+
+// token is what a node must send back to announce itself from ip
+func (d *DHT) token(ip net.IP, now time.Time) string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.rotateSecret(now)
+	return tokenFor(d.secret, ip)
+}
+
+func (d *DHT) validToken(ip net.IP, token string, now time.Time) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.rotateSecret(now)
+	return token != "" && (token == tokenFor(d.secret, ip) || token == tokenFor(d.previousSecret, ip))
+}
+
+// storePeer keeps a peer announced in compact form
+func (d *DHT) storePeer(infoHash [20]byte, compact string, now time.Time) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	peers, ok := d.peers[infoHash]
+	if !ok {
+		if len(d.peers) >= maxTorrents {
+			return false
+		}
+		peers = make(map[string]time.Time)
+		d.peers[infoHash] = peers
+	}
+	if _, ok := peers[compact]; !ok && len(peers) >= maxPeersPerTorrent {
+		return false
+	}
+	peers[compact] = now
+	return true
+}
+
+// storedPeers hands out the peers announced for a torrent in compact form,
+// dropping the expired ones
+func (d *DHT) storedPeers(infoHash [20]byte, now time.Time) []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	peers := d.peers[infoHash]
+	values := []string{}
+	for compact, at := range peers {
+		if now.Sub(at) > peerTTL {
+			delete(peers, compact)
+			continue
+		}
+		values = append(values, compact)
+	}
+	if len(peers) == 0 {
+		delete(d.peers, infoHash)
+	}
+	return values
+}
@@ -0,0 +1,66 @@
+package dht
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func startNode(t *testing.T, bootstrap ...string) *DHT {
+	t.Helper()
+	d, err := New(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.Bootstrap = bootstrap
+	if err := d.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { d.Close() })
+	return d
+}
+
+func waitForNodes(t *testing.T, d *DHT) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for d.Nodes() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("the node did not join the network")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestAnnounceOnLoopback(t *testing.T) {
+	router := startNode(t)
+	routerAddr := "127.0.0.1:" + portOf(router)
+	seeder := startNode(t, routerAddr)
+	leecher := startNode(t, routerAddr)
+	waitForNodes(t, seeder)
+	waitForNodes(t, leecher)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	infoHash := [20]byte{0xde, 0xad}
+	if _, err := seeder.Announce(ctx, infoHash, 7000); err != nil {
+		t.Fatal(err)
+	}
+	peers, err := leecher.Announce(ctx, infoHash, 7001)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range peers {
+		if p.IP.IsLoopback() && p.Port == 7000 {
+			return
+		}
+	}
+	t.Fatalf("found peers %v, want 127.0.0.1:7000", peers)
+}
+
+func portOf(d *DHT) string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	_, port, _ := net.SplitHostPort(d.conn.LocalAddr().String())
+	return port
+}
@@ -0,0 +1,127 @@
+package dht
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/TheLox95/go-torrent-client/pkg/bencode"
+)
+
+// message is a KRPC query, response or error, which one is told by Y
+type message struct {
+	T string     `bencode:"t"`
+	Y string     `bencode:"y"`
+	Q string     `bencode:"q,omitempty"`
+	A *arguments `bencode:"a,omitempty"`
+	R *response  `bencode:"r,omitempty"`
+	E []any      `bencode:"e,omitempty"`
+}
+
+type arguments struct {
+	ID          string `bencode:"id"`
+	Target      string `bencode:"target,omitempty"`
+	InfoHash    string `bencode:"info_hash,omitempty"`
+	Port        int    `bencode:"port,omitempty"`
+	ImpliedPort int    `bencode:"implied_port,omitempty"`
+	Token       string `bencode:"token,omitempty"`
+}
+
+type response struct {
+	ID     string   `bencode:"id"`
+	Nodes  string   `bencode:"nodes,omitempty"`
+	Values []string `bencode:"values,omitempty"`
+	Token  string   `bencode:"token,omitempty"`
+}
+
+// KRPC error codes
+const (
+	errorGeneric  = 201
+	errorProtocol = 203
+	errorMethod   = 204
+)
+
+// compactNodeLength is a node id followed by its IPv4 address and port
+const compactNodeLength = 26
+
+// compactPeerLength is an IPv4 address and port
+const compactPeerLength = 6
+
+func decodeMessage(packet []byte) (*message, error) {
+	msg := &message{}
+	d := bencode.NewDecoder(bytes.NewReader(packet))
+	d.MaxStringLength = len(packet)
+	err := d.Decode(msg)
+	if err != nil {
+		return nil, err
+	}
+	if msg.T == "" {
+		return nil, errors.New("message has no transaction id")
+	}
+	return msg, nil
+}
+
+func encodeMessage(msg *message) ([]byte, error) {
+	var buf bytes.Buffer
+	err := bencode.Marshal(&buf, msg)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// remoteError turns the e list of an error message into an error
+func remoteError(e []any) error {
+	if len(e) < 2 {
+		return errors.New("dht: malformed error")
+	}
+	return fmt.Errorf("dht: remote error %v: %v", e[0], e[1])
+}
+
+func compactAddr(addr *net.UDPAddr) ([]byte, bool) {
+	ip := addr.IP.To4()
+	if ip == nil {
+		return nil, false
+	}
+	buf := make([]byte, compactPeerLength)
+	copy(buf, ip)
+	binary.BigEndian.PutUint16(buf[4:], uint16(addr.Port))
+	return buf, true
+}
+
+func parseCompactAddr(b []byte) *net.UDPAddr {
+	return &net.UDPAddr{
+		IP:   net.IP(bytes.Clone(b[:4])),
+		Port: int(binary.BigEndian.Uint16(b[4:6])),
+	}
+}
+
+func encodeNodes(nodes []*node) string {
+	buf := make([]byte, 0, len(nodes)*compactNodeLength)
+	for _, n := range nodes {
+		addr, ok := compactAddr(n.addr)
+		if !ok {
+			continue
+		}
+		buf = append(buf, n.id[:]...)
+		buf = append(buf, addr...)
+	}
+	return string(buf)
+}
+
+// parseNodes reads the compact node info of a response, entries that do
+// not fit are dropped
+func parseNodes(s string) []*node {
+	nodes := []*node{}
+	for i := 0; i+compactNodeLength <= len(s); i += compactNodeLength {
+		n := &node{addr: parseCompactAddr([]byte(s[i+20 : i+compactNodeLength]))}
+		copy(n.id[:], s[i:i+20])
+		if n.addr.Port == 0 {
+			continue
+		}
+		nodes = append(nodes, n)
+	}
+	return nodes
+}
@@ -0,0 +1,132 @@
+package dht
+
+import (
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestEncodeMessage(t *testing.T) {
+	// the examples of BEP 5
+	tests := []struct {
+		name string
+		msg  *message
+		data string
+	}{
+		{
+			"ping query",
+			&message{T: "aa", Y: "q", Q: "ping", A: &arguments{ID: "abcdefghij0123456789"}},
+			"d1:ad2:id20:abcdefghij0123456789e1:q4:ping1:t2:aa1:y1:qe",
+		},
+		{
+			"ping response",
+			&message{T: "aa", Y: "r", R: &response{ID: "mnopqrstuvwxyz123456"}},
+			"d1:rd2:id20:mnopqrstuvwxyz123456e1:t2:aa1:y1:re",
+		},
+		{
+			"get_peers query",
+			&message{T: "aa", Y: "q", Q: "get_peers", A: &arguments{ID: "abcdefghij0123456789", InfoHash: "mnopqrstuvwxyz123456"}},
+			"d1:ad2:id20:abcdefghij01234567899:info_hash20:mnopqrstuvwxyz123456e1:q9:get_peers1:t2:aa1:y1:qe",
+		},
+		{
+			"get_peers response with peers",
+			&message{T: "aa", Y: "r", R: &response{ID: "abcdefghij0123456789", Token: "aoeusnth", Values: []string{"axje.u", "idhtnm"}}},
+			"d1:rd2:id20:abcdefghij01234567895:token8:aoeusnth6:valuesl6:axje.u6:idhtnmee1:t2:aa1:y1:re",
+		},
+		{
+			"announce_peer query",
+			&message{T: "aa", Y: "q", Q: "announce_peer", A: &arguments{ID: "abcdefghij0123456789", ImpliedPort: 1, InfoHash: "mnopqrstuvwxyz123456", Port: 6881, Token: "aoeusnth"}},
+			"d1:ad2:id20:abcdefghij012345678912:implied_porti1e9:info_hash20:mnopqrstuvwxyz1234564:porti6881e5:token8:aoeusnthe1:q13:announce_peer1:t2:aa1:y1:qe",
+		},
+		{
+			"error",
+			&message{T: "aa", Y: "e", E: []any{201, "A Generic Error Ocurred"}},
+			"d1:eli201e23:A Generic Error Ocurrede1:t2:aa1:y1:ee",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := encodeMessage(tt.msg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != tt.data {
+				t.Fatalf("encoded as\n%s\nwant\n%s", data, tt.data)
+			}
+			msg, err := decodeMessage(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.msg.E != nil {
+				if err := remoteError(msg.E); err == nil || !strings.Contains(err.Error(), "201") {
+					t.Fatalf("remote error read as %v", err)
+				}
+				msg.E, tt.msg.E = nil, nil
+			}
+			if !reflect.DeepEqual(msg, tt.msg) {
+				t.Fatalf("decoded as %+v, want %+v", msg, tt.msg)
+			}
+		})
+	}
+}
+
+func TestDecodeMessageInvalid(t *testing.T) {
+	for _, data := range []string{
+		"",
+		"le",
+		"d1:y1:qe",
+		"d1:t2:aa1:y1:q",
+		"d1:t999999:aa1:y1:qe",
+	} {
+		if _, err := decodeMessage([]byte(data)); err == nil {
+			t.Errorf("decodeMessage(%q) was accepted", data)
+		}
+	}
+	if err := remoteError([]any{201}); err == nil {
+		t.Error("malformed error list was accepted")
+	}
+}
+
+func TestCompactNodes(t *testing.T) {
+	nodes := []*node{
+		{id: [20]byte{1}, addr: &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 6881}},
+		{id: [20]byte{2}, addr: &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 6881}},
+		{id: [20]byte{3}, addr: &net.UDPAddr{IP: net.IPv4(192, 168, 1, 2), Port: 51413}},
+	}
+	encoded := encodeNodes(nodes)
+	// IPv6 nodes do not fit the compact format
+	if len(encoded) != 2*compactNodeLength {
+		t.Fatalf("encoded %d bytes, want %d", len(encoded), 2*compactNodeLength)
+	}
+	// a truncated entry at the end is dropped
+	parsed := parseNodes(encoded + "short")
+	if len(parsed) != 2 {
+		t.Fatalf("parsed %d nodes, want 2", len(parsed))
+	}
+	for i, want := range []*node{nodes[0], nodes[2]} {
+		if parsed[i].id != want.id || !parsed[i].addr.IP.Equal(want.addr.IP) || parsed[i].addr.Port != want.addr.Port {
+			t.Fatalf("node %d parsed as %x %s, want %x %s", i, parsed[i].id, parsed[i].addr, want.id, want.addr)
+		}
+	}
+
+	zeroPort := string(make([]byte, compactNodeLength))
+	if parsed := parseNodes(zeroPort); len(parsed) != 0 {
+		t.Fatal("node with port 0 was accepted")
+	}
+}
+
+func TestCompactAddr(t *testing.T) {
+	addr := &net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 6881}
+	compact, ok := compactAddr(addr)
+	if !ok || string(compact) != "\x01\x02\x03\x04\x1a\xe1" {
+		t.Fatalf("compact address %q", compact)
+	}
+	parsed := parseCompactAddr(compact)
+	if !parsed.IP.Equal(addr.IP) || parsed.Port != addr.Port {
+		t.Fatalf("parsed as %s, want %s", parsed, addr)
+	}
+	if _, ok := compactAddr(&net.UDPAddr{IP: net.ParseIP("::1"), Port: 1}); ok {
+		t.Fatal("IPv6 address has a compact IPv4 form")
+	}
+}
@@ -0,0 +1,171 @@
+package dht
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"slices"
+	"sync"
+)
+
+// alpha is how many nodes a lookup asks at once
+const alpha = 3
+
+// maxLookupRounds stops a lookup that keeps finding closer nodes
+const maxLookupRounds = 20
+
+// contact is a node met during a lookup, bootstrap nodes have no id until
+// they answer
+type contact struct {
+	node
+	hasID   bool
+	queried bool
+	// token is what the node wants back in announce_peer
+	token string
+}
+
+// lookup walks towards target asking the closest nodes it knows for
+// closer ones, get_peers when peers is set and find_node otherwise. It
+// gives the K closest nodes that answered and the peers they sent.
+func (d *DHT) lookup(ctx context.Context, target [20]byte, peers bool) ([]*contact, []*net.TCPAddr, error) {
+	d.mu.Lock()
+	started := d.conn != nil
+	closest := d.table.closest(target, K)
+	d.mu.Unlock()
+	if !started {
+		return nil, nil, ErrClosed
+	}
+	contacts := []*contact{}
+	seen := map[string]bool{}
+	for _, n := range closest {
+		contacts = append(contacts, &contact{node: *n, hasID: true})
+		seen[n.addr.String()] = true
+	}
+	if len(contacts) < K {
+		for _, hostPort := range d.Bootstrap {
+			addr, err := net.ResolveUDPAddr("udp4", hostPort)
+			if err != nil || seen[addr.String()] {
+				continue
+			}
+			seen[addr.String()] = true
+			contacts = append(contacts, &contact{node: node{addr: addr}})
+		}
+	}
+	if len(contacts) == 0 {
+		return nil, nil, errors.New("dht: no nodes to ask")
+	}
+
+	found := []*net.TCPAddr{}
+	foundSeen := map[string]bool{}
+	answered := map[*contact]bool{}
+	var mu sync.Mutex
+	for range maxLookupRounds {
+		sortContacts(contacts, target)
+		batch := []*contact{}
+		for _, c := range contacts[:min(K, len(contacts))] {
+			if !c.queried && len(batch) < alpha {
+				c.queried = true
+				batch = append(batch, c)
+			}
+		}
+		if len(batch) == 0 {
+			break
+		}
+		var wg sync.WaitGroup
+		for _, c := range batch {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				args := &arguments{Target: string(target[:])}
+				method := "find_node"
+				if peers {
+					args = &arguments{InfoHash: string(target[:])}
+					method = "get_peers"
+				}
+				r, err := d.query(ctx, c.addr, method, args)
+				if err != nil {
+					return
+				}
+				mu.Lock()
+				defer mu.Unlock()
+				copy(c.id[:], r.ID)
+				c.hasID = true
+				c.token = r.Token
+				answered[c] = true
+				for _, n := range parseNodes(r.Nodes) {
+					if n.id == d.ID || seen[n.addr.String()] {
+						continue
+					}
+					seen[n.addr.String()] = true
+					contacts = append(contacts, &contact{node: *n, hasID: true})
+				}
+				for _, value := range r.Values {
+					if len(value) != compactPeerLength {
+						continue
+					}
+					addr := parseCompactAddr([]byte(value))
+					if addr.Port == 0 || foundSeen[addr.String()] || d.Filter.Blocked(addr.IP) {
+						continue
+					}
+					foundSeen[addr.String()] = true
+					found = append(found, &net.TCPAddr{IP: addr.IP, Port: addr.Port})
+				}
+			}()
+		}
+		wg.Wait()
+		if ctx.Err() != nil {
+			return nil, nil, ctx.Err()
+		}
+	}
+
+	sortContacts(contacts, target)
+	nearest := []*contact{}
+	for _, c := range contacts {
+		if answered[c] && len(nearest) < K {
+			nearest = append(nearest, c)
+		}
+	}
+	return nearest, found, nil
+}
+
+// sortContacts puts the contacts closest to target first, the ones with
+// no id yet last
+func sortContacts(contacts []*contact, target [20]byte) {
+	slices.SortStableFunc(contacts, func(a, b *contact) int {
+		if a.hasID != b.hasID {
+			if a.hasID {
+				return -1
+			}
+			return 1
+		}
+		da, db := distance(a.id, target), distance(b.id, target)
+		return bytes.Compare(da[:], db[:])
+	})
+}
+
+// Announce looks up the peers of a torrent and tells the nodes closest to
+// it that we are one of them, accepting connections on port
+func (d *DHT) Announce(ctx context.Context, infoHash [20]byte, port int) ([]*net.TCPAddr, error) {
+	nearest, found, err := d.lookup(ctx, infoHash, true)
+	if err != nil {
+		return nil, err
+	}
+	var wg sync.WaitGroup
+	for _, c := range nearest {
+		if c.token == "" {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			d.query(ctx, c.addr, "announce_peer", &arguments{
+				InfoHash: string(infoHash[:]),
+				Port:     port,
+				Token:    c.token,
+			})
+		}()
+	}
+	wg.Wait()
+	return found, nil
+}
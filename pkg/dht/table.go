@@ -0,0 +1,126 @@
+package dht
+
+import (
+	"bytes"
+	"math/bits"
+	"net"
+	"slices"
+	"time"
+)
+
+// K is how many nodes a bucket holds and how many a lookup converges on
+const K = 8
+
+// maxFailures is how many queries in a row a node can miss before another
+// node takes its place
+const maxFailures = 2
+
+// questionableAfter is how long a node stays good without us hearing
+// from it
+const questionableAfter = 15 * time.Minute
+
+type node struct {
+	id       [20]byte
+	addr     *net.UDPAddr
+	lastSeen time.Time
+	failures int
+}
+
+func (n *node) good(now time.Time) bool {
+	return n.failures < maxFailures && now.Sub(n.lastSeen) < questionableAfter
+}
+
+// table is the routing table. Nodes go to the bucket of the bits their id
+// shares with ours, so buckets near our id keep more of their
+// neighbourhood, as a fully split Kademlia tree would.
+type table struct {
+	self    [20]byte
+	buckets [160][]*node
+}
+
+func distance(a, b [20]byte) [20]byte {
+	var d [20]byte
+	for i := range d {
+		d[i] = a[i] ^ b[i]
+	}
+	return d
+}
+
+func commonPrefix(a, b [20]byte) int {
+	for i := range a {
+		if x := a[i] ^ b[i]; x != 0 {
+			return i*8 + bits.LeadingZeros8(x)
+		}
+	}
+	return 160
+}
+
+// seen adds a node that answered or queried us, a full bucket makes room
+// by dropping a node that stopped answering
+func (t *table) seen(id [20]byte, addr *net.UDPAddr, now time.Time) {
+	prefix := commonPrefix(t.self, id)
+	if prefix == 160 {
+		return
+	}
+	bucket := t.buckets[prefix]
+	for _, n := range bucket {
+		if n.id == id {
+			n.addr = addr
+			n.lastSeen = now
+			n.failures = 0
+			return
+		}
+	}
+	fresh := &node{id: id, addr: addr, lastSeen: now}
+	if len(bucket) < K {
+		t.buckets[prefix] = append(bucket, fresh)
+		return
+	}
+	for i, n := range bucket {
+		if !n.good(now) {
+			bucket[i] = fresh
+			return
+		}
+	}
+}
+
+// failed counts a query the node at addr did not answer
+func (t *table) failed(addr *net.UDPAddr) {
+	for _, bucket := range t.buckets {
+		for _, n := range bucket {
+			if n.addr.IP.Equal(addr.IP) && n.addr.Port == addr.Port {
+				n.failures++
+			}
+		}
+	}
+}
+
+// closest lists up to count nodes nearest to target, the ones that stopped
+// answering left out
+func (t *table) closest(target [20]byte, count int) []*node {
+	nodes := []*node{}
+	for _, bucket := range t.buckets {
+		for _, n := range bucket {
+			if n.failures < maxFailures {
+				copied := *n
+				nodes = append(nodes, &copied)
+			}
+		}
+	}
+	slices.SortFunc(nodes, func(a, b *node) int {
+		da, db := distance(a.id, target), distance(b.id, target)
+		return bytes.Compare(da[:], db[:])
+	})
+	if len(nodes) > count {
+		nodes = nodes[:count]
+	}
+	return nodes
+}
+
+func (t *table) len() int {
+	count := 0
+	for _, bucket := range t.buckets {
+		count += len(bucket)
+	}
+	return count
+}
@@ -0,0 +1,145 @@
+package dht
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// idAt is an id sharing exactly prefix bits with self, prefix below 152.
+// n tells ids of the same bucket apart.
+func idAt(self [20]byte, prefix int, n byte) [20]byte {
+	id := self
+	id[prefix/8] ^= 0x80 >> (prefix % 8)
+	id[19] ^= n
+	return id
+}
+
+func testAddr(n int) *net.UDPAddr {
+	return &net.UDPAddr{IP: net.IPv4(10, 0, byte(n>>8), byte(n)), Port: 6881}
+}
+
+func TestTableBuckets(t *testing.T) {
+	self := [20]byte{0xf0, 0x0f}
+	tab := &table{self: self}
+	now := time.Now()
+
+	for n := range K + 3 {
+		tab.seen(idAt(self, 0, byte(n+1)), testAddr(n), now)
+	}
+	if got := len(tab.buckets[0]); got != K {
+		t.Fatalf("far bucket holds %d nodes, want %d", got, K)
+	}
+	// nodes nearer to us land in buckets of their own, as the splits of a
+	// Kademlia tree would give them room
+	for prefix := 1; prefix < 10; prefix++ {
+		tab.seen(idAt(self, prefix, 1), testAddr(100+prefix), now)
+		if got := len(tab.buckets[prefix]); got != 1 {
+			t.Fatalf("bucket %d holds %d nodes, want 1", prefix, got)
+		}
+	}
+	if tab.len() != K+9 {
+		t.Fatalf("table holds %d nodes, want %d", tab.len(), K+9)
+	}
+
+	// we are never our own contact
+	tab.seen(self, testAddr(999), now)
+	if tab.len() != K+9 {
+		t.Fatal("our own id was added")
+	}
+
+	// seen again only refreshes the entry
+	tab.seen(idAt(self, 1, 1), testAddr(500), now)
+	if len(tab.buckets[1]) != 1 || tab.buckets[1][0].addr.Port != testAddr(500).Port || !tab.buckets[1][0].addr.IP.Equal(testAddr(500).IP) {
+		t.Fatal("a known node was not updated in place")
+	}
+}
+
+func TestTableEviction(t *testing.T) {
+	self := [20]byte{0x12}
+	tab := &table{self: self}
+	now := time.Now()
+	for n := range K {
+		tab.seen(idAt(self, 3, byte(n+1)), testAddr(n), now)
+	}
+
+	// a full bucket of good nodes keeps them over a newcomer
+	newcomer := idAt(self, 3, 0x40)
+	tab.seen(newcomer, testAddr(50), now)
+	if contains(tab.buckets[3], newcomer) {
+		t.Fatal("a good node was evicted")
+	}
+
+	// a node that stopped answering makes room
+	failing := tab.buckets[3][2]
+	for range maxFailures {
+		tab.failed(failing.addr)
+	}
+	tab.seen(newcomer, testAddr(50), now)
+	if !contains(tab.buckets[3], newcomer) || contains(tab.buckets[3], failing.id) {
+		t.Fatal("the failing node was not replaced")
+	}
+	if len(tab.buckets[3]) != K {
+		t.Fatalf("bucket holds %d nodes, want %d", len(tab.buckets[3]), K)
+	}
+
+	// so does one we have not heard from in a while
+	later := now.Add(questionableAfter)
+	for _, n := range tab.buckets[3][1:] {
+		tab.seen(n.id, n.addr, later)
+	}
+	stale := tab.buckets[3][0]
+	other := idAt(self, 3, 0x41)
+	tab.seen(other, testAddr(51), later)
+	if !contains(tab.buckets[3], other) || contains(tab.buckets[3], stale.id) {
+		t.Fatal("the questionable node was not replaced")
+	}
+
+	// answering again clears the failures
+	n := tab.buckets[3][1]
+	tab.failed(n.addr)
+	tab.seen(n.id, n.addr, later)
+	if n.failures != 0 {
+		t.Fatalf("node kept %d failures after answering", n.failures)
+	}
+}
+
+func TestTableClosest(t *testing.T) {
+	self := [20]byte{}
+	tab := &table{self: self}
+	now := time.Now()
+	for prefix := range 20 {
+		tab.seen(idAt(self, prefix, 0), testAddr(prefix), now)
+	}
+	target := idAt(self, 19, 0)
+	closest := tab.closest(target, K)
+	if len(closest) != K {
+		t.Fatalf("closest returned %d nodes, want %d", len(closest), K)
+	}
+	if closest[0].id != target {
+		t.Fatalf("closest node is %x, want %x", closest[0].id, target)
+	}
+	for i := 1; i < len(closest); i++ {
+		a, b := distance(closest[i-1].id, target), distance(closest[i].id, target)
+		if string(a[:]) > string(b[:]) {
+			t.Fatal("closest nodes are not sorted by distance")
+		}
+	}
+
+	// nodes that stopped answering are not handed out
+	for range maxFailures {
+		tab.failed(closest[0].addr)
+	}
+	if tab.closest(target, 1)[0].id == target {
+		t.Fatal("a failing node was handed out")
+	}
+}
+
+func contains(bucket []*node, id [20]byte) bool {
+	for _, n := range bucket {
+		if n.id == id {
+			return true
+		}
+	}
+	return false
+}
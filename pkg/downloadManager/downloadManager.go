@@ -1,14 +1,23 @@
 package downloadmanager
 
 import (
+	"context"
+	"crypto/sha1"
 	"errors"
 	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	clientidentifier "github.com/TheLox95/go-torrent-client/pkg/clientIdentifier"
 	downloadunit "github.com/TheLox95/go-torrent-client/pkg/downloadUnit"
 	filemanager "github.com/TheLox95/go-torrent-client/pkg/fileManager"
+	filereader "github.com/TheLox95/go-torrent-client/pkg/fileReader"
 	"github.com/TheLox95/go-torrent-client/pkg/peer"
 	"github.com/TheLox95/go-torrent-client/pkg/piece"
+	piecepicker "github.com/TheLox95/go-torrent-client/pkg/piecePicker"
+	resumedata "github.com/TheLox95/go-torrent-client/pkg/resumeData"
 )
 
 var Cyan = "\033[36m"
@@ -17,121 +26,706 @@ var Red = "\033[31m"
 var Reset = "\033[0m"
 
 type PeerManager interface {
-	GetPeer() *peer.Peer
+	// GetPeer blocks until a connected peer is free or ctx is done
+	GetPeer(ctx context.Context) (*peer.Peer, error)
 	AddPeer(p *peer.Peer)
 	AvailablePeers() int
 }
 
+// resumablePeerManager is implemented by peer managers that keep their
+// peers and tracker state across runs
+type resumablePeerManager interface {
+	RestoreResume(r *resumedata.ResumeData)
+	FillResume(r *resumedata.ResumeData)
+}
+
+// swarmPeerManager is implemented by peer managers that can describe the
+// whole swarm, used for rarest first and to find the fastest peers
+type swarmPeerManager interface {
+	ConnectedPeers() []*peer.Peer
+	Availability(pieceCount int) []int
+}
+
+// pausablePeerManager is implemented by peer managers that can leave the
+// swarm for a while and come back
+type pausablePeerManager interface {
+	Pause()
+	Resume()
+}
+
+// bannablePeerManager is implemented by peer managers that can stop
+// talking to a peer for good
+type bannablePeerManager interface {
+	Ban(id string)
+}
+
+// deadlineStep spaces the deadlines of consecutive pieces after a read
+// position, the first one is wanted right away
+const deadlineStep = 500 * time.Millisecond
+
 type DownloadManager struct {
 	PeerManager           PeerManager
-	PiecePool             chan *piece.Piece
-	piecesCompletedAmount int
-	piecesCompleted       []*piece.Piece
+	Picker                *piecepicker.PiecePicker
+	piecesCompletedAmount atomic.Int32
 	Client                *(clientidentifier.ClientIdentifier)
 	FileManager           *(filemanager.FileManager)
 	totalPieces           int
 	MaxParallelDownload   int
-	activeDownloads       int
+	activeDownloads       atomic.Int32
+	// Sequential downloads pieces in order, for media that is played
+	// while it downloads
+	Sequential  bool
+	pieceLength int
+	fileLength  int
+	// urgent are the piece deadlines each reader and WaitRange asked for,
+	// a piece keeps the earliest one still wanted
+	urgent map[any]map[int]time.Time
+	mu     sync.Mutex
+	// verified is closed per piece once it is on disk, readers wait on it
+	verified map[int]chan struct{}
+	cancel   context.CancelFunc
+	paused   bool
+	hashes   [][20]byte
+	// corrupt keeps the blocks of pieces that failed their hash check
+	// until a good copy tells who sent the bad ones
+	corrupt map[int][]blockRecord
+}
+
+// blockRecord is a block of a corrupt piece and the peer that sent it
+type blockRecord struct {
+	begin  int
+	length int
+	hash   [20]byte
+	peerID string
 }
 
-func (m *DownloadManager) Download(pieceLength int, fileLength int, hashes [][20]byte) []byte {
-	m.FileManager.LoadMetadata()
+// pauseDrainTimeout bounds how long Pause waits for the pieces in flight
+// to fail once their peers are gone
+const pauseDrainTimeout = 10 * time.Second
+
+// ErrStopped is returned by Download when Stop or its context interrupts
+// it, wrapping the cause
+var ErrStopped = errors.New("download stopped")
+
+// idleWait is how long the loop backs off when a peer has nothing we want
+const idleWait = 100 * time.Millisecond
+
+// Download fetches every wanted piece into the FileManager and returns once
+// they are all verified
+func (m *DownloadManager) Download(ctx context.Context, pieceLength int, fileLength int, hashes [][20]byte) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	m.mu.Lock()
+	m.cancel = cancel
+	m.mu.Unlock()
+	m.FileManager.PieceCount = len(hashes)
+	err := m.FileManager.LoadMetadata()
+	if err != nil {
+		fmt.Println("could not load resume data:", err)
+	}
+	if resumable, ok := m.PeerManager.(resumablePeerManager); ok && m.FileManager.Resume() != nil {
+		resumable.RestoreResume(m.FileManager.Resume())
+		m.FileManager.Snapshot = resumable.FillResume
+	}
 	m.totalPieces = len(hashes)
-	for i, hash := range hashes {
+	m.piecesCompletedAmount.Store(0)
+	m.pieceLength = pieceLength
+	m.fileLength = fileLength
+	m.hashes = hashes
+	picker := piecepicker.New(m.totalPieces)
+	if swarm, ok := m.PeerManager.(swarmPeerManager); ok {
+		picker.Availability = func() []int {
+			return swarm.Availability(m.totalPieces)
+		}
+	}
+	m.mu.Lock()
+	picker.Sequential = m.Sequential
+	m.Picker = picker
+	m.mu.Unlock()
+	m.recheck(pieceLength, fileLength, hashes)
+	for i := range hashes {
 		if m.FileManager.PieceAlreadyDownloaded(&i) == false {
-			pieceLen := pieceLength
-			if i == m.totalPieces-1 {
-				pieceLen = fileLength - (pieceLength * (m.totalPieces - 1))
-			}
-			if pieceLen < pieceLength {
-				fmt.Println(i, m.totalPieces, pieceLen)
-			}
-			p := piece.Piece{Idx: i, Hash: hash, Length: pieceLen, Buf: nil}
-			m.PiecePool <- &p
+			m.addPiece(i)
 		} else {
-			m.piecesCompletedAmount++
+			m.piecesCompletedAmount.Add(1)
 		}
 	}
+	// readers from before a reload keep their pieces urgent
+	m.mu.Lock()
+	for _, deadlines := range m.urgent {
+		for idx := range deadlines {
+			m.applyDeadline(idx)
+		}
+	}
+	m.mu.Unlock()
 
-	for pw := range m.PiecePool {
+	for !m.Completed() {
 		//if m.activeDownloads >= m.MaxParallelDownload {
-		//	m.PiecePool <- pw
 		//}
-		if m.piecesCompletedAmount == m.totalPieces {
-			break
+		if ctx.Err() != nil {
+			m.FileManager.SaveResume()
+			return fmt.Errorf("%w: %w", ErrStopped, context.Cause(ctx))
+		}
+		if m.Paused() {
+			time.Sleep(idleWait)
+			continue
 		}
-		p := m.PeerManager.GetPeer()
-		//FIX: sometimes Bitfield is empty, should not be like that never
-		for p == nil || p.Bitfield.Len() == 0 {
-			p = m.PeerManager.GetPeer()
+		p, err := m.PeerManager.GetPeer(ctx)
+		if err != nil {
+			// ctx is done, handled at the top of the loop
 			continue
 		}
-		if p.Bitfield.HasPiece(pw.Idx) == false {
+		pw := m.Picker.Pick(p.HasPiece, m.isFastPeer(p))
+		if pw == nil {
 			m.PeerManager.AddPeer(p)
-			m.PiecePool <- pw
+			time.Sleep(idleWait)
 			continue
 		}
 
-		fmt.Println("@@@@@@@@@@@@@@@@@@@@@@ COMPLETED SO FAR", m.piecesCompletedAmount, " out of ", m.totalPieces, " with ", m.PeerManager.AvailablePeers(), " peers available")
+		fmt.Println("@@@@@@@@@@@@@@@@@@@@@@ COMPLETED SO FAR", m.piecesCompletedAmount.Load(), " out of ", m.totalPieces, " with ", m.PeerManager.AvailablePeers(), " peers available")
 		if p.IsConnected() == false {
-			err := p.Connect(m.Client)
+			err := p.Connect(ctx, m.Client)
 			if err != nil {
 				fmt.Println("failed to connect peer: ", p.IP)
 				m.PeerManager.AddPeer(p)
-				m.PiecePool <- pw
+				m.Picker.Return(pw)
 				continue
 			}
 		}
 		unit := &downloadunit.DownloadUnit{Peer: p, Piece: pw, Status: downloadunit.Failed}
-		go m.askPiece(unit, fileLength, pieceLength)
+		m.activeDownloads.Add(1)
+		go m.askPiece(ctx, unit, fileLength, pieceLength)
+	}
+
+	return m.FileManager.SaveResume()
+}
+
+func (m *DownloadManager) addPiece(idx int) {
+	pieceLen := m.pieceLength
+	if idx == m.totalPieces-1 {
+		pieceLen = m.fileLength - (m.pieceLength * (m.totalPieces - 1))
+	}
+	p := piece.Piece{Idx: idx, Hash: m.hashes[idx], Length: pieceLen, Buf: nil, OnBlock: m.FileManager.WriteBlock}
+	restored := m.FileManager.RestorePartial(&p)
+	if restored > 0 {
+		fmt.Printf("resuming piece %d with %d of %d bytes\n", idx, restored, pieceLen)
+	}
+	m.Picker.SetPriority(idx, m.FileManager.PiecePriority(idx))
+	m.Picker.Add(&p)
+}
+
+// Pause leaves the swarm without ending Download: connections are closed,
+// trackers are told we stopped and everything verified so far is flushed
+// with the resume data. Download waits until Resume.
+func (m *DownloadManager) Pause() error {
+	m.mu.Lock()
+	if m.paused {
+		m.mu.Unlock()
+		return nil
+	}
+	m.paused = true
+	m.mu.Unlock()
+
+	if pausable, ok := m.PeerManager.(pausablePeerManager); ok {
+		pausable.Pause()
+	}
+	// pieces in flight fail as soon as their connection is closed, let
+	// them finish so the resume data does not miss one
+	deadline := time.Now().Add(pauseDrainTimeout)
+	for m.activeDownloads.Load() > 0 && time.Now().Before(deadline) {
+		time.Sleep(idleWait)
+	}
+	return m.FileManager.Close()
+}
+
+// Resume reloads the resume data, in case the files were touched while
+// paused, and joins the swarm again
+func (m *DownloadManager) Resume() error {
+	m.mu.Lock()
+	if !m.paused {
+		m.mu.Unlock()
+		return nil
+	}
+	m.mu.Unlock()
+
+	var err error
+	if m.totalPieces > 0 {
+		err = m.reload()
+	}
+	m.mu.Lock()
+	m.paused = false
+	m.mu.Unlock()
+	if pausable, ok := m.PeerManager.(pausablePeerManager); ok {
+		pausable.Resume()
+	}
+	return err
+}
+
+func (m *DownloadManager) Paused() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.paused
+}
+
+// reload reads the resume data again and queues the pieces that turned
+// out to be missing after a recheck
+func (m *DownloadManager) reload() error {
+	err := m.FileManager.LoadMetadata()
+	if err != nil {
+		return fmt.Errorf("could not reload resume data: %w", err)
+	}
+	if resumable, ok := m.PeerManager.(resumablePeerManager); ok {
+		resumable.RestoreResume(m.FileManager.Resume())
+	}
+	m.recheck(m.pieceLength, m.fileLength, m.hashes)
+	for i := range m.totalPieces {
+		if !m.FileManager.PieceAlreadyDownloaded(&i) && !m.Picker.Has(i) {
+			fmt.Printf("piece %d is gone from disk, downloading it again\n", i)
+			m.addPiece(i)
+		}
+	}
+	return nil
+}
+
+// Stop makes a running Download return ErrStopped, pieces in flight are
+// abandoned and fetched again by the next Download
+func (m *DownloadManager) Stop() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.cancel != nil {
+		m.cancel()
+	}
+}
+
+// isFastPeer tells if a peer is at least as fast as the median connected
+// peer, only those get pieces with a deadline far ahead
+func (m *DownloadManager) isFastPeer(p *peer.Peer) bool {
+	swarm, ok := m.PeerManager.(swarmPeerManager)
+	if !ok || !m.Picker.HasDeadlines() {
+		return true
+	}
+	rates := make([]float64, 0)
+	for _, connected := range swarm.ConnectedPeers() {
+		rates = append(rates, connected.DownloadRate())
+	}
+	if len(rates) == 0 {
+		return true
+	}
+	sort.Float64s(rates)
+	return p.DownloadRate() >= rates[len(rates)/2]
+}
+
+// picker returns the picker of the current download, nil before Download
+// starts. Download replaces it so other goroutines read it under mu.
+func (m *DownloadManager) picker() *piecepicker.PiecePicker {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.Picker
+}
+
+func (m *DownloadManager) SetSequential(sequential bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.Sequential = sequential
+	if m.Picker != nil {
+		m.Picker.SetSequential(sequential)
+	}
+}
+
+// SetPieceDeadline asks for a piece to be ready within d
+func (m *DownloadManager) SetPieceDeadline(idx int, d time.Duration) {
+	if picker := m.picker(); picker != nil {
+		picker.SetDeadline(idx, time.Now().Add(d))
+	}
+}
+
+// SetReadPosition makes the pieces covering offset..offset+readahead the
+// most urgent ones, replacing the window reader asked for before. Every
+// reader has its own window, everything else keeps downloading in the
+// background.
+func (m *DownloadManager) SetReadPosition(reader any, offset int64, readahead int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.Picker == nil || m.pieceLength == 0 {
+		return
+	}
+	end := min(offset+max(readahead, 1), int64(m.fileLength))
+	if offset < 0 || offset >= end {
+		m.setUrgent(reader, nil)
+		return
+	}
+	first := int(offset / int64(m.pieceLength))
+	last := int((end - 1) / int64(m.pieceLength))
+	now := time.Now()
+	window := make(map[int]time.Time)
+	for idx := first; idx <= last; idx++ {
+		window[idx] = now.Add(time.Duration(idx-first) * deadlineStep)
+	}
+	m.setUrgent(reader, window)
+}
+
+// ClearReadPosition drops the window of a reader that is done
+func (m *DownloadManager) ClearReadPosition(reader any) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.setUrgent(reader, nil)
+}
+
+// setUrgent replaces the deadlines owner asks for, nil drops them. It must
+// be called holding m.mu.
+func (m *DownloadManager) setUrgent(owner any, deadlines map[int]time.Time) {
+	old := m.urgent[owner]
+	if len(deadlines) == 0 {
+		delete(m.urgent, owner)
+	} else {
+		if m.urgent == nil {
+			m.urgent = make(map[any]map[int]time.Time)
+		}
+		m.urgent[owner] = deadlines
+	}
+	if m.Picker == nil {
+		return
+	}
+	for idx := range old {
+		if _, ok := deadlines[idx]; !ok {
+			m.applyDeadline(idx)
+		}
+	}
+	for idx := range deadlines {
+		m.applyDeadline(idx)
+	}
+}
+
+// applyDeadline gives the picker the earliest deadline anyone still wants
+// for a piece. It must be called holding m.mu.
+func (m *DownloadManager) applyDeadline(idx int) {
+	var earliest time.Time
+	for _, deadlines := range m.urgent {
+		deadline, ok := deadlines[idx]
+		if ok && (earliest.IsZero() || deadline.Before(earliest)) {
+			earliest = deadline
+		}
+	}
+	if earliest.IsZero() {
+		m.Picker.ClearDeadline(idx)
+	} else {
+		m.Picker.SetDeadline(idx, earliest)
+	}
+}
+
+func (m *DownloadManager) verifiedChan(idx int) chan struct{} {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.verified == nil {
+		m.verified = make(map[int]chan struct{})
 	}
+	ch, ok := m.verified[idx]
+	if !ok {
+		ch = make(chan struct{})
+		m.verified[idx] = ch
+	}
+	return ch
+}
+
+func (m *DownloadManager) pieceVerified(idx int) {
+	ch := m.verifiedChan(idx)
+	select {
+	case <-ch:
+	default:
+		close(ch)
+	}
+}
 
-	close(m.PiecePool)
-	buf := make([]byte, fileLength)
-	for i := 0; i < len(m.piecesCompleted); i++ {
-		piece := m.piecesCompleted[i]
+// rangeWait owns the deadline of a WaitRange call
+type rangeWait struct {
+	offset int64
+	length int64
+}
 
-		begin, _ := piece.CalculateBounds(fileLength, pieceLength)
-		//copy(buf[piece.Idx*pieceLength:], piece.Buf)
-		copy(buf[begin:], piece.Buf)
+// WaitRange blocks until the pieces holding offset..offset+length are
+// verified, pushing the missing ones to the front of the queue until it
+// returns
+func (m *DownloadManager) WaitRange(ctx context.Context, offset int64, length int64) error {
+	if m.FileManager.BasePieceSize == 0 || length <= 0 {
+		return nil
+	}
+	wait := &rangeWait{offset: offset, length: length}
+	defer func() {
+		m.mu.Lock()
+		m.setUrgent(wait, nil)
+		m.mu.Unlock()
+	}()
+	pieceSize := int64(m.FileManager.BasePieceSize)
+	first := int(offset / pieceSize)
+	last := int((offset + length - 1) / pieceSize)
+	for idx := first; idx <= last; idx++ {
+		if m.FileManager.PieceAlreadyDownloaded(&idx) {
+			continue
+		}
+		m.mu.Lock()
+		m.setUrgent(wait, map[int]time.Time{idx: time.Now()})
+		m.mu.Unlock()
+		select {
+		case <-m.verifiedChan(idx):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
 	}
-	return buf
+	return nil
 }
 
-func (m *DownloadManager) askPiece(unit *downloadunit.DownloadUnit, fileLength, pieceLength int) error {
+// ReadAt reads payload data straight from storage, see WaitRange
+func (m *DownloadManager) ReadAt(p []byte, offset int64) (int, error) {
+	return m.FileManager.ReadAt(p, offset)
+}
+
+func (m *DownloadManager) InfoHash() [20]byte {
+	return m.FileManager.InfoHash
+}
+
+func (m *DownloadManager) Name() string {
+	return m.FileManager.Filename
+}
+
+func (m *DownloadManager) Files() []filemanager.File {
+	files := make([]filemanager.File, 0, len(m.FileManager.Files))
+	for idx := range m.FileManager.Files {
+		f, _ := m.FileManager.File(idx)
+		files = append(files, f)
+	}
+	return files
+}
+
+// NewFileReader streams a file of the torrent while it downloads
+func (m *DownloadManager) NewFileReader(fileIdx int) (*filereader.Reader, error) {
+	f, err := m.FileManager.File(fileIdx)
+	if err != nil {
+		return nil, err
+	}
+	return filereader.New(m, f.Offset, f.Length), nil
+}
+
+// SetFilePriority changes which files are downloaded and in which order,
+// it can be called while the download runs
+func (m *DownloadManager) SetFilePriority(fileIdx int, priority piece.Priority) error {
+	pieces, err := m.FileManager.SetFilePriority(fileIdx, priority)
+	if err != nil {
+		return err
+	}
+	picker := m.picker()
+	if picker == nil {
+		return nil
+	}
+	for _, idx := range pieces {
+		picker.SetPriority(idx, m.FileManager.PiecePriority(idx))
+	}
+	return nil
+}
+
+// recheck hashes pieces already on disk that the resume data could not
+// vouch for
+func (m *DownloadManager) recheck(pieceLength int, fileLength int, hashes [][20]byte) {
+	pieces := m.FileManager.PiecesToRecheck()
+	if len(pieces) == 0 {
+		return
+	}
+	fmt.Printf("rechecking %d pieces\n", len(pieces))
+	valid := 0
+	for _, idx := range pieces {
+		p := piece.Piece{Idx: idx, Hash: hashes[idx], Length: pieceLength}
+		p.Length = p.CalculateSize(fileLength, pieceLength)
+		if m.FileManager.ReadPiece(&p) != nil || p.CheckIntegrity() != nil {
+			continue
+		}
+		m.FileManager.MarkVerified(idx)
+		valid++
+	}
+	fmt.Printf("recheck found %d of %d pieces valid\n", valid, len(pieces))
+	err := m.FileManager.SaveResume()
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
+// maxRequestLength is the largest block we upload in one message, bigger
+// requests are ignored
+const maxRequestLength = 128 * 1024
+
+// HandleEvent serves the blocks connected peers request, it runs on the
+// reader goroutine of their connection
+func (m *DownloadManager) HandleEvent(e peer.Event) {
+	switch e.Kind {
+	case peer.EventHave:
+		picker := m.picker()
+		if picker != nil && picker.Wanted(e.Index) {
+			e.Peer.SetInterested(true)
+		}
+		return
+	case peer.EventBitfield:
+		e.Peer.SetInterested(m.Interesting(e.Peer))
+		return
+	case peer.EventRequest:
+	default:
+		return
+	}
+	idx := e.Index
+	pieceSize := int64(m.FileManager.BasePieceSize)
+	offset := int64(idx)*pieceSize + int64(e.Begin)
+	if e.Length <= 0 || e.Length > maxRequestLength || e.Begin < 0 || int64(e.Begin+e.Length) > pieceSize {
+		return
+	}
+	if offset+int64(e.Length) > m.FileManager.TotalLength() || !m.FileManager.PieceAlreadyDownloaded(&idx) {
+		return
+	}
+	if e.Peer.Stats().AmChoking {
+		return
+	}
+	data := make([]byte, e.Length)
+	_, err := m.FileManager.ReadAt(data, offset)
+	if err != nil {
+		fmt.Println("could not read block for", e.Peer.GetID(), err)
+		return
+	}
+	err = e.Peer.SendBlock(idx, e.Begin, data)
+	if err != nil {
+		return
+	}
+	m.FileManager.AddTransfer(0, int64(e.Length))
+}
+
+// Interesting tells if a peer has a piece we still want, before the
+// download starts every peer is
+func (m *DownloadManager) Interesting(p *peer.Peer) bool {
+	picker := m.picker()
+	if picker == nil {
+		return true
+	}
+	if picker.Remaining() == 0 {
+		return false
+	}
+	pieces := p.Pieces()
+	for idx := range m.totalPieces {
+		if pieces.HasPiece(idx) && picker.Wanted(idx) {
+			return true
+		}
+	}
+	return false
+}
+
+// announceHave tells every connected peer about a piece we verified
+func (m *DownloadManager) announceHave(idx int) {
+	swarm, ok := m.PeerManager.(swarmPeerManager)
+	if !ok {
+		return
+	}
+	for _, p := range swarm.ConnectedPeers() {
+		p.OnPieceRequestSucceed(idx)
+	}
+}
+
+// Completed is true once every wanted piece has been verified, from then
+// on the torrent is only seeding
+func (m *DownloadManager) Completed() bool {
+	picker := m.picker()
+	return picker != nil && picker.Remaining() == 0
+}
+
+func (m *DownloadManager) askPiece(ctx context.Context, unit *downloadunit.DownloadUnit, fileLength, pieceLength int) error {
+	defer m.activeDownloads.Add(-1)
 	pieceSize := unit.Piece.CalculateSize(fileLength, pieceLength)
 
 	fmt.Printf("asking piece %d to peer %s of size %d\n", unit.Piece.Idx, unit.Peer.GetID(), pieceSize)
-	m.activeDownloads++
-	err := unit.Peer.RequestPiece(unit.Piece)
-	m.activeDownloads--
+	err := unit.Peer.RequestPiece(ctx, unit.Piece)
 	m.PeerManager.AddPeer(unit.Peer)
 	if err != nil {
 		fmt.Printf(Red+"PIECE_ID [%d] RequestPiece failed for IP %s with: %v\n"+Reset, unit.Piece.Idx, unit.Peer.IP.String(), err)
-		m.PiecePool <- unit.Piece
+		m.Picker.Return(unit.Piece)
 		return errors.New("call to piece failed")
 	} else if unit.Piece.Buf == nil {
 		fmt.Printf(Cyan+"piece is null putting pice [%d] back\n"+Reset, unit.Piece.Idx)
-		m.PiecePool <- unit.Piece
-		unit.Peer.PiecesAsked = 0
+		m.Picker.Return(unit.Piece)
+		unit.Peer.FinishPiece(false)
 		return errors.New("piece is null")
 	}
 	err = unit.Piece.CheckIntegrity()
 	if err != nil {
-		unit.Peer.PiecesAsked = 0
+		m.recordCorrupt(unit.Piece)
+		unit.Piece.Reset()
+		m.FileManager.DiscardPartial(unit.Piece)
+		unit.Peer.FinishPiece(false)
 		fmt.Printf(Green+"putting pice [%d] back\n"+Reset, unit.Piece.Idx)
-		m.PiecePool <- unit.Piece
+		m.Picker.Return(unit.Piece)
 		return errors.New("piece is corrupted")
 	}
-	unit.Peer.OnPieceRequestSucceed(unit.Piece.Idx)
+	m.banCorrupt(unit.Piece)
+	m.announceHave(unit.Piece.Idx)
 	unit.Status = downloadunit.Success
-	unit.Peer.PiecesAsked = 0
-	unit.Peer.PiecesDownloaded++
-	m.piecesCompletedAmount++
+	unit.Peer.FinishPiece(true)
+	m.piecesCompletedAmount.Add(1)
+	m.FileManager.AddTransfer(int64(unit.Piece.Length), 0)
 	m.FileManager.AddToFile(unit.Piece)
-	m.piecesCompleted = append(m.piecesCompleted, unit.Piece)
-	if m.piecesCompletedAmount == m.totalPieces {
-		m.PiecePool <- unit.Piece
-	}
+	m.Picker.Done(unit.Piece.Idx)
+	m.pieceVerified(unit.Piece.Idx)
+	// the data is on disk now
+	unit.Piece.Buf = nil
 	return nil
 }
+
+// recordCorrupt remembers the blocks of a piece that failed its hash check
+// so banCorrupt can compare them with the good copy. A piece that came
+// whole from one peer already tells who is to blame, but not when some
+// blocks were restored from disk: those may be the corrupt ones.
+func (m *DownloadManager) recordCorrupt(p *piece.Piece) {
+	records := []blockRecord{}
+	sources := map[string]bool{}
+	restored := false
+	for i, peerID := range p.BlockSources {
+		if peerID == "" {
+			restored = true
+			continue
+		}
+		begin := i * piece.MaxBlockSize
+		length := p.CalculateBlockSize(begin)
+		records = append(records, blockRecord{
+			begin:  begin,
+			length: length,
+			hash:   sha1.Sum(p.Buf[begin : begin+length]),
+			peerID: peerID,
+		})
+		sources[peerID] = true
+	}
+	if len(sources) == 1 && !restored {
+		m.ban(records[0].peerID)
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.corrupt == nil {
+		m.corrupt = make(map[int][]blockRecord)
+	}
+	m.corrupt[p.Idx] = append(m.corrupt[p.Idx], records...)
+}
+
+// banCorrupt bans the peers whose blocks of an earlier corrupt copy of p
+// differ from the verified data
+func (m *DownloadManager) banCorrupt(p *piece.Piece) {
+	m.mu.Lock()
+	records, ok := m.corrupt[p.Idx]
+	delete(m.corrupt, p.Idx)
+	m.mu.Unlock()
+	if !ok {
+		return
+	}
+	for _, r := range records {
+		if sha1.Sum(p.Buf[r.begin:r.begin+r.length]) != r.hash {
+			fmt.Printf(Red+"peer %s sent a corrupt block of piece %d\n"+Reset, r.peerID, p.Idx)
+			m.ban(r.peerID)
+		}
+	}
+}
+
+func (m *DownloadManager) ban(peerID string) {
+	if bannable, ok := m.PeerManager.(bannablePeerManager); ok {
+		bannable.Ban(peerID)
+	}
+}
@@ -0,0 +1,203 @@
+package downloadmanager
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	bencodeinfo "github.com/TheLox95/go-torrent-client/pkg/bencodeInfo"
+	filemanager "github.com/TheLox95/go-torrent-client/pkg/fileManager"
+	"github.com/TheLox95/go-torrent-client/pkg/peer"
+	"github.com/TheLox95/go-torrent-client/pkg/piece"
+	piecepicker "github.com/TheLox95/go-torrent-client/pkg/piecePicker"
+)
+
+// idlePeerManager never has a peer to hand out
+type idlePeerManager struct{}
+
+func (idlePeerManager) GetPeer(ctx context.Context) (*peer.Peer, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (idlePeerManager) AddPeer(p *peer.Peer) {}
+
+func (idlePeerManager) AvailablePeers() int { return 0 }
+
+// banningPeerManager records the peers banned
+type banningPeerManager struct {
+	idlePeerManager
+	banned []string
+}
+
+func (b *banningPeerManager) Ban(id string) {
+	b.banned = append(b.banned, id)
+}
+
+func newTestManager(t *testing.T) *DownloadManager {
+	t.Helper()
+	info := &bencodeinfo.BencodeInfo{Name: "data.bin", Length: 40000, PieceLength: 16384}
+	files, err := filemanager.LayoutFromInfo(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &DownloadManager{
+		PeerManager: idlePeerManager{},
+		FileManager: &filemanager.FileManager{
+			Filename:      info.Name,
+			BasePieceSize: info.PieceLength,
+			InfoHash:      [20]byte{1},
+			Files:         files,
+			Root:          t.TempDir(),
+		},
+		MaxParallelDownload: 1,
+	}
+}
+
+func TestDownloadReturnsErrStoppedWhenCancelled(t *testing.T) {
+	m := newTestManager(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- m.Download(ctx, 16384, 40000, make([][20]byte, 3))
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-done:
+		if !errors.Is(err, ErrStopped) {
+			t.Fatalf("Download returned %v, want ErrStopped", err)
+		}
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("Download returned %v, want it to wrap context.Canceled", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Download did not return after cancel")
+	}
+}
+
+func TestDownloadStopsWhilePaused(t *testing.T) {
+	m := newTestManager(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- m.Download(ctx, 16384, 40000, make([][20]byte, 3))
+	}()
+	time.Sleep(50 * time.Millisecond)
+	err := m.Pause()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	select {
+	case err := <-done:
+		if !errors.Is(err, ErrStopped) {
+			t.Fatalf("Download returned %v, want ErrStopped", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("paused Download did not return after cancel")
+	}
+}
+
+// corruptPiece is a two block piece whose blocks came from sources, its
+// good copy differs from it in the blocks marked bad
+func corruptPiece(sources []string, bad []bool) (corrupt *piece.Piece, good *piece.Piece) {
+	length := 2 * piece.MaxBlockSize
+	corrupt = &piece.Piece{Idx: 0, Length: length, Buf: make([]byte, length)}
+	good = &piece.Piece{Idx: 0, Length: length, Buf: make([]byte, length)}
+	corrupt.BlockSources = sources
+	for i, isBad := range bad {
+		if isBad {
+			corrupt.Buf[i*piece.MaxBlockSize] = 0xff
+		}
+	}
+	return corrupt, good
+}
+
+func TestCorruptPieceBans(t *testing.T) {
+	tests := []struct {
+		name    string
+		sources []string
+		bad     []bool
+		banned  []string
+	}{
+		{"one peer sent it all", []string{"a", "a"}, []bool{false, true}, []string{"a"}},
+		{"the restored block is corrupt", []string{"", "a"}, []bool{true, false}, nil},
+		{"the peer block is corrupt next to a restored one", []string{"", "a"}, []bool{false, true}, []string{"a"}},
+		{"two peers, one lied", []string{"a", "b"}, []bool{false, true}, []string{"b"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			peers := &banningPeerManager{}
+			m := &DownloadManager{PeerManager: peers}
+			corrupt, good := corruptPiece(tt.sources, tt.bad)
+			m.recordCorrupt(corrupt)
+			m.banCorrupt(good)
+			if len(peers.banned) != len(tt.banned) {
+				t.Fatalf("banned %v, want %v", peers.banned, tt.banned)
+			}
+			for i := range tt.banned {
+				if peers.banned[i] != tt.banned[i] {
+					t.Fatalf("banned %v, want %v", peers.banned, tt.banned)
+				}
+			}
+		})
+	}
+}
+
+// newReadingManager is a download with three open pieces, as Download
+// leaves it before any of them arrives
+func newReadingManager(t *testing.T) *DownloadManager {
+	m := newTestManager(t)
+	m.pieceLength = 16384
+	m.fileLength = 40000
+	m.Picker = piecepicker.New(3)
+	for i := range 3 {
+		m.Picker.Add(&piece.Piece{Idx: i})
+	}
+	return m
+}
+
+func TestReadWindowsBelongToTheirReader(t *testing.T) {
+	m := newReadingManager(t)
+	first, err := m.NewFileReader(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := m.NewFileReader(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.SetReadPosition(first, 0, 1)
+	m.SetReadPosition(second, 32768, 1)
+
+	first.Close()
+	if !m.Picker.HasDeadlines() {
+		t.Fatal("closing a reader dropped the window of another one")
+	}
+	second.Close()
+	if m.Picker.HasDeadlines() {
+		t.Fatal("pieces stay urgent after every reader closed")
+	}
+}
+
+func TestWaitRangeClearsItsDeadlineWhenCancelled(t *testing.T) {
+	m := newReadingManager(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- m.WaitRange(ctx, 0, 100)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	if !m.Picker.HasDeadlines() {
+		t.Fatal("WaitRange did not make its piece urgent")
+	}
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Fatalf("WaitRange returned %v, want context.Canceled", err)
+	}
+	if m.Picker.HasDeadlines() {
+		t.Fatal("the piece stays urgent after WaitRange gave up")
+	}
+}
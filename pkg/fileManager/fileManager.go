@@ -4,99 +4,443 @@ import (
 	"bufio"
 	"errors"
 	"fmt"
-	"io"
+	"maps"
 	"os"
 	"path/filepath"
 	"slices"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/TheLox95/go-torrent-client/pkg/bitfield"
 	delve "github.com/TheLox95/go-torrent-client/pkg/debug"
 	"github.com/TheLox95/go-torrent-client/pkg/piece"
+	resumedata "github.com/TheLox95/go-torrent-client/pkg/resumeData"
 )
 
 var downloadFolder = "download"
 var CWD, _ = os.Getwd()
 var downloadPath = filepath.Join(CWD, downloadFolder)
 
+// resumeSaveInterval throttles how often finished pieces hit the resume
+// file, blocks of pieces finished in between are still in the .parts log
+const resumeSaveInterval = 5 * time.Second
+
 type FileManager struct {
-	Filename         string
-	BasePieceSize    int
-	metaFile         *os.File
-	piecesDownloaded []int
+	Filename      string
+	BasePieceSize int
+	InfoHash      [20]byte
+	PieceCount    int
+	// Files is the layout of the payload, see LayoutFromInfo
+	Files []File
+	// Root is where the payload and .resume folder go, the downloads
+	// folder of the working directory when empty
+	Root string
+	// Snapshot lets the owner add peers, trackers and totals right before
+	// the resume file is written, it runs holding the manager lock so it
+	// must not call back into the FileManager
+	Snapshot   func(r *resumedata.ResumeData)
+	resume     *resumedata.ResumeData
+	resumePath string
+	lastSave   time.Time
+	recheck    []int
+	// partsFile logs "piece begin length" for every block written before
+	// its piece was verified, so a restart only asks for missing blocks
+	partsFile     *os.File
+	partialBlocks map[int]map[int]int
+	mu            sync.Mutex
 }
 
 func (m *FileManager) PieceAlreadyDownloaded(p *int) bool {
-	return slices.Contains(m.piecesDownloaded, *p)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.resume != nil && m.resume.HasPiece(*p)
+}
+
+// Resume exposes the loaded resume data, it is nil before LoadMetadata
+func (m *FileManager) Resume() *resumedata.ResumeData {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.resume
+}
+
+// Bitfield is a copy of the verified pieces, what we offer to peers
+func (m *FileManager) Bitfield() bitfield.Bitfield {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.resume == nil {
+		return nil
+	}
+	return slices.Clone(m.resume.Bitfield())
+}
+
+// PiecesToRecheck lists pieces whose data on disk has to be hashed again
+// before it can be trusted, because the files changed behind our back or
+// the resume data could not be used
+func (m *FileManager) PiecesToRecheck() []int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	pieces := m.recheck
+	m.recheck = nil
+	return pieces
 }
 
 func (m *FileManager) LoadMetadata() error {
 	m.setupDownloadPath()
-	path := m.buildDownloadPath()
-	metadataPath := filepath.Join(path, m.Filename+".meta")
-	if _, err := os.Stat(metadataPath); os.IsNotExist(err) {
-		m.metaFile, err = os.OpenFile(metadataPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
-		if err != nil {
-			return errors.New("could not create .meta file")
-		}
+	resumePath := resumedata.Path(m.buildDownloadPath(), m.InfoHash)
+	resume, err := resumedata.Load(resumePath, m.InfoHash, m.PieceCount)
+	recheck := []int{}
+	if err == nil {
+		recheck = m.validateFiles(resume)
 	} else {
-		m.metaFile, err = os.OpenFile(metadataPath, os.O_RDWR|os.O_APPEND, 0644)
+		resume = resumedata.New(m.InfoHash, m.PieceCount)
+		if !errors.Is(err, os.ErrNotExist) {
+			fmt.Println("discarding resume file:", err)
+			if m.payloadExists() {
+				for i := range m.PieceCount {
+					recheck = append(recheck, i)
+				}
+			}
+		}
+	}
+	// peers connecting meanwhile ask for our bitfield
+	m.mu.Lock()
+	m.resumePath = resumePath
+	m.resume = resume
+	m.recheck = append(m.recheck, recheck...)
+	m.mu.Unlock()
+	if errors.Is(err, os.ErrNotExist) {
+		err = m.migrateLegacyMeta()
 		if err != nil {
-			return errors.New("could not read .meta file")
+			fmt.Println("could not migrate .meta file:", err)
 		}
+	}
+	return m.loadParts()
+}
 
-		scanner := bufio.NewScanner(m.metaFile)
-		for scanner.Scan() {
-			line := scanner.Text() // Get the line as a string
-			idx, _ := strconv.Atoi(line)
-			m.piecesDownloaded = append(m.piecesDownloaded, idx)
+func (m *FileManager) payloadExists() bool {
+	for _, f := range m.layout() {
+		if _, err := os.Stat(m.filePath(&f)); err == nil {
+			return true
 		}
+	}
+	return false
+}
 
-		if err := scanner.Err(); err != nil {
-			return errors.New("could parse .meta file")
+func (m *FileManager) fileStates() []resumedata.FileState {
+	files := m.layout()
+	states := make([]resumedata.FileState, 0, len(files))
+	for i := range files {
+		state := resumedata.FileState{Path: files[i].Path}
+		// skipped files may not exist at all
+		if info, err := os.Stat(m.filePath(&files[i])); err == nil {
+			state.Size = info.Size()
+			state.Mtime = info.ModTime().Unix()
 		}
+		states = append(states, state)
+	}
+	return states
+}
 
+// validateFiles makes sure the payload is the one the resume file was
+// written for, otherwise every piece it claims is cleared and returned to
+// be verified again
+func (m *FileManager) validateFiles(resume *resumedata.ResumeData) []int {
+	current := m.fileStates()
+	valid := len(current) == len(resume.Files)
+	for i := 0; valid && i < len(current); i++ {
+		saved := resume.Files[i]
+		valid = saved.Path == current[i].Path && saved.Size == current[i].Size && saved.Mtime == current[i].Mtime
 	}
-	return nil
+	if valid {
+		return nil
+	}
+	fmt.Println("files changed since the last run, rechecking completed pieces")
+	recheck := []int{}
+	for i := range m.PieceCount {
+		if resume.HasPiece(i) {
+			resume.ClearPiece(i)
+			recheck = append(recheck, i)
+		}
+	}
+	return recheck
 }
 
-func (m *FileManager) AddToFile(p *piece.Piece) {
-	m.setupDownloadPath()
-	path := m.buildDownloadPath()
-	file, err := os.OpenFile(filepath.Join(path, m.Filename), os.O_CREATE|os.O_WRONLY, 0644)
+// migrateLegacyMeta imports the newline separated .meta file of older
+// versions. Its pieces are rechecked since it was never synced to disk.
+func (m *FileManager) migrateLegacyMeta() error {
+	metadataPath := filepath.Join(m.buildDownloadPath(), m.Filename+".meta")
+	metaFile, err := os.Open(metadataPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
 	if err != nil {
-		fmt.Println("Error opening file:", err)
-		return
+		return errors.New("could not read .meta file")
+	}
+	defer metaFile.Close()
+
+	scanner := bufio.NewScanner(metaFile)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		idx, err := strconv.Atoi(line)
+		if err != nil || idx < 0 || idx >= m.PieceCount {
+			fmt.Printf("ignoring invalid .meta entry %q\n", line)
+			continue
+		}
+		// peers may be connected already, see LoadMetadata
+		m.mu.Lock()
+		if !slices.Contains(m.recheck, idx) {
+			m.recheck = append(m.recheck, idx)
+		}
+		m.mu.Unlock()
+	}
+	if err := scanner.Err(); err != nil {
+		return errors.New("could parse .meta file")
 	}
-	defer file.Close()
 
-	// Seek to the correct position based on the piece index
-	_, err = file.Seek(int64(p.Idx*m.BasePieceSize), io.SeekStart)
+	err = m.SaveResume()
 	if err != nil {
-		fmt.Println("Error seeking to position:", err)
+		return err
+	}
+	return os.Remove(metadataPath)
+}
+
+// MarkVerified records a piece whose data on disk passed its hash check
+func (m *FileManager) MarkVerified(idx int) {
+	m.mu.Lock()
+	m.resume.SetPiece(idx)
+	delete(m.partialBlocks, idx)
+	m.mu.Unlock()
+	m.saveIfDue()
+}
+
+// AddTransfer adds to the uploaded and downloaded totals kept across runs
+func (m *FileManager) AddTransfer(downloaded, uploaded int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.resume == nil {
 		return
 	}
+	m.resume.Downloaded += downloaded
+	m.resume.Uploaded += uploaded
+}
 
-	// Write the piece data to the file
-	_, err = file.Write(p.Buf)
+func (m *FileManager) saveIfDue() {
+	m.mu.Lock()
+	due := time.Since(m.lastSave) >= resumeSaveInterval || m.resume.CompletedPieces() == m.PieceCount
+	m.mu.Unlock()
+	if due {
+		err := m.SaveResume()
+		if err != nil {
+			fmt.Println(err)
+		}
+	}
+}
+
+// SaveResume writes the resume file now
+func (m *FileManager) SaveResume() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.resume == nil {
+		return errors.New("resume data not loaded")
+	}
+	// filled under the lock, parallel saves would write it while it changes
+	if m.Snapshot != nil {
+		m.Snapshot(m.resume)
+	}
+	// the pieces the resume file claims must be on disk before it is
+	for _, f := range m.layout() {
+		if file, err := os.OpenFile(m.filePath(&f), os.O_WRONLY, 0644); err == nil {
+			file.Sync()
+			file.Close()
+		}
+	}
+	m.resume.Files = m.fileStates()
+	m.lastSave = time.Now()
+	return m.resume.Save(m.resumePath)
+}
+
+// Close flushes the payload and resume data and closes the .parts log,
+// LoadMetadata opens everything again
+func (m *FileManager) Close() error {
+	if m.Resume() == nil {
+		return nil
+	}
+	err := m.SaveResume()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.partsFile != nil {
+		m.partsFile.Sync()
+		m.partsFile.Close()
+		m.partsFile = nil
+	}
+	return err
+}
+
+// ReadPiece fills the buffer of p with what is on disk for it
+func (m *FileManager) ReadPiece(p *piece.Piece) error {
+	p.Buf = make([]byte, p.Length)
+	err := m.readAt(p.Buf, m.pieceOffset(p.Idx))
 	if err != nil {
-		fmt.Println("Error writing to file:", err)
+		return fmt.Errorf("could not read piece %d: %w", p.Idx, err)
+	}
+	return nil
+}
+
+func (m *FileManager) partsPath() string {
+	return strings.TrimSuffix(m.resumePath, ".resume") + ".parts"
+}
+
+func (m *FileManager) loadParts() error {
+	partialBlocks := make(map[int]map[int]int)
+	content, err := os.ReadFile(m.partsPath())
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("could not read .parts file: %w", err)
+	}
+	for _, line := range strings.Split(string(content), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			// a torn last line from a crash, the block is simply asked again
+			continue
+		}
+		idx, errIdx := strconv.Atoi(fields[0])
+		begin, errBegin := strconv.Atoi(fields[1])
+		length, errLen := strconv.Atoi(fields[2])
+		if errIdx != nil || errBegin != nil || errLen != nil {
+			continue
+		}
+		if begin < 0 {
+			// the piece failed its hash check, its earlier blocks are void
+			delete(partialBlocks, idx)
+			continue
+		}
+		if m.PieceAlreadyDownloaded(&idx) {
+			continue
+		}
+		if partialBlocks[idx] == nil {
+			partialBlocks[idx] = make(map[int]int)
+		}
+		partialBlocks[idx][begin] = length
+	}
+
+	// rewrite the log without finished pieces so it does not grow forever
+	err = os.MkdirAll(filepath.Dir(m.partsPath()), os.ModePerm)
+	if err != nil {
+		return fmt.Errorf("could not create resume folder: %w", err)
+	}
+	tmpPath := m.partsPath() + ".tmp"
+	tmp, err := os.Create(tmpPath)
+	if err != nil {
+		return fmt.Errorf("could not compact .parts file: %w", err)
+	}
+	for idx, blocks := range partialBlocks {
+		for begin, length := range blocks {
+			fmt.Fprintln(tmp, idx, begin, length)
+		}
+	}
+	tmp.Sync()
+	tmp.Close()
+	err = os.Rename(tmpPath, m.partsPath())
+	if err != nil {
+		return fmt.Errorf("could not compact .parts file: %w", err)
+	}
+
+	partsFile, err := os.OpenFile(m.partsPath(), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return errors.New("could not open .parts file")
+	}
+	// blocks of the previous run may still be arriving
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.partsFile != nil {
+		// loaded again after a pause
+		m.partsFile.Close()
+	}
+	m.partsFile = partsFile
+	m.partialBlocks = partialBlocks
+	return nil
+}
+
+// RestorePartial loads the blocks of p that were written by a previous
+// run back into its buffer
+func (m *FileManager) RestorePartial(p *piece.Piece) int {
+	// copied, askPiece goroutines of a previous run may still change it
+	m.mu.Lock()
+	blocks := maps.Clone(m.partialBlocks[p.Idx])
+	m.mu.Unlock()
+	if len(blocks) == 0 {
+		return 0
+	}
+	p.Reset()
+	restored := 0
+	for begin, length := range blocks {
+		if begin >= p.Length || begin%piece.MaxBlockSize != 0 {
+			continue
+		}
+		size := p.CalculateBlockSize(begin)
+		if length != size {
+			continue
+		}
+		err := m.readAt(p.Buf[begin:begin+size], m.pieceOffset(p.Idx)+int64(begin))
+		if err != nil {
+			continue
+		}
+		p.MarkBlock(begin)
+		restored += size
+	}
+	return restored
+}
+
+// WriteBlock stores a block of a piece that is not verified yet. The data
+// lands in its final position and is logged afterwards, so a logged block
+// is always on disk.
+func (m *FileManager) WriteBlock(p *piece.Piece, begin int, data []byte) {
+	err := m.writeAt(data, m.pieceOffset(p.Idx)+int64(begin))
+	if err != nil {
+		fmt.Println("Error writing block:", err)
 		return
 	}
 
-	if m.metaFile != nil {
-		_, err := fmt.Fprintln(m.metaFile, p.Idx)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.partsFile != nil {
+		_, err := fmt.Fprintln(m.partsFile, p.Idx, begin, len(data))
 		if err != nil {
 			fmt.Println(err)
-			return
 		}
 	}
-	m.piecesDownloaded = append(m.piecesDownloaded, p.Idx)
+}
+
+// DiscardPartial forgets the blocks of a piece that failed its hash check
+func (m *FileManager) DiscardPartial(p *piece.Piece) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.partialBlocks, p.Idx)
+	if m.partsFile != nil {
+		// a negative begin tells the next load to drop what came before
+		fmt.Fprintln(m.partsFile, p.Idx, -1, 0)
+	}
+}
+
+func (m *FileManager) AddToFile(p *piece.Piece) {
+	// Write the piece data to the files it spans
+	err := m.writeAt(p.Buf, m.pieceOffset(p.Idx))
+	if err != nil {
+		fmt.Println("Error writing to file:", err)
+		return
+	}
+
+	m.MarkVerified(p.Idx)
 }
 
 func (m *FileManager) setupDownloadPath() {
 	path := m.buildDownloadPath()
 	if _, err := os.Stat(path); os.IsNotExist(err) {
-		err := os.Mkdir(downloadPath, os.ModePerm)
+		err := os.MkdirAll(path, os.ModePerm)
 		if err != nil {
 			os.Exit(1)
 		}
@@ -104,6 +448,9 @@ func (m *FileManager) setupDownloadPath() {
 }
 
 func (m *FileManager) buildDownloadPath() string {
+	if m.Root != "" {
+		return m.Root
+	}
 	path := downloadPath
 	if delve.RunningWithDelve() {
 		path = filepath.Join(CWD, "..", "..", downloadFolder)
@@ -0,0 +1,110 @@
+package filemanager
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	bencodeinfo "github.com/TheLox95/go-torrent-client/pkg/bencodeInfo"
+	"github.com/TheLox95/go-torrent-client/pkg/piece"
+)
+
+func newTestManager(t *testing.T) *FileManager {
+	t.Helper()
+	info := &bencodeinfo.BencodeInfo{Name: "data.bin", Length: 40000, PieceLength: 16384}
+	files, err := LayoutFromInfo(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &FileManager{
+		Filename:      info.Name,
+		BasePieceSize: info.PieceLength,
+		InfoHash:      [20]byte{1},
+		Files:         files,
+		Root:          t.TempDir(),
+		PieceCount:    3,
+	}
+}
+
+// a paused torrent loads its metadata again while peers of the previous
+// run still ask for the bitfield and save the resume data
+func TestReloadWhilePeersAreConnected(t *testing.T) {
+	m := newTestManager(t)
+	if err := m.LoadMetadata(); err != nil {
+		t.Fatal(err)
+	}
+	// a .meta file of older versions is migrated on the next load
+	os.Remove(m.resumePath)
+	os.WriteFile(filepath.Join(m.buildDownloadPath(), m.Filename+".meta"), []byte("0\n2\n"), 0644)
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			m.Bitfield()
+			m.SaveResume()
+			m.PiecesToRecheck()
+		}
+	}()
+	for range 5 {
+		if err := m.LoadMetadata(); err != nil {
+			t.Error(err)
+		}
+	}
+	close(stop)
+	wg.Wait()
+	m.Close()
+}
+
+func TestRestorePartialAfterReload(t *testing.T) {
+	m := newTestManager(t)
+	if err := m.LoadMetadata(); err != nil {
+		t.Fatal(err)
+	}
+	block := make([]byte, piece.MaxBlockSize)
+	for i := range block {
+		block[i] = byte(i)
+	}
+	for idx := range m.PieceCount {
+		m.WriteBlock(&piece.Piece{Idx: idx, Length: 16384}, 0, block)
+	}
+	m.DiscardPartial(&piece.Piece{Idx: 2})
+
+	// askPiece goroutines of the previous run finish while the download
+	// loads again and restores its pieces
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		m.MarkVerified(0)
+		m.DiscardPartial(&piece.Piece{Idx: 2})
+	}()
+	if err := m.LoadMetadata(); err != nil {
+		t.Fatal(err)
+	}
+	for idx := range m.PieceCount {
+		m.RestorePartial(&piece.Piece{Idx: idx, Length: 16384})
+	}
+	wg.Wait()
+
+	p := &piece.Piece{Idx: 1, Length: 16384}
+	if restored := m.RestorePartial(p); restored != piece.MaxBlockSize {
+		t.Fatalf("restored %d bytes of piece 1, want %d", restored, piece.MaxBlockSize)
+	}
+	if !bytes.Equal(p.Buf[:piece.MaxBlockSize], block) {
+		t.Fatal("restored block differs from the one written")
+	}
+	if restored := m.RestorePartial(&piece.Piece{Idx: 2, Length: 16384}); restored != 0 {
+		t.Fatalf("restored %d bytes of a discarded piece", restored)
+	}
+	m.Close()
+}
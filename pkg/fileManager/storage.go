@@ -0,0 +1,187 @@
+package filemanager
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	bencodeinfo "github.com/TheLox95/go-torrent-client/pkg/bencodeInfo"
+	"github.com/TheLox95/go-torrent-client/pkg/piece"
+)
+
+// File is one file of the torrent laid out on the concatenated payload
+type File struct {
+	Path     string
+	Length   int64
+	Offset   int64
+	Priority piece.Priority
+}
+
+// LayoutFromInfo maps the files of a torrent to paths under its name. A
+// single file torrent is stored as the name itself.
+func LayoutFromInfo(info *bencodeinfo.BencodeInfo) ([]File, error) {
+	if len(info.Files) == 0 {
+		return []File{{Path: info.Name, Length: int64(info.Length), Priority: piece.PriorityNormal}}, nil
+	}
+	files := make([]File, 0, len(info.Files))
+	offset := int64(0)
+	for _, f := range info.Files {
+		parts := []string{info.Name}
+		for _, part := range f.Path {
+			if part == "" || part == "." || part == ".." || strings.ContainsAny(part, "/\\") {
+				return nil, fmt.Errorf("unsafe path component %q in torrent", part)
+			}
+			parts = append(parts, part)
+		}
+		files = append(files, File{Path: filepath.Join(parts...), Length: int64(f.Length), Offset: offset, Priority: piece.PriorityNormal})
+		offset += int64(f.Length)
+	}
+	return files, nil
+}
+
+func (m *FileManager) layout() []File {
+	if len(m.Files) == 0 {
+		// single file fallback when no layout was given
+		m.Files = []File{{Path: m.Filename, Length: int64(m.PieceCount) * int64(m.BasePieceSize), Priority: piece.PriorityNormal}}
+	}
+	return m.Files
+}
+
+// TotalLength is the size of the whole payload
+func (m *FileManager) TotalLength() int64 {
+	total := int64(0)
+	for _, f := range m.layout() {
+		total += f.Length
+	}
+	return total
+}
+
+func (m *FileManager) filePath(f *File) string {
+	return filepath.Join(m.buildDownloadPath(), f.Path)
+}
+
+// span is the part of a file a range of the payload falls into
+type span struct {
+	file       *File
+	fileOffset int64
+	bufStart   int
+	bufEnd     int
+}
+
+func (m *FileManager) spans(offset int64, length int) []span {
+	spans := make([]span, 0, 1)
+	files := m.layout()
+	end := offset + int64(length)
+	for i := range files {
+		f := &files[i]
+		fileEnd := f.Offset + f.Length
+		if fileEnd <= offset || f.Offset >= end || f.Length == 0 {
+			continue
+		}
+		start := max(offset, f.Offset)
+		stop := min(end, fileEnd)
+		spans = append(spans, span{
+			file:       f,
+			fileOffset: start - f.Offset,
+			bufStart:   int(start - offset),
+			bufEnd:     int(stop - offset),
+		})
+	}
+	return spans
+}
+
+func (m *FileManager) writeAt(data []byte, offset int64) error {
+	m.setupDownloadPath()
+	for _, s := range m.spans(offset, len(data)) {
+		path := m.filePath(s.file)
+		err := os.MkdirAll(filepath.Dir(path), os.ModePerm)
+		if err != nil {
+			return fmt.Errorf("could not create folder: %w", err)
+		}
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return fmt.Errorf("could not open file: %w", err)
+		}
+		_, err = file.WriteAt(data[s.bufStart:s.bufEnd], s.fileOffset)
+		file.Close()
+		if err != nil {
+			return fmt.Errorf("could not write %s: %w", s.file.Path, err)
+		}
+	}
+	return nil
+}
+
+func (m *FileManager) readAt(buf []byte, offset int64) error {
+	for _, s := range m.spans(offset, len(buf)) {
+		file, err := os.Open(m.filePath(s.file))
+		if err != nil {
+			return fmt.Errorf("could not open file: %w", err)
+		}
+		_, err = file.ReadAt(buf[s.bufStart:s.bufEnd], s.fileOffset)
+		file.Close()
+		if err != nil {
+			return fmt.Errorf("could not read %s: %w", s.file.Path, err)
+		}
+	}
+	return nil
+}
+
+// ReadAt reads raw payload data, verified or not
+func (m *FileManager) ReadAt(p []byte, offset int64) (int, error) {
+	err := m.readAt(p, offset)
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// File returns the layout entry of a file
+func (m *FileManager) File(idx int) (File, error) {
+	files := m.layout()
+	if idx < 0 || idx >= len(files) {
+		return File{}, errors.New("file index out of range")
+	}
+	return files[idx], nil
+}
+
+func (m *FileManager) pieceOffset(idx int) int64 {
+	return int64(idx) * int64(m.BasePieceSize)
+}
+
+// SetFilePriority changes the priority of a file and returns the pieces
+// whose priority changed with it
+func (m *FileManager) SetFilePriority(fileIdx int, priority piece.Priority) ([]int, error) {
+	files := m.layout()
+	if fileIdx < 0 || fileIdx >= len(files) {
+		return nil, errors.New("file index out of range")
+	}
+	m.mu.Lock()
+	files[fileIdx].Priority = priority
+	m.mu.Unlock()
+
+	f := files[fileIdx]
+	if f.Length == 0 || m.BasePieceSize == 0 {
+		return nil, nil
+	}
+	first := int(f.Offset / int64(m.BasePieceSize))
+	last := int((f.Offset + f.Length - 1) / int64(m.BasePieceSize))
+	pieces := make([]int, 0, last-first+1)
+	for i := first; i <= last; i++ {
+		pieces = append(pieces, i)
+	}
+	return pieces, nil
+}
+
+// PiecePriority is the highest priority among the files a piece touches,
+// so a boundary piece shared with a wanted file is still downloaded
+func (m *FileManager) PiecePriority(idx int) piece.Priority {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	priority := piece.PrioritySkip
+	for _, s := range m.spans(m.pieceOffset(idx), m.BasePieceSize) {
+		priority = max(priority, s.file.Priority)
+	}
+	return priority
+}
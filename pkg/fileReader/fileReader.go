@@ -0,0 +1,150 @@
+package filereader
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+)
+
+// DefaultReadahead is how much data past the read position is made
+// urgent, enough for a few seconds of high bitrate video
+const DefaultReadahead = 8 * 1024 * 1024
+
+// Torrent is what a Reader needs from the download behind it. Offsets are
+// relative to the whole payload of the torrent.
+type Torrent interface {
+	// WaitRange blocks until every piece covering the range is verified,
+	// making them urgent meanwhile
+	WaitRange(ctx context.Context, offset int64, length int64) error
+	ReadAt(p []byte, offset int64) (int, error)
+	// SetReadPosition makes the data after offset urgent for reader,
+	// replacing the window it asked for before. ClearReadPosition drops it.
+	SetReadPosition(reader any, offset int64, readahead int64)
+	ClearReadPosition(reader any)
+}
+
+// Reader reads one file of a torrent while it downloads. Reads block until
+// the data they touch is verified instead of returning zeros.
+type Reader struct {
+	torrent Torrent
+	offset  int64
+	length  int64
+	// Readahead is how far past the position Read bumps piece priority
+	Readahead int64
+
+	mu     sync.Mutex
+	pos    int64
+	ctx    context.Context
+	cancel context.CancelFunc
+	// windowMu keeps a Read from setting its window after Close dropped it
+	windowMu sync.Mutex
+}
+
+var _ io.ReadSeekCloser = (*Reader)(nil)
+var _ io.ReaderAt = (*Reader)(nil)
+
+var ErrClosed = errors.New("reader closed")
+
+// New returns a reader for the file found at offset with the given length
+// inside the payload of t
+func New(t Torrent, offset int64, length int64) *Reader {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Reader{
+		torrent:   t,
+		offset:    offset,
+		length:    length,
+		Readahead: DefaultReadahead,
+		ctx:       ctx,
+		cancel:    cancel,
+	}
+}
+
+func (r *Reader) Size() int64 {
+	return r.length
+}
+
+// ReadAt does not move the position and can be called concurrently
+func (r *Reader) ReadAt(p []byte, off int64) (int, error) {
+	if r.ctx.Err() != nil {
+		return 0, ErrClosed
+	}
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	if off >= r.length {
+		return 0, io.EOF
+	}
+	want := p
+	if int64(len(want)) > r.length-off {
+		want = want[:r.length-off]
+	}
+	if len(want) == 0 {
+		return 0, nil
+	}
+	err := r.torrent.WaitRange(r.ctx, r.offset+off, int64(len(want)))
+	if err != nil {
+		if r.ctx.Err() != nil {
+			return 0, ErrClosed
+		}
+		return 0, err
+	}
+	n, err := r.torrent.ReadAt(want, r.offset+off)
+	if err != nil {
+		return n, err
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (r *Reader) Read(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.pos >= r.length {
+		return 0, io.EOF
+	}
+	r.windowMu.Lock()
+	if r.ctx.Err() == nil {
+		r.torrent.SetReadPosition(r, r.offset+r.pos, r.Readahead)
+	}
+	r.windowMu.Unlock()
+	n, err := r.ReadAt(p, r.pos)
+	r.pos += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (r *Reader) Seek(offset int64, whence int) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var pos int64
+	switch whence {
+	case io.SeekStart:
+		pos = offset
+	case io.SeekCurrent:
+		pos = r.pos + offset
+	case io.SeekEnd:
+		pos = r.length + offset
+	default:
+		return r.pos, errors.New("invalid whence")
+	}
+	if pos < 0 {
+		return r.pos, errors.New("negative position")
+	}
+	r.pos = pos
+	return pos, nil
+}
+
+// Close unblocks pending reads and gives up the priority of the data they
+// wanted, the download itself keeps running
+func (r *Reader) Close() error {
+	r.cancel()
+	r.windowMu.Lock()
+	defer r.windowMu.Unlock()
+	r.torrent.ClearReadPosition(r)
+	return nil
+}
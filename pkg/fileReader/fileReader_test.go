@@ -0,0 +1,178 @@
+package filereader
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeTorrent serves data once ready is closed
+type fakeTorrent struct {
+	data  []byte
+	ready chan struct{}
+
+	mu      sync.Mutex
+	windows map[any]int64
+}
+
+func newFakeTorrent(data []byte) *fakeTorrent {
+	return &fakeTorrent{data: data, ready: make(chan struct{}), windows: make(map[any]int64)}
+}
+
+func (f *fakeTorrent) WaitRange(ctx context.Context, offset int64, length int64) error {
+	select {
+	case <-f.ready:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (f *fakeTorrent) ReadAt(p []byte, offset int64) (int, error) {
+	return copy(p, f.data[offset:]), nil
+}
+
+func (f *fakeTorrent) SetReadPosition(reader any, offset int64, readahead int64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.windows[reader] = offset
+}
+
+func (f *fakeTorrent) ClearReadPosition(reader any) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.windows, reader)
+}
+
+func (f *fakeTorrent) openWindows() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.windows)
+}
+
+// payload is two files, the reader covers the second one
+var payload = []byte("first file|second file")
+
+const fileOffset = 11
+
+func TestReadBlocksUntilTheDataIsReady(t *testing.T) {
+	torrent := newFakeTorrent(payload)
+	r := New(torrent, fileOffset, int64(len(payload)-fileOffset))
+	defer r.Close()
+
+	done := make(chan string)
+	go func() {
+		buf := make([]byte, 6)
+		n, err := r.Read(buf)
+		if err != nil {
+			t.Error(err)
+		}
+		done <- string(buf[:n])
+	}()
+	select {
+	case <-done:
+		t.Fatal("Read returned before the data was ready")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if torrent.openWindows() != 1 {
+		t.Fatal("Read did not make its position urgent")
+	}
+	close(torrent.ready)
+	if got := <-done; got != "second" {
+		t.Fatalf("read %q, want %q", got, "second")
+	}
+}
+
+func TestCloseUnblocksPendingRead(t *testing.T) {
+	torrent := newFakeTorrent(payload)
+	r := New(torrent, fileOffset, int64(len(payload)-fileOffset))
+
+	done := make(chan error)
+	go func() {
+		_, err := r.Read(make([]byte, 4))
+		done <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	r.Close()
+	select {
+	case err := <-done:
+		if !errors.Is(err, ErrClosed) {
+			t.Fatalf("Read returned %v, want ErrClosed", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Read still blocked after Close")
+	}
+	if torrent.openWindows() != 0 {
+		t.Fatal("Close kept the read window urgent")
+	}
+	if _, err := r.Read(make([]byte, 4)); !errors.Is(err, ErrClosed) {
+		t.Fatalf("Read after Close returned %v, want ErrClosed", err)
+	}
+}
+
+func TestSeek(t *testing.T) {
+	torrent := newFakeTorrent(payload)
+	close(torrent.ready)
+	r := New(torrent, fileOffset, int64(len(payload)-fileOffset))
+	defer r.Close()
+
+	tests := []struct {
+		offset int64
+		whence int
+		pos    int64
+		read   string
+	}{
+		{7, io.SeekStart, 7, "file"},
+		{-4, io.SeekCurrent, 7, "fi"},
+		{-4, io.SeekEnd, 7, "file"},
+		{0, io.SeekEnd, 11, ""},
+	}
+	for _, tt := range tests {
+		pos, err := r.Seek(tt.offset, tt.whence)
+		if err != nil || pos != tt.pos {
+			t.Fatalf("Seek(%d, %d) = %d, %v, want %d", tt.offset, tt.whence, pos, err, tt.pos)
+		}
+		buf := make([]byte, len(tt.read))
+		if tt.read == "" {
+			buf = make([]byte, 1)
+		}
+		n, err := r.Read(buf)
+		if string(buf[:n]) != tt.read {
+			t.Fatalf("read %q after Seek(%d, %d), want %q", buf[:n], tt.offset, tt.whence, tt.read)
+		}
+		if tt.read == "" && err != io.EOF {
+			t.Fatalf("Read at the end returned %v, want io.EOF", err)
+		}
+	}
+	if _, err := r.Seek(-1, io.SeekStart); err == nil {
+		t.Fatal("negative position was accepted")
+	}
+}
+
+func TestShortReadAtEOF(t *testing.T) {
+	torrent := newFakeTorrent(payload)
+	close(torrent.ready)
+	r := New(torrent, fileOffset, int64(len(payload)-fileOffset))
+	defer r.Close()
+
+	buf := make([]byte, 8)
+	n, err := r.ReadAt(buf, 7)
+	if n != 4 || err != io.EOF || string(buf[:n]) != "file" {
+		t.Fatalf("ReadAt past the end = %d %q, %v, want 4 \"file\", io.EOF", n, buf[:n], err)
+	}
+
+	all, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(all, []byte("second file")) {
+		t.Fatalf("read %q", all)
+	}
+	if n, err := r.Read(buf); n != 0 || err != io.EOF {
+		t.Fatalf("Read at the end = %d, %v, want 0, io.EOF", n, err)
+	}
+}
@@ -0,0 +1,187 @@
+package ipfilter
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultReloadInterval is how often Watch looks for changed blocklists
+const DefaultReloadInterval = time.Minute
+
+// Filter blocks the peers whose address is in one of its blocklists. A
+// nil *Filter blocks nobody.
+type Filter struct {
+	// Paths are the blocklists, reloaded together
+	Paths []string
+	// ranges are sorted by Start and never overlap
+	ranges  []Range
+	modTime map[string]time.Time
+	blocked atomic.Int64
+	mu      sync.RWMutex
+}
+
+// Load reads the blocklists at paths into a new Filter
+func Load(paths ...string) (*Filter, error) {
+	f := &Filter{Paths: paths}
+	err := f.Reload()
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Reload reads every blocklist again and swaps the ranges in at once, the
+// old ones stay in use when any of them cannot be read
+func (f *Filter) Reload() error {
+	ranges := []Range{}
+	modTime := make(map[string]time.Time)
+	for _, path := range f.Paths {
+		file, err := os.Open(path)
+		if err != nil {
+			return fmt.Errorf("could not open blocklist: %w", err)
+		}
+		info, err := file.Stat()
+		if err == nil {
+			modTime[path] = info.ModTime()
+		}
+		parsed, invalid, err := Parse(file)
+		file.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		if invalid > 0 {
+			fmt.Printf("blocklist %s: skipped %d invalid lines\n", path, invalid)
+		}
+		ranges = append(ranges, parsed...)
+	}
+	ranges = merge(ranges)
+
+	f.mu.Lock()
+	f.ranges = ranges
+	f.modTime = modTime
+	f.mu.Unlock()
+	fmt.Printf("ip filter loaded %d ranges\n", len(ranges))
+	return nil
+}
+
+// merge sorts the ranges and joins the ones that overlap or touch
+func merge(ranges []Range) []Range {
+	slices.SortFunc(ranges, func(a, b Range) int {
+		return a.Start.Compare(b.Start)
+	})
+	merged := []Range{}
+	for _, r := range ranges {
+		if len(merged) > 0 {
+			last := &merged[len(merged)-1]
+			if last.End.BitLen() == r.Start.BitLen() && (r.Start.Compare(last.End) <= 0 || last.End.Next() == r.Start) {
+				if last.End.Less(r.End) {
+					last.End = r.End
+				}
+				continue
+			}
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+// changed tells if any blocklist was modified since it was loaded
+func (f *Filter) changed() bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	for _, path := range f.Paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		if !info.ModTime().Equal(f.modTime[path]) {
+			return true
+		}
+	}
+	return false
+}
+
+// Watch reloads the blocklists every time one of them changes on disk,
+// checking every interval until ctx is done
+func (f *Filter) Watch(ctx context.Context, interval time.Duration) {
+	if f == nil {
+		return
+	}
+	if interval <= 0 {
+		interval = DefaultReloadInterval
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if !f.changed() {
+					continue
+				}
+				err := f.Reload()
+				if err != nil {
+					fmt.Println("could not reload ip filter:", err)
+				}
+			}
+		}
+	}()
+}
+
+// Match returns the range that blocks ip
+func (f *Filter) Match(ip net.IP) (Range, bool) {
+	if f == nil {
+		return Range{}, false
+	}
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return Range{}, false
+	}
+	addr = addr.Unmap()
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	idx, _ := slices.BinarySearchFunc(f.ranges, addr, func(r Range, ip netip.Addr) int {
+		return r.End.Compare(ip)
+	})
+	if idx < len(f.ranges) && f.ranges[idx].Contains(addr) {
+		return f.ranges[idx], true
+	}
+	return Range{}, false
+}
+
+// Blocked tells if a connection with ip is refused, and counts it when it
+// is
+func (f *Filter) Blocked(ip net.IP) bool {
+	_, blocked := f.Match(ip)
+	if blocked {
+		f.blocked.Add(1)
+	}
+	return blocked
+}
+
+// BlockedAttempts is how many connections the filter refused
+func (f *Filter) BlockedAttempts() int64 {
+	if f == nil {
+		return 0
+	}
+	return f.blocked.Load()
+}
+
+// Len is the number of ranges after overlapping ones were merged
+func (f *Filter) Len() int {
+	if f == nil {
+		return 0
+	}
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return len(f.ranges)
+}
@@ -0,0 +1,160 @@
+package ipfilter
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// datAllowLevel is the eMule access level from which a DAT range is
+// allowed instead of blocked
+const datAllowLevel = 128
+
+// Range is a blocked block of addresses, both ends included
+type Range struct {
+	Start       netip.Addr
+	End         netip.Addr
+	Description string
+}
+
+func (r Range) Contains(ip netip.Addr) bool {
+	return r.Start.Compare(ip) <= 0 && ip.Compare(r.End) <= 0
+}
+
+// Parse reads a blocklist in eMule DAT, PeerGuardian P2P or CIDR format,
+// one range per line, gzipped or not. Formats can be mixed, lines that
+// cannot be read are counted in invalid and skipped.
+func Parse(r io.Reader) (ranges []Range, invalid int, err error) {
+	buffered := bufio.NewReader(r)
+	magic, _ := buffered.Peek(2)
+	var src io.Reader = buffered
+	if len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(buffered)
+		if err != nil {
+			return nil, 0, fmt.Errorf("could not read gzipped blocklist: %w", err)
+		}
+		defer gz.Close()
+		src = gz
+	}
+
+	scanner := bufio.NewScanner(src)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "//") {
+			continue
+		}
+		r, blocked, err := ParseLine(line)
+		if err != nil {
+			invalid++
+			continue
+		}
+		if blocked {
+			ranges = append(ranges, r)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, invalid, fmt.Errorf("could not read blocklist: %w", err)
+	}
+	return ranges, invalid, nil
+}
+
+// ParseLine reads one blocklist entry, blocked is false for DAT ranges
+// whose access level allows them:
+//
+//	001.002.003.000 - 001.002.003.255 , 000 , description
+//	description:1.2.3.0-1.2.3.255
+//	1.2.3.0/24
+//	1.2.3.4
+func ParseLine(line string) (r Range, blocked bool, err error) {
+	if prefix, err := netip.ParsePrefix(line); err == nil {
+		prefix = prefix.Masked()
+		return Range{Start: prefix.Addr(), End: lastAddr(prefix)}, true, nil
+	}
+	if ip, err := parseAddr(line); err == nil {
+		return Range{Start: ip, End: ip}, true, nil
+	}
+	// P2P descriptions can hold commas, so P2P goes before DAT
+	if idx := strings.LastIndex(line, ":"); idx != -1 {
+		r, err := parseRange(line[idx+1:])
+		if err == nil {
+			r.Description = strings.TrimSpace(line[:idx])
+			return r, true, nil
+		}
+	}
+	if fields := strings.SplitN(line, ",", 3); len(fields) > 1 {
+		if r, err := parseRange(fields[0]); err == nil {
+			return parseDAT(r, fields, line)
+		}
+	}
+	r, err = parseRange(line)
+	return r, err == nil, err
+}
+
+// parseDAT reads the access level and description of a DAT line whose
+// range was read from fields[0]
+func parseDAT(r Range, fields []string, line string) (Range, bool, error) {
+	if len(fields) > 2 {
+		r.Description = strings.TrimSpace(fields[2])
+	}
+	level, err := strconv.Atoi(strings.TrimSpace(fields[1]))
+	if err != nil {
+		return r, false, fmt.Errorf("invalid access level in %q", line)
+	}
+	return r, level < datAllowLevel, nil
+}
+
+// parseRange reads "start - end"
+func parseRange(s string) (Range, error) {
+	from, to, ok := strings.Cut(s, "-")
+	if !ok {
+		return Range{}, fmt.Errorf("expected a range, got %q", s)
+	}
+	start, err := parseAddr(from)
+	if err != nil {
+		return Range{}, err
+	}
+	end, err := parseAddr(to)
+	if err != nil {
+		return Range{}, err
+	}
+	if start.BitLen() != end.BitLen() || end.Less(start) {
+		return Range{}, fmt.Errorf("invalid range %q", s)
+	}
+	return Range{Start: start, End: end}, nil
+}
+
+// parseAddr also reads the zero padded IPv4 addresses of DAT files
+func parseAddr(s string) (netip.Addr, error) {
+	s = strings.TrimSpace(s)
+	if !strings.Contains(s, ":") {
+		octets := strings.Split(s, ".")
+		if len(octets) == 4 {
+			for i, octet := range octets {
+				n, err := strconv.Atoi(octet)
+				if err != nil || n < 0 || n > 255 {
+					return netip.Addr{}, fmt.Errorf("invalid address %q", s)
+				}
+				octets[i] = strconv.Itoa(n)
+			}
+			s = strings.Join(octets, ".")
+		}
+	}
+	ip, err := netip.ParseAddr(s)
+	if err != nil {
+		return ip, fmt.Errorf("invalid address %q", s)
+	}
+	return ip.Unmap(), nil
+}
+
+func lastAddr(prefix netip.Prefix) netip.Addr {
+	b := prefix.Addr().AsSlice()
+	for i := prefix.Bits(); i < len(b)*8; i++ {
+		b[i/8] |= 0x80 >> (i % 8)
+	}
+	ip, _ := netip.AddrFromSlice(b)
+	return ip
+}
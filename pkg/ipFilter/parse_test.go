@@ -0,0 +1,55 @@
+package ipfilter
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestParseLine(t *testing.T) {
+	tests := []struct {
+		line        string
+		start, end  string
+		blocked     bool
+		description string
+	}{
+		{"001.002.003.000 - 001.002.003.255 , 000 , Some ISP", "1.2.3.0", "1.2.3.255", true, "Some ISP"},
+		{"001.002.003.000 - 001.002.003.255 , 200 , Allowed", "1.2.3.0", "1.2.3.255", false, "Allowed"},
+		{"001.002.003.000 - 001.002.003.255 , 000 , Foo, Inc", "1.2.3.0", "1.2.3.255", true, "Foo, Inc"},
+		{"Some ISP:1.2.3.0-1.2.3.255", "1.2.3.0", "1.2.3.255", true, "Some ISP"},
+		{"China Internet Network Information Center, CNNIC:1.2.3.0-1.2.3.255", "1.2.3.0", "1.2.3.255", true, "China Internet Network Information Center, CNNIC"},
+		{"Bad: name, with: colons:1.2.3.0-1.2.3.255", "1.2.3.0", "1.2.3.255", true, "Bad: name, with: colons"},
+		{"1.2.3.0/24", "1.2.3.0", "1.2.3.255", true, ""},
+		{"1.2.3.4", "1.2.3.4", "1.2.3.4", true, ""},
+		{"1.2.3.0 - 1.2.3.9", "1.2.3.0", "1.2.3.9", true, ""},
+	}
+	for _, tt := range tests {
+		r, blocked, err := ParseLine(tt.line)
+		if err != nil {
+			t.Errorf("ParseLine(%q): %v", tt.line, err)
+			continue
+		}
+		if r.Start != netip.MustParseAddr(tt.start) || r.End != netip.MustParseAddr(tt.end) {
+			t.Errorf("ParseLine(%q) range %s-%s, want %s-%s", tt.line, r.Start, r.End, tt.start, tt.end)
+		}
+		if blocked != tt.blocked {
+			t.Errorf("ParseLine(%q) blocked %v, want %v", tt.line, blocked, tt.blocked)
+		}
+		if r.Description != tt.description {
+			t.Errorf("ParseLine(%q) description %q, want %q", tt.line, r.Description, tt.description)
+		}
+	}
+}
+
+func TestParseLineInvalid(t *testing.T) {
+	for _, line := range []string{
+		"not a range",
+		"Some ISP, no range here",
+		"001.002.003.000 - 001.002.003.255 , high , Level",
+		"1.2.3.9 - 1.2.3.0",
+		"Some ISP:1.2.3.0-",
+	} {
+		if _, _, err := ParseLine(line); err == nil {
+			t.Errorf("ParseLine(%q) did not fail", line)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package peer
+
+import (
+	"bytes"
+	"errors"
+
+	"github.com/TheLox95/go-torrent-client/pkg/bencode"
+)
+
+// the reserved bit of the handshake announcing the extension protocol of
+// BEP 10
+const extensionByte = 5
+const extensionBit = 0x10
+
+// extendedHandshakeID is the extended message id of the BEP 10 handshake
+const extendedHandshakeID = 0
+
+type extendedHandshake struct {
+	// M maps the extensions a client supports to their message ids
+	M map[string]int `bencode:"m"`
+	// V is the client name and version
+	V string `bencode:"v,omitempty"`
+}
+
+func supportsExtensions(reserved [8]byte) bool {
+	return reserved[extensionByte]&extensionBit != 0
+}
+
+// encodeExtendedHandshake is the payload of our BEP 10 handshake, we do not
+// support any extension yet but name our client
+func encodeExtendedHandshake(userAgent string) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte(extendedHandshakeID)
+	err := bencode.Marshal(&buf, extendedHandshake{M: map[string]int{}, V: userAgent})
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func parseExtendedHandshake(payload []byte) (extendedHandshake, error) {
+	h := extendedHandshake{}
+	if len(payload) == 0 || payload[0] != extendedHandshakeID {
+		return h, errors.New("not an extended handshake")
+	}
+	// it comes from the peer, anything but canonical bencode is refused
+	err := bencode.UnmarshalStrict(payload[1:], &h)
+	return h, err
+}
@@ -2,19 +2,24 @@ package peer
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"net"
-	"runtime"
+	"slices"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/TheLox95/go-torrent-client/pkg/bitfield"
 	clientidentifier "github.com/TheLox95/go-torrent-client/pkg/clientIdentifier"
+	peerid "github.com/TheLox95/go-torrent-client/pkg/peerID"
 	"github.com/TheLox95/go-torrent-client/pkg/peerMessage"
 	"github.com/TheLox95/go-torrent-client/pkg/piece"
+	"github.com/TheLox95/go-torrent-client/pkg/proxy"
+	ratelimiter "github.com/TheLox95/go-torrent-client/pkg/rateLimiter"
 )
 
 const MAX_REQUEST_PER_PEER = 1
@@ -39,250 +44,619 @@ type Peer struct {
 	Status            PeerStatus
 	conn              *net.Conn
 	Bitfield          *bitfield.Bitfield
+	Proxy             *proxy.Proxy
+	// RateLimits are the shared scopes (global, torrent) the connection is
+	// throttled by, OwnLimits only applies to this peer
+	RateLimits []*ratelimiter.Pair
+	OwnLimits  *ratelimiter.Pair
+	// AmChoking is true while we refuse to upload to the peer
+	AmChoking bool
+	// AmInterested is true while we want pieces from the peer
+	AmInterested bool
+	// PeerInterested is true while the peer wants pieces from us
+	PeerInterested bool
+	Downloaded     int64
+	Uploaded       int64
+	ConnectedAt    time.Time
+	LastPieceAt    time.Time
+	// PeerID is the id the peer sent in its handshake, UserAgent the
+	// client it named in its BEP 10 handshake
+	PeerID    [20]byte
+	UserAgent string
+	// extensions is true when the peer speaks BEP 10
+	extensions bool
+	// OnEvent gets every message of the connection once the peer state
+	// was updated, it runs on the reader goroutine
+	OnEvent func(e Event)
+	wire    *wire
+	// lastActive is the last time data or interest changed hands
+	lastActive time.Time
+	// mu guards the state the reader and writer goroutines change
+	mu sync.Mutex
 }
 
+// Stats is a snapshot of the peer state the connection goroutines keep
+// changing
+type Stats struct {
+	AmChoking      bool
+	AmInterested   bool
+	PeerInterested bool
+	Downloaded     int64
+	Uploaded       int64
+	ConnectedAt    time.Time
+	LastPieceAt    time.Time
+}
+
+// RequestTimeout is how long a piece can take to arrive
+const RequestTimeout = 500 * time.Second
+
+// KeepAliveInterval is how long a connection can go without us sending
+// anything before a keep-alive is sent
+const KeepAliveInterval = 2 * time.Minute
+
+// ReceiveTimeout closes connections the peer sent nothing on, not even a
+// keep-alive
+const ReceiveTimeout = KeepAliveInterval + time.Minute
+
 func (p *Peer) GetID() string {
 	peerUrl := net.JoinHostPort(p.IP.String(), strconv.Itoa(int(p.Port)))
 	return peerUrl
 }
 
 func (p *Peer) CloseConnection() {
-	if p.conn != nil {
-		(*p.conn).SetDeadline(time.Time{}) // Disable the deadline
-		(*p.conn).Close()
-		p.conn = nil
-	}
+	p.mu.Lock()
+	conn, w := p.conn, p.wire
+	p.conn = nil
+	p.wire = nil
 	if p.Status != Disconnected {
 		p.Status = Disconnected
 		p.PiecesAsked = 0
 		p.PiecesDownloaded = 0
+		p.AmChoking = true
+		p.AmInterested = false
+		p.PeerInterested = false
+	}
+	p.mu.Unlock()
+	if w != nil {
+		w.close()
+	}
+	if conn != nil {
+		(*conn).SetDeadline(time.Time{}) // Disable the deadline
+		(*conn).Close()
 	}
 }
 
+// IsConnected is true while the connection is open and the peer lets us
+// download from it
 func (p *Peer) IsConnected() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
 	return p.Status == Connected
 }
-func (p *Peer) Connect(client *(clientidentifier.ClientIdentifier)) error {
-	p.Status = Disconnected
+
+// HasConnection is true while the wire is open, even if the peer chokes us
+func (p *Peer) HasConnection() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.conn != nil && p.Status != Disconnected
+}
+
+func (p *Peer) setStatus(status PeerStatus) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.Status = status
+}
+
+// HasPiece tells if the peer announced a piece
+func (p *Peer) HasPiece(idx int) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.Bitfield != nil && p.Bitfield.HasPiece(idx)
+}
+
+// Pieces is a copy of the bitfield the peer announced
+func (p *Peer) Pieces() bitfield.Bitfield {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.Bitfield == nil {
+		return nil
+	}
+	return slices.Clone(*p.Bitfield)
+}
+
+func (p *Peer) Stats() Stats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return Stats{
+		AmChoking:      p.AmChoking,
+		AmInterested:   p.AmInterested,
+		PeerInterested: p.PeerInterested,
+		Downloaded:     p.Downloaded,
+		Uploaded:       p.Uploaded,
+		ConnectedAt:    p.ConnectedAt,
+		LastPieceAt:    p.LastPieceAt,
+	}
+}
+
+// PiecesCompleted is how many pieces the peer gave us that verified
+func (p *Peer) PiecesCompleted() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.PiecesDownloaded
+}
+
+// FinishPiece records the end of a piece request, verified ones count for
+// the peer when GetPeer ranks it
+func (p *Peer) FinishPiece(verified bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.PiecesAsked = 0
+	if verified {
+		p.PiecesDownloaded++
+	}
+}
+
+// DownloadRate is the average speed in bytes per second the peer sent us
+// data at since it connected
+func (p *Peer) DownloadRate() float64 {
+	stats := p.Stats()
+	elapsed := time.Since(stats.ConnectedAt).Seconds()
+	if stats.ConnectedAt.IsZero() || elapsed <= 0 {
+		return 0
+	}
+	return float64(stats.Downloaded) / elapsed
+}
+
+// Choke stops uploading to the peer, blocks queued for it are dropped as
+// the peer forgets its requests
+func (p *Peer) Choke() error {
+	w := p.currentWire()
+	if w == nil {
+		return errors.New("disconnected user")
+	}
+	w.dropUploads(func(index, begin int) bool { return false })
+	err := w.send(peerMessage.MsgChoke, nil)
+	if err != nil {
+		return fmt.Errorf("failed to send choke: %w", err)
+	}
+	p.mu.Lock()
+	p.AmChoking = true
+	p.mu.Unlock()
+	return nil
+}
+
+func (p *Peer) Unchoke() error {
+	err := p.send(peerMessage.MsgUnchoke, nil)
+	if err != nil {
+		return fmt.Errorf("failed to send unchoke: %w", err)
+	}
+	p.mu.Lock()
+	p.AmChoking = false
+	p.mu.Unlock()
+	return nil
+}
+
+// SetInterested tells the peer whether we want pieces from it
+func (p *Peer) SetInterested(interested bool) error {
+	if p.Stats().AmInterested == interested {
+		return nil
+	}
+	id := peerMessage.MsgNotInterested
+	if interested {
+		id = peerMessage.MsgInterested
+	}
+	err := p.send(id, nil)
+	if err != nil {
+		return fmt.Errorf("failed to send interest: %w", err)
+	}
+	p.mu.Lock()
+	p.AmInterested = interested
+	p.lastActive = time.Now()
+	p.mu.Unlock()
+	return nil
+}
+
+// Idle is how long the connection has gone with no interest on either
+// side and no data moving, zero while either side is interested
+func (p *Peer) Idle(now time.Time) time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.AmInterested || p.PeerInterested || p.lastActive.IsZero() {
+		return 0
+	}
+	return now.Sub(p.lastActive)
+}
+
+// SendBlock queues a block the peer requested, it is refused while we
+// choke the peer or when too many blocks are waiting already
+func (p *Peer) SendBlock(index int, begin int, data []byte) error {
+	w := p.currentWire()
+	if w == nil {
+		return errors.New("disconnected user")
+	}
+	if p.Stats().AmChoking {
+		return errors.New("peer is choked")
+	}
+	if w.queuedUploads() >= MaxQueuedUploads {
+		return errors.New("upload queue is full")
+	}
+	payload := make([]byte, 8+len(data))
+	binary.BigEndian.PutUint32(payload[0:4], uint32(index))
+	binary.BigEndian.PutUint32(payload[4:8], uint32(begin))
+	copy(payload[8:], data)
+	return w.send(peerMessage.MsgPiece, payload)
+}
+
+// interruptOn unblocks every read and write on the connection once ctx
+// is done, call the returned func to stop watching
+func interruptOn(ctx context.Context, conn net.Conn) func() bool {
+	return context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Now())
+	})
+}
+
+func (p *Peer) Connect(ctx context.Context, client *(clientidentifier.ClientIdentifier)) error {
+	p.setStatus(Disconnected)
 	peerUrl := net.JoinHostPort(p.IP.String(), strconv.Itoa(int(p.Port)))
-	if p.conn == nil {
-		peerConn, err := net.DialTimeout("tcp", peerUrl, 30*time.Second)
+	// the handshake works on its own copy, CloseConnection may clear
+	// p.conn at any time
+	p.mu.Lock()
+	conn := p.conn
+	p.mu.Unlock()
+	if conn == nil {
+		peerConn, err := p.Proxy.DialPeer(ctx, peerUrl, 30*time.Second)
 		if err != nil {
 			fmt.Println("Could not call peer:", err)
 			return errors.New("connection failed")
 		}
-		p.conn = &peerConn
+		limited := ratelimiter.WrapConn(peerConn, append(p.RateLimits, p.OwnLimits)...)
+		conn = &limited
+		p.mu.Lock()
+		p.conn = conn
+		p.mu.Unlock()
 	}
+	stop := interruptOn(ctx, *conn)
+	defer stop()
 
-	Pstr := "BitTorrent protocol"
-
-	peerReqBuf := make([]byte, len(Pstr)+49)
-	peerReqBuf[0] = byte(len(Pstr))
-	curr := 1
-	curr += copy(peerReqBuf[curr:], Pstr)
-	curr += copy(peerReqBuf[curr:], make([]byte, 8)) // 8 reserved bytes
-	curr += copy(peerReqBuf[curr:], client.InfoHash[:])
-	curr += copy(peerReqBuf[curr:], client.PeerID[:])
-
-	_, err := (*p.conn).Write(peerReqBuf)
+	err := writeHandshake(*conn, client)
 	if err != nil {
 		fmt.Println("Could not send handshake to peer")
 		return errors.New("handshake failed")
 	}
 
-	_, handshakeInfoHash, _, err := ReadHandshake(*p.conn)
+	handshake, err := ReadHandshake(*conn)
 	if err != nil {
 		fmt.Println("Could not read response from peer", err)
 		return errors.New("handshake read failed")
 	}
-	if !bytes.Equal(handshakeInfoHash[:], client.InfoHash[:]) {
-		fmt.Printf("Expected infohash %x but got %x", handshakeInfoHash, client.InfoHash)
+	if !bytes.Equal(handshake.InfoHash[:], client.InfoHash[:]) {
+		fmt.Printf("Expected infohash %x but got %x", handshake.InfoHash, client.InfoHash)
 		return errors.New("unexpected info hash")
 	}
+	p.setHandshake(handshake)
 
-	lengthBuf := make([]byte, 4)
-	_, err = io.ReadFull(*p.conn, lengthBuf)
+	msg, err := peerMessage.Read(conn)
+	// keep-alives and the extended handshake may come before the bitfield
+	for err == nil && (msg.ID == peerMessage.MsgKeepAlive || msg.ID == peerMessage.MsgExtended) {
+		if msg.ID == peerMessage.MsgExtended {
+			p.apply(nil, Event{Peer: p, Kind: EventExtension, Message: msg})
+		}
+		msg, err = peerMessage.Read(conn)
+	}
 	if err != nil {
-		return errors.New("err reading lenBuf")
+		return errors.New("err reading messageBuf")
 	}
-	length := binary.BigEndian.Uint32(lengthBuf)
 
-	// keep-alive message
-	if length == 0 {
-		return nil
+	isBitfield := msg.ID == peerMessage.MsgBitfield
+	fmt.Println("is bitfield? ", isBitfield)
+	if isBitfield == false {
+		(*conn).Close()
+		return errors.New("bitfield not received")
 	}
+	bit := bitfield.Bitfield(msg.Payload)
 
-	messageBuf := make([]byte, length)
-	msgSize, err := io.ReadFull(*p.conn, messageBuf)
+	_, err = peerMessage.SendMessage(conn, peerMessage.MsgInterested, make([]byte, 0))
 	if err != nil {
-		return errors.New("err reading messageBuf")
+		fmt.Println("Could not send interested", err)
+		return errors.New("INTERESTED request failed")
 	}
-
-	if msgSize == 0 {
-		(*p.conn).Close()
-		return errors.New("bitfield empty")
+	err = p.sendExtendedHandshake(conn, client)
+	if err != nil {
+		return err
 	}
 
-	isBitfield := peerMessage.MessageID((messageBuf[0])) == peerMessage.MsgBitfield
-	fmt.Println("is bitfield? ", isBitfield)
-	if isBitfield == false {
-		(*p.conn).Close()
-		return errors.New("bitfield not received")
-	} else {
-		bit := bitfield.Bitfield(messageBuf[1:])
-		p.Bitfield = &bit
+	p.mu.Lock()
+	if p.conn != conn {
+		p.mu.Unlock()
+		return errors.New("connection closed")
 	}
+	p.Bitfield = &bit
+	// remote peers start choked, the choker decides who we upload to, and
+	// so do we until the peer unchokes us
+	p.AmChoking = true
+	p.PeerInterested = false
+	p.AmInterested = true
+	p.Status = Choked
+	p.ConnectedAt = time.Now()
+	p.lastActive = p.ConnectedAt
+	p.mu.Unlock()
+	return p.start(conn)
+}
 
-	_, err = peerMessage.SendMessage(p.conn, peerMessage.MsgUnchoke, make([]byte, 0))
+// Accept finishes the handshake of a connection the remote peer opened,
+// its handshake was already read to find the torrent it wants. Our
+// bitfield goes first so the peer knows what it can ask for.
+func (p *Peer) Accept(ctx context.Context, conn net.Conn, client *(clientidentifier.ClientIdentifier), remote Handshake, ourBitfield bitfield.Bitfield) error {
+	p.setStatus(Disconnected)
+	p.setHandshake(remote)
+	limited := ratelimiter.WrapConn(conn, append(p.RateLimits, p.OwnLimits)...)
+	own := &limited
+	p.mu.Lock()
+	p.conn = own
+	p.mu.Unlock()
+	stop := interruptOn(ctx, limited)
+	defer stop()
+
+	err := writeHandshake(limited, client)
 	if err != nil {
-		fmt.Println("Could not unchoke", err)
-		return errors.New("unchoke failed")
-	} else {
-		//unchoke, err := response.Read()
-		//if err != nil {
-		//	return errors.New("could not read UNCHOKE response")
-		//}
-		//if unchoke == nil {
-		//	return errors.New("UNCHOKE response is null")
-		//}
-		//fmt.Println("unchoke said: ", unchoke.ID)
-		//if unchoke.ID != peerMessage.MsgUnchoke {
-		//	response, err := peerMessage.SendMessage(p.conn, peerMessage.MsgUnchoke, make([]byte, 0))
-		//	if err != nil {
-		//		fmt.Println("Could not second unchoke: ", err)
-		//		return errors.New("second unchoke failed")
-		//	}
-		//	un, err := response.Read()
-		//	if err != nil {
-		//		return errors.New("could not read second UNCHOKE")
-		//	}
-		//	if un != nil {
-		//		fmt.Println("second unchoke said: ", un.ID)
-		//	} else {
-		//		fmt.Println("second unchoke message is nil")
-		//	}
-		//}
-	}
-
-	_, err = peerMessage.SendMessage(p.conn, peerMessage.MsgInterested, make([]byte, 0))
+		p.CloseConnection()
+		return errors.New("handshake failed")
+	}
+	if len(ourBitfield) > 0 {
+		_, err = peerMessage.SendMessage(own, peerMessage.MsgBitfield, ourBitfield)
+		if err != nil {
+			p.CloseConnection()
+			return errors.New("could not send bitfield")
+		}
+	}
+	err = p.sendExtendedHandshake(own, client)
 	if err != nil {
-		fmt.Println("Could not send interested", err)
+		p.CloseConnection()
+		return err
+	}
+
+	// a peer with no pieces may skip its bitfield entirely
+	bf := make(bitfield.Bitfield, len(ourBitfield))
+	p.mu.Lock()
+	p.Bitfield = &bf
+	p.mu.Unlock()
+	limited.SetReadDeadline(time.Now().Add(30 * time.Second))
+	msg, err := peerMessage.Read(own)
+	limited.SetReadDeadline(time.Time{})
+	var first *Event
+	if err == nil && msg.ID != peerMessage.MsgKeepAlive {
+		e, err := decode(msg)
+		if err != nil {
+			p.CloseConnection()
+			return fmt.Errorf("could not read first message: %w", err)
+		}
+		e.Peer = p
+		first = &e
+	} else if err != nil {
+		var netErr net.Error
+		if !errors.As(err, &netErr) || !netErr.Timeout() {
+			p.CloseConnection()
+			return fmt.Errorf("could not read first message: %w", err)
+		}
+	}
+
+	_, err = peerMessage.SendMessage(own, peerMessage.MsgInterested, make([]byte, 0))
+	if err != nil {
+		p.CloseConnection()
 		return errors.New("INTERESTED request failed")
 	}
+	p.mu.Lock()
+	if p.conn != own {
+		p.mu.Unlock()
+		return errors.New("connection closed")
+	}
+	p.AmChoking = true
+	p.AmInterested = true
+	p.Status = Choked
+	p.ConnectedAt = time.Now()
+	p.lastActive = p.ConnectedAt
+	p.mu.Unlock()
+	if first != nil {
+		// read before the goroutines run, applied ahead of what they read
+		p.apply(nil, *first)
+	}
+	err = p.start(own)
+	if err != nil {
+		return err
+	}
+	if first != nil && p.OnEvent != nil {
+		p.OnEvent(*first)
+	}
+	return nil
+}
 
-	p.Status = Connected
+func (p *Peer) setHandshake(h Handshake) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.PeerID = h.PeerID
+	p.UserAgent = ""
+	p.extensions = supportsExtensions(h.Reserved)
+}
 
+// sendExtendedHandshake is sent before the connection goroutines run, only
+// to peers that speak BEP 10
+func (p *Peer) sendExtendedHandshake(conn *net.Conn, client *(clientidentifier.ClientIdentifier)) error {
+	p.mu.Lock()
+	extensions := p.extensions
+	p.mu.Unlock()
+	if !extensions {
+		return nil
+	}
+	payload, err := encodeExtendedHandshake(client.UserAgent)
+	if err != nil {
+		return fmt.Errorf("could not encode extended handshake: %w", err)
+	}
+	_, err = peerMessage.SendMessage(conn, peerMessage.MsgExtended, payload)
+	if err != nil {
+		return fmt.Errorf("could not send extended handshake: %w", err)
+	}
 	return nil
 }
 
-func (p *Peer) RequestPiece(piece *piece.Piece) error {
-	piece.Buf = make([]byte, piece.Length)
+// Client names the software of the peer, from its BEP 10 handshake when it
+// sent one and from its peer id otherwise
+func (p *Peer) Client() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.UserAgent != "" {
+		return p.UserAgent
+	}
+	if p.PeerID == [20]byte{} {
+		return ""
+	}
+	return peerid.Decode(p.PeerID).String()
+}
+
+func writeHandshake(w io.Writer, client *(clientidentifier.ClientIdentifier)) error {
+	Pstr := "BitTorrent protocol"
 
-	totalDownloaded := 0
-	requested := 0
+	peerReqBuf := make([]byte, len(Pstr)+49)
+	peerReqBuf[0] = byte(len(Pstr))
+	curr := 1
+	curr += copy(peerReqBuf[curr:], Pstr)
+	reserved := make([]byte, 8)
+	reserved[extensionByte] |= extensionBit
+	curr += copy(peerReqBuf[curr:], reserved) // 8 reserved bytes
+	curr += copy(peerReqBuf[curr:], client.InfoHash[:])
+	curr += copy(peerReqBuf[curr:], client.PeerID[:])
 
-	if p.conn == nil {
+	_, err := w.Write(peerReqBuf)
+	return err
+}
+
+// RequestPiece asks for every missing block of a piece and waits for them,
+// the blocks come in through the reader goroutine. A choke drops our
+// requests so they are sent again once the peer unchokes us.
+func (p *Peer) RequestPiece(ctx context.Context, piece *piece.Piece) error {
+	piece.Prepare()
+
+	w := p.currentWire()
+	if w == nil {
 		return errors.New("disconnected user")
 	}
+	req := w.expect(piece.Idx)
+	defer w.forget(req)
 
-	(*p.conn).SetDeadline(time.Now().Add(time.Second * 500))
-	defer (*p.conn).SetDeadline(time.Time{})
-
-	for totalDownloaded < piece.Length {
-		for requested < piece.Length {
-			if p.Status == Choked {
-				continue
-			}
-			piecePayload := make([]byte, 12)
-			binary.BigEndian.PutUint32(piecePayload[0:4], uint32(piece.Idx))
-			binary.BigEndian.PutUint32(piecePayload[4:8], uint32(requested))
-			blockSize := piece.CalculateBlockSize(requested)
-			binary.BigEndian.PutUint32(piecePayload[8:12], uint32(blockSize))
+	timeout := time.NewTimer(RequestTimeout)
+	defer timeout.Stop()
 
-			response, err := peerMessage.SendMessage(p.conn, peerMessage.MsgRequest, piecePayload)
+	requested := false
+	// blocks restored from a previous run are not asked again
+	for piece.ReceivedBytes() < piece.Length {
+		if !requested && p.IsConnected() {
+			err := p.requestMissing(w, peerMessage.MsgRequest, piece)
 			if err != nil {
-				fmt.Println("Failed to send message", err)
-				//TODO: return error and disconnect user outside this function
-				if p.IsConnected() {
-					p.CloseConnection()
-				}
 				return fmt.Errorf("failed to send piece request: %w", err)
 			}
-
-			if response == nil {
-				fmt.Println("Piece response is nil")
-				return errors.New("piece response is nil")
+			requested = true
+		}
+		select {
+		case <-ctx.Done():
+			if requested {
+				p.requestMissing(w, peerMessage.MsgCancel, piece)
+			}
+			return ctx.Err()
+		case <-timeout.C:
+			if requested {
+				p.requestMissing(w, peerMessage.MsgCancel, piece)
+			}
+			return errors.New("piece request timed out")
+		case <-w.closed:
+			return errors.New("connection closed")
+		case e := <-req.events:
+			switch e.Kind {
+			case EventChoke:
+				requested = false
+			case EventPiece:
+				payloadSize, err := piece.ParsePiece(e.Message)
+				if err != nil {
+					fmt.Println("Received :::::::::::::::::::::::::", err)
+					return err
+				}
+				if payloadSize > 0 {
+					piece.SetBlockSource(e.Begin, p.GetID())
+				}
+				p.mu.Lock()
+				p.Downloaded += int64(payloadSize)
+				p.LastPieceAt = time.Now()
+				p.lastActive = p.LastPieceAt
+				p.mu.Unlock()
+				fmt.Println("pieceIDX: ", piece.Idx, " Downloaded: ", piece.ReceivedBytes(), " of Total: ", piece.Length, " [", p.GetID(), "]")
 			}
-
-			requested += blockSize
 		}
+	}
 
-		msg, err := peerMessage.Read(p.conn)
-		if err != nil {
-			fmt.Println("Could not read message response", err)
-			return fmt.Errorf("could not read message response: %w", err)
-		}
-		if msg.ID == peerMessage.MsgChoke {
-			p.Status = Choked
-		} else if msg.ID == peerMessage.MsgUnchoke {
-			p.Status = Connected
-		} else if msg.ID == peerMessage.MsgHave {
-			index := int(binary.BigEndian.Uint32(msg.Payload))
-			p.Bitfield.SetPiece(index)
-		} else if msg.ID == peerMessage.MsgPiece {
-			payloadSize, err := piece.ParsePiece(msg)
-			if err != nil {
-				fmt.Println("Received :::::::::::::::::::::::::", err)
-				return err
-			}
+	return nil
+}
 
-			totalDownloaded += payloadSize
+// requestMissing sends a request or a cancel for every block of the piece
+// we do not have yet, all of them in one write
+func (p *Peer) requestMissing(w *wire, id peerMessage.MessageID, piece *piece.Piece) error {
+	for begin := 0; begin < piece.Length; begin += piece.CalculateBlockSize(begin) {
+		if piece.HasBlock(begin) {
+			continue
+		}
+		payload := make([]byte, 12)
+		binary.BigEndian.PutUint32(payload[0:4], uint32(piece.Idx))
+		binary.BigEndian.PutUint32(payload[4:8], uint32(begin))
+		binary.BigEndian.PutUint32(payload[8:12], uint32(piece.CalculateBlockSize(begin)))
+		err := w.send(id, payload)
+		if err != nil {
+			return err
 		}
-		fmt.Println("pieceIDX: ", piece.Idx, " Downloaded: ", totalDownloaded, " of Total: ", piece.Length, " [", (*p.conn).RemoteAddr().String(), "] | routines ", runtime.NumGoroutine())
 	}
-
 	return nil
 }
 
 func (p *Peer) OnPieceRequestSucceed(index int) error {
 	payload := make([]byte, 4)
 	binary.BigEndian.PutUint32(payload, uint32(index))
-	if p.conn == nil {
-		return errors.New("disconnected user")
-	}
-	_, err := peerMessage.SendMessage(p.conn, peerMessage.MsgHave, payload)
+	err := p.send(peerMessage.MsgHave, payload)
 	if err != nil {
 		return errors.New("failed to send HAVING request")
 	}
 	return nil
 }
 
-func ReadHandshake(r io.Reader) (string, [20]byte, [20]byte, error) {
-	var a [20]byte
+// Handshake is the first message of a connection
+type Handshake struct {
+	Protocol string
+	Reserved [8]byte
+	InfoHash [20]byte
+	PeerID   [20]byte
+}
+
+func ReadHandshake(r io.Reader) (Handshake, error) {
+	var h Handshake
 
 	lengthBuf := make([]byte, 1)
 	_, err := io.ReadFull(r, lengthBuf)
 	if err != nil {
-		return "", a, a, err
+		return h, err
 	}
 	pstrlen := int(lengthBuf[0])
 
 	if pstrlen == 0 {
 		err := fmt.Errorf("pstrlen cannot be 0")
-		return "", a, a, err
+		return h, err
 	}
 
 	handshakeBuf := make([]byte, 48+pstrlen)
 	_, err = io.ReadFull(r, handshakeBuf)
 	if err != nil {
-		return "", a, a, err
+		return h, err
 	}
 
-	var infoHash, peerID [20]byte
-
-	copy(infoHash[:], handshakeBuf[pstrlen+8:pstrlen+8+20])
-	copy(peerID[:], handshakeBuf[pstrlen+8+20:])
+	h.Protocol = string(handshakeBuf[0:pstrlen])
+	copy(h.Reserved[:], handshakeBuf[pstrlen:pstrlen+8])
+	copy(h.InfoHash[:], handshakeBuf[pstrlen+8:pstrlen+8+20])
+	copy(h.PeerID[:], handshakeBuf[pstrlen+8+20:])
 
-	return string(handshakeBuf[0:pstrlen]), infoHash, peerID, nil
+	return h, nil
 
 }
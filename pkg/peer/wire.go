@@ -0,0 +1,382 @@
+package peer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/TheLox95/go-torrent-client/pkg/bitfield"
+	"github.com/TheLox95/go-torrent-client/pkg/peerMessage"
+)
+
+type EventKind int
+
+const (
+	EventChoke EventKind = iota
+	EventUnchoke
+	EventInterested
+	EventNotInterested
+	EventHave
+	EventBitfield
+	EventRequest
+	EventPiece
+	EventCancel
+	EventExtension
+	// EventClosed is the last event of a connection
+	EventClosed
+)
+
+// Event is a message the reader goroutine decoded, the peer state it
+// changes (choke, interest, bitfield) is already updated when it is seen
+type Event struct {
+	Peer *Peer
+	Kind EventKind
+	// Index, Begin and Length are set for have, request, piece and cancel
+	Index  int
+	Begin  int
+	Length int
+	// Message is the raw message, nil for EventClosed
+	Message *peerMessage.PeerMessage
+	// Err is why the connection closed
+	Err error
+}
+
+// MaxQueuedUploads caps the blocks a peer can have waiting to be sent,
+// requests past it are dropped
+const MaxQueuedUploads = 256
+
+type outgoing struct {
+	id      peerMessage.MessageID
+	payload []byte
+}
+
+// pendingRequest is the piece a RequestPiece call waits for, the reader
+// routes its blocks and the choke changes to it
+type pendingRequest struct {
+	idx    int
+	events chan Event
+	done   chan struct{}
+}
+
+// wire is one open connection, a reader goroutine decodes what comes in
+// and a writer goroutine sends everything queued since its last write in
+// a single write
+type wire struct {
+	conn    *net.Conn
+	outbox  []outgoing
+	queued  chan struct{}
+	closed  chan struct{}
+	once    sync.Once
+	request *pendingRequest
+	mu      sync.Mutex
+}
+
+func newWire(conn *net.Conn) *wire {
+	return &wire{
+		conn:   conn,
+		queued: make(chan struct{}, 1),
+		closed: make(chan struct{}),
+	}
+}
+
+func (w *wire) close() {
+	w.once.Do(func() {
+		close(w.closed)
+	})
+}
+
+func (w *wire) send(id peerMessage.MessageID, payload []byte) error {
+	w.mu.Lock()
+	select {
+	case <-w.closed:
+		w.mu.Unlock()
+		return errors.New("disconnected user")
+	default:
+	}
+	w.outbox = append(w.outbox, outgoing{id: id, payload: payload})
+	w.mu.Unlock()
+	select {
+	case w.queued <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (w *wire) take() []outgoing {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	batch := w.outbox
+	w.outbox = nil
+	return batch
+}
+
+func (w *wire) queuedUploads() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	count := 0
+	for _, msg := range w.outbox {
+		if msg.id == peerMessage.MsgPiece {
+			count++
+		}
+	}
+	return count
+}
+
+// dropUploads removes queued blocks that were not sent yet, the ones
+// matching keep stay
+func (w *wire) dropUploads(keep func(index, begin int) bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	outbox := w.outbox[:0]
+	for _, msg := range w.outbox {
+		if msg.id == peerMessage.MsgPiece && !keep(blockPosition(msg.payload)) {
+			continue
+		}
+		outbox = append(outbox, msg)
+	}
+	w.outbox = outbox
+}
+
+func (w *wire) expect(idx int) *pendingRequest {
+	req := &pendingRequest{idx: idx, events: make(chan Event), done: make(chan struct{})}
+	w.mu.Lock()
+	w.request = req
+	w.mu.Unlock()
+	return req
+}
+
+func (w *wire) forget(req *pendingRequest) {
+	w.mu.Lock()
+	if w.request == req {
+		w.request = nil
+	}
+	w.mu.Unlock()
+	close(req.done)
+}
+
+// route hands an event to the RequestPiece waiting on it, if any
+func (w *wire) route(e Event) {
+	w.mu.Lock()
+	req := w.request
+	w.mu.Unlock()
+	if req == nil {
+		return
+	}
+	if e.Kind == EventPiece && e.Index != req.idx {
+		return
+	}
+	if e.Kind != EventPiece && e.Kind != EventChoke && e.Kind != EventUnchoke {
+		return
+	}
+	select {
+	case req.events <- e:
+	case <-req.done:
+	case <-w.closed:
+	}
+}
+
+func blockPosition(payload []byte) (index int, begin int) {
+	return int(binary.BigEndian.Uint32(payload[0:4])), int(binary.BigEndian.Uint32(payload[4:8]))
+}
+
+// decode turns a message into an event, a malformed one is an error
+func decode(msg *peerMessage.PeerMessage) (Event, error) {
+	e := Event{Message: msg}
+	switch msg.ID {
+	case peerMessage.MsgChoke:
+		e.Kind = EventChoke
+	case peerMessage.MsgUnchoke:
+		e.Kind = EventUnchoke
+	case peerMessage.MsgInterested:
+		e.Kind = EventInterested
+	case peerMessage.MsgNotInterested:
+		e.Kind = EventNotInterested
+	case peerMessage.MsgHave:
+		if len(msg.Payload) != 4 {
+			return e, errors.New("malformed have")
+		}
+		e.Kind = EventHave
+		e.Index = int(binary.BigEndian.Uint32(msg.Payload))
+	case peerMessage.MsgBitfield:
+		e.Kind = EventBitfield
+	case peerMessage.MsgRequest, peerMessage.MsgCancel:
+		if len(msg.Payload) != 12 {
+			return e, fmt.Errorf("malformed message %d", msg.ID)
+		}
+		e.Kind = EventRequest
+		if msg.ID == peerMessage.MsgCancel {
+			e.Kind = EventCancel
+		}
+		e.Index, e.Begin = blockPosition(msg.Payload)
+		e.Length = int(binary.BigEndian.Uint32(msg.Payload[8:12]))
+	case peerMessage.MsgPiece:
+		if len(msg.Payload) < 8 {
+			return e, errors.New("malformed piece")
+		}
+		e.Kind = EventPiece
+		e.Index, e.Begin = blockPosition(msg.Payload)
+		e.Length = len(msg.Payload) - 8
+	case peerMessage.MsgExtended:
+		e.Kind = EventExtension
+	default:
+		return e, fmt.Errorf("unknown message %d", msg.ID)
+	}
+	return e, nil
+}
+
+// start runs the goroutines of the connection the handshake was made on,
+// unless it was closed meanwhile
+func (p *Peer) start(conn *net.Conn) error {
+	p.mu.Lock()
+	if p.conn != conn {
+		p.mu.Unlock()
+		return errors.New("connection closed")
+	}
+	w := newWire(conn)
+	p.wire = w
+	p.mu.Unlock()
+	go p.readLoop(w)
+	go p.writeLoop(w)
+	return nil
+}
+
+func (p *Peer) currentWire() *wire {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.wire
+}
+
+func (p *Peer) send(id peerMessage.MessageID, payload []byte) error {
+	w := p.currentWire()
+	if w == nil {
+		return errors.New("disconnected user")
+	}
+	return w.send(id, payload)
+}
+
+func (p *Peer) readLoop(w *wire) {
+	for {
+		(*w.conn).SetReadDeadline(time.Now().Add(ReceiveTimeout))
+		msg, err := peerMessage.Read(w.conn)
+		if err == nil && msg.ID == peerMessage.MsgKeepAlive {
+			// it only kept the read deadline from firing
+			continue
+		}
+		var e Event
+		if err == nil {
+			e, err = decode(msg)
+		}
+		if err != nil {
+			p.drop(w)
+			if p.OnEvent != nil {
+				p.OnEvent(Event{Peer: p, Kind: EventClosed, Err: err})
+			}
+			return
+		}
+		e.Peer = p
+		p.apply(w, e)
+		w.route(e)
+		if p.OnEvent != nil {
+			p.OnEvent(e)
+		}
+	}
+}
+
+// apply updates the peer state an event changes
+func (p *Peer) apply(w *wire, e Event) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	switch e.Kind {
+	case EventChoke:
+		if p.Status == Connected {
+			p.Status = Choked
+		}
+	case EventUnchoke:
+		if p.Status == Choked {
+			p.Status = Connected
+		}
+	case EventInterested:
+		p.PeerInterested = true
+		p.lastActive = time.Now()
+	case EventNotInterested:
+		p.PeerInterested = false
+		p.lastActive = time.Now()
+	case EventRequest:
+		p.lastActive = time.Now()
+	case EventHave:
+		if p.Bitfield != nil {
+			p.Bitfield.SetPiece(e.Index)
+		}
+	case EventBitfield:
+		received := bitfield.Bitfield(e.Message.Payload)
+		p.Bitfield = &received
+	case EventExtension:
+		handshake, err := parseExtendedHandshake(e.Message.Payload)
+		if err == nil {
+			p.UserAgent = handshake.V
+		}
+	case EventCancel:
+		if w == nil {
+			return
+		}
+		w.dropUploads(func(index, begin int) bool {
+			return index != e.Index || begin != e.Begin
+		})
+	}
+}
+
+func (p *Peer) writeLoop(w *wire) {
+	var buf bytes.Buffer
+	keepAlive := time.NewTimer(KeepAliveInterval)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-w.closed:
+			return
+		case <-keepAlive.C:
+			w.send(peerMessage.MsgKeepAlive, nil)
+			continue
+		case <-w.queued:
+		}
+		buf.Reset()
+		uploaded := 0
+		for _, msg := range w.take() {
+			buf.Write(peerMessage.Encode(msg.id, msg.payload))
+			if msg.id == peerMessage.MsgPiece {
+				uploaded += len(msg.payload) - 8
+			}
+		}
+		if buf.Len() == 0 {
+			continue
+		}
+		_, err := (*w.conn).Write(buf.Bytes())
+		if err != nil {
+			// the reader fails right after and reports it
+			p.drop(w)
+			return
+		}
+		keepAlive.Reset(KeepAliveInterval)
+		if uploaded > 0 {
+			p.mu.Lock()
+			p.Uploaded += int64(uploaded)
+			p.lastActive = time.Now()
+			p.mu.Unlock()
+		}
+	}
+}
+
+// drop closes the connection after its reader or writer failed, unless
+// it was replaced already
+func (p *Peer) drop(w *wire) {
+	p.mu.Lock()
+	current := p.wire == w
+	p.mu.Unlock()
+	if current {
+		p.CloseConnection()
+	}
+	w.close()
+}
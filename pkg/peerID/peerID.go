@@ -0,0 +1,213 @@
+package peerid
+
+import (
+	"crypto/rand"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ClientCode and Version make the Azureus style prefix of our peer ids
+const ClientCode = "GT"
+const ClientName = "go-torrent-client"
+const Version = "0.1.0"
+
+// randomChars fill the peer id after its prefix, printable so the id
+// reads well in tracker logs
+const randomChars = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+
+// Prefix is the Azureus style prefix naming this client, -GT0100-
+func Prefix() string {
+	digits := ""
+	for _, part := range strings.Split(Version, ".") {
+		digits += part
+	}
+	return fmt.Sprintf("-%s%-4.4s-", ClientCode, digits+"0000")
+}
+
+// UserAgent names this client in HTTP tracker requests and the BEP 10
+// handshake
+func UserAgent() string {
+	return ClientName + "/" + Version
+}
+
+// Generate makes a peer id starting with prefix and random after it, the
+// prefix can mimic another client for trackers that only allow a few
+func Generate(prefix string) ([20]byte, error) {
+	var id [20]byte
+	if len(prefix) > 12 {
+		return id, fmt.Errorf("peer id prefix %q is longer than 12 bytes", prefix)
+	}
+	n := copy(id[:], prefix)
+	random := make([]byte, len(id)-n)
+	_, err := rand.Read(random)
+	if err != nil {
+		return id, fmt.Errorf("could not generate peer id: %w", err)
+	}
+	for i, b := range random {
+		id[n+i] = randomChars[int(b)%len(randomChars)]
+	}
+	return id, nil
+}
+
+// Client is the software a peer runs, as its peer id tells
+type Client struct {
+	Name    string
+	Version string
+}
+
+func (c Client) String() string {
+	if c.Version == "" {
+		return c.Name
+	}
+	return c.Name + " " + c.Version
+}
+
+// Unknown is the client of peer ids that follow no known convention
+var Unknown = Client{Name: "unknown"}
+
+// azureusClients are the two letter codes of Azureus style ids, -XX1234-
+var azureusClients = map[string]string{
+	"AG": "Ares",
+	"AZ": "Vuze",
+	"BC": "BitComet",
+	"BF": "Bitflu",
+	"BI": "BiglyBT",
+	"BT": "BitTorrent",
+	"DE": "Deluge",
+	"FD": "Free Download Manager",
+	"FW": "FrostWire",
+	"GR": "GetRight",
+	"GT": ClientName,
+	"KT": "KTorrent",
+	"LT": "libtorrent",
+	"lt": "rTorrent",
+	"MG": "MediaGet",
+	"ML": "MLDonkey",
+	"PI": "PicoTorrent",
+	"qB": "qBittorrent",
+	"SD": "Thunder",
+	"TL": "Tribler",
+	"TR": "Transmission",
+	"TT": "TuoTu",
+	"UM": "µTorrent Mac",
+	"UT": "µTorrent",
+	"UW": "µTorrent Web",
+	"WW": "WebTorrent",
+	"XL": "Xunlei",
+}
+
+// shadowClients are the one letter codes of Shadow style ids, X12345--
+var shadowClients = map[byte]string{
+	'A': "ABC",
+	'O': "Osprey Permaseed",
+	'Q': "BTQueue",
+	'R': "Tribler",
+	'S': "Shadow",
+	'T': "BitTornado",
+	'U': "UPnP NAT Bit Torrent",
+}
+
+// Decode tells the client and its version from the first bytes of a peer
+// id
+func Decode(id [20]byte) Client {
+	if c, ok := decodeAzureus(id); ok {
+		return c
+	}
+	if c, ok := decodeMainline(id); ok {
+		return c
+	}
+	if c, ok := decodeShadow(id); ok {
+		return c
+	}
+	return Unknown
+}
+
+// versionDigit reads the version characters of Azureus and Shadow ids,
+// 0-9 then A-Z for 10 to 35, then a-z
+func versionDigit(b byte) (int, bool) {
+	switch {
+	case b >= '0' && b <= '9':
+		return int(b - '0'), true
+	case b >= 'A' && b <= 'Z':
+		return int(b-'A') + 10, true
+	case b >= 'a' && b <= 'z':
+		return int(b-'a') + 36, true
+	case b == '.':
+		return 62, true
+	}
+	return 0, false
+}
+
+func decodeAzureus(id [20]byte) (Client, bool) {
+	if id[0] != '-' || id[7] != '-' {
+		return Client{}, false
+	}
+	code := string(id[1:3])
+	name, ok := azureusClients[code]
+	if !ok {
+		for _, b := range id[1:3] {
+			if !isAlnum(b) {
+				return Client{}, false
+			}
+		}
+		// unknown clients keep their code so they can still be told apart
+		name = code
+	}
+	parts := []string{}
+	for _, b := range id[3:7] {
+		if !isAlnum(b) {
+			return Client{Name: name}, true
+		}
+		digit, _ := versionDigit(b)
+		parts = append(parts, strconv.Itoa(digit))
+	}
+	// the last part is a build number most clients leave at 0
+	if parts[3] == "0" {
+		parts = parts[:3]
+	}
+	return Client{Name: name, Version: strings.Join(parts, ".")}, true
+}
+
+// decodeMainline reads ids like M4-3-6-- and M7-10-3-
+func decodeMainline(id [20]byte) (Client, bool) {
+	if id[0] != 'M' {
+		return Client{}, false
+	}
+	fields := strings.SplitN(string(id[1:8]), "-", 4)
+	if len(fields) < 4 {
+		return Client{}, false
+	}
+	for _, field := range fields[:3] {
+		if _, err := strconv.Atoi(field); err != nil {
+			return Client{}, false
+		}
+	}
+	return Client{Name: "BitTorrent", Version: strings.Join(fields[:3], ".")}, true
+}
+
+// decodeShadow reads ids like S58B----- where every character after the
+// client letter is a version part, up to five of them
+func decodeShadow(id [20]byte) (Client, bool) {
+	name, ok := shadowClients[id[0]]
+	if !ok {
+		return Client{}, false
+	}
+	parts := []string{}
+	i := 1
+	for ; i < 6 && id[i] != '-'; i++ {
+		digit, ok := versionDigit(id[i])
+		if !ok {
+			return Client{}, false
+		}
+		parts = append(parts, strconv.Itoa(digit))
+	}
+	if len(parts) == 0 || id[i] != '-' || id[i+1] != '-' {
+		return Client{}, false
+	}
+	return Client{Name: name, Version: strings.Join(parts, ".")}, true
+}
+
+func isAlnum(b byte) bool {
+	return b >= '0' && b <= '9' || b >= 'A' && b <= 'Z' || b >= 'a' && b <= 'z'
+}
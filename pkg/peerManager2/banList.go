@@ -0,0 +1,51 @@
+package peermanager2
+
+import (
+	"net"
+	"slices"
+	"sync"
+)
+
+// BanList holds the addresses of peers caught sending corrupt data, a
+// session shares one between its torrents. A nil BanList bans nobody.
+type BanList struct {
+	ips map[string]bool
+	mu  sync.Mutex
+}
+
+func NewBanList() *BanList {
+	return &BanList{ips: make(map[string]bool)}
+}
+
+func (b *BanList) Ban(ip net.IP) {
+	if b == nil || ip == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.ips[ip.String()] = true
+}
+
+func (b *BanList) Banned(ip net.IP) bool {
+	if b == nil || ip == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.ips[ip.String()]
+}
+
+// List returns the banned addresses, sorted
+func (b *BanList) List() []string {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ips := make([]string, 0, len(b.ips))
+	for ip := range b.ips {
+		ips = append(ips, ip)
+	}
+	slices.Sort(ips)
+	return ips
+}
@@ -0,0 +1,359 @@
+package peermanager2
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"net"
+	"slices"
+	"time"
+
+	"github.com/TheLox95/go-torrent-client/pkg/peer"
+)
+
+// PeerSource is where we learned about a peer, later sources rank higher
+// when picking who to dial
+type PeerSource int
+
+const (
+	// SourceDHT peers were announced by anyone, they rank last
+	SourceDHT PeerSource = iota
+	SourceTracker
+	SourceIncoming
+	// SourceResume peers were connected in a previous run
+	SourceResume
+)
+
+// DefaultMaxConnections caps the open connections of one torrent
+const DefaultMaxConnections = 50
+
+// MaxConnectFailures is how many dials in a row a peer can fail before it
+// is not tried again
+const MaxConnectFailures = 8
+
+// connectBackoff is the wait after the first failed dial, it doubles with
+// every failure up to maxConnectBackoff
+const connectBackoff = 30 * time.Second
+const maxConnectBackoff = 30 * time.Minute
+
+// evictGrace protects new connections from being evicted before they had
+// a chance to be useful
+const evictGrace = time.Minute
+
+// connectInterval is how often the candidates are looked at when nothing
+// woke the connect loop up
+const connectInterval = time.Second
+
+// candidate is what we know about a peer to decide who to connect to
+type candidate struct {
+	source PeerSource
+	// connected is true once a connection to the peer worked
+	connected   bool
+	failures    int
+	nextAttempt time.Time
+	dialing     bool
+	// priority is the BEP 40 canonical priority, higher first
+	priority uint32
+}
+
+// better ranks peers that worked before first, then the ones that failed
+// less, then by source and canonical priority
+func (c *candidate) better(o *candidate) bool {
+	if c.connected != o.connected {
+		return c.connected
+	}
+	if c.failures != o.failures {
+		return c.failures < o.failures
+	}
+	if c.source != o.source {
+		return c.source > o.source
+	}
+	return c.priority > o.priority
+}
+
+// CanonicalPriority is the BEP 40 priority of a connection between two
+// peers, both sides compute the same value so the swarm agrees on which
+// connections to keep
+func CanonicalPriority(ip1 net.IP, port1 uint16, ip2 net.IP, port2 uint16) uint32 {
+	table := crc32.MakeTable(crc32.Castagnoli)
+	a, b := ip1.To4(), ip2.To4()
+	// the first bytes that are always kept, a /16 for IPv4 and a /48 for
+	// IPv6
+	keep := 2
+	if a == nil || b == nil {
+		a, b = ip1.To16(), ip2.To16()
+		keep = 6
+	}
+	if a == nil || b == nil || len(a) != len(b) {
+		return 0
+	}
+	if a.Equal(b) {
+		ports := []uint16{port1, port2}
+		slices.Sort(ports)
+		buf := make([]byte, 4)
+		binary.BigEndian.PutUint16(buf[0:2], ports[0])
+		binary.BigEndian.PutUint16(buf[2:4], ports[1])
+		return crc32.Checksum(buf, table)
+	}
+	// the mask covers the first byte that differs once past the kept ones
+	common := 0
+	for common < len(a) && a[common] == b[common] {
+		common++
+	}
+	full := max(keep, common+1)
+	masked := func(ip net.IP) []byte {
+		out := make([]byte, len(ip))
+		for i := range ip {
+			mask := byte(0x55)
+			if i < full {
+				mask = 0xff
+			}
+			out[i] = ip[i] & mask
+		}
+		return out
+	}
+	ma, mb := masked(a), masked(b)
+	if slices.Compare(ma, mb) > 0 {
+		ma, mb = mb, ma
+	}
+	return crc32.Checksum(append(ma, mb...), table)
+}
+
+// candidate must be called with mu held
+func (m *PeerManager2) candidate(p *peer.Peer) *candidate {
+	if m.candidates == nil {
+		m.candidates = make(map[string]*candidate)
+	}
+	c, ok := m.candidates[p.GetID()]
+	if !ok {
+		c = &candidate{}
+		if m.ExternalIP != nil {
+			c.priority = CanonicalPriority(m.ExternalIP, uint16(m.ListenPort), p.IP, p.Port)
+		}
+		m.candidates[p.GetID()] = c
+	}
+	return c
+}
+
+// signalCandidates wakes the connect loop up
+func (m *PeerManager2) signalCandidates() {
+	select {
+	case m.candidatesChanged <- struct{}{}:
+	default:
+	}
+}
+
+// connectPeers dials the best candidates while there is room for them
+func (m *PeerManager2) connectPeers(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(connectInterval)
+		defer ticker.Stop()
+		for {
+			m.dialCandidates(ctx)
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			case <-m.candidatesChanged:
+			}
+		}
+	}()
+}
+
+func (m *PeerManager2) dialCandidates(ctx context.Context) {
+	for ctx.Err() == nil {
+		best := m.bestCandidate(time.Now())
+		if best == nil {
+			return
+		}
+		worst, ok := m.roomFor(best)
+		if !ok || !m.acquireHalfOpen() {
+			return
+		}
+		if !m.takeCandidate(best) {
+			m.releaseHalfOpen()
+			continue
+		}
+		// only evicted once the dial that replaces it is certain
+		if worst != nil {
+			fmt.Println("evicting", worst.GetID(), "for", best.GetID())
+			worst.CloseConnection()
+			m.backOff(worst, connectBackoff)
+		}
+		go func() {
+			defer m.signalCandidates()
+			defer m.releaseHalfOpen()
+			m.stablishConnection(ctx, best)
+		}()
+	}
+}
+
+// bestCandidate is the unconnected peer most worth dialing now
+func (m *PeerManager2) bestCandidate(now time.Time) *peer.Peer {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var best *peer.Peer
+	var bestCandidate *candidate
+	for _, p := range m.unconnectedPeers {
+		c := m.candidate(p)
+		if c.dialing || c.failures >= MaxConnectFailures || now.Before(c.nextAttempt) || m.Banned.Banned(p.IP) {
+			continue
+		}
+		if m.Filter.Blocked(p.IP) {
+			// looked at again later in case the filter is reloaded
+			c.nextAttempt = now.Add(connectBackoff)
+			continue
+		}
+		if best == nil || c.better(bestCandidate) {
+			best, bestCandidate = p, c
+		}
+	}
+	return best
+}
+
+// takeCandidate moves a peer from the pool to the dialing ones, false if
+// someone else took it meanwhile
+func (m *PeerManager2) takeCandidate(p *peer.Peer) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	idx := slices.Index(m.unconnectedPeers, p)
+	if idx == -1 {
+		return false
+	}
+	m.unconnectedPeers = slices.Delete(m.unconnectedPeers, idx, idx+1)
+	delete(m.pooled, p.GetID())
+	m.candidate(p).dialing = true
+	m.dialing++
+	return true
+}
+
+func (m *PeerManager2) finishDial(p *peer.Peer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c := m.candidate(p)
+	if c.dialing {
+		c.dialing = false
+		m.dialing--
+	}
+}
+
+// recordConnect updates the ranking of a peer after a connection attempt,
+// failures back it off exponentially
+func (m *PeerManager2) recordConnect(p *peer.Peer, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c := m.candidate(p)
+	if err == nil {
+		c.connected = true
+		c.failures = 0
+		return
+	}
+	c.failures++
+	backoff := connectBackoff << min(c.failures-1, 10)
+	c.nextAttempt = time.Now().Add(min(backoff, maxConnectBackoff))
+}
+
+// backOff keeps a peer we closed on purpose from being dialed again for d
+func (m *PeerManager2) backOff(p *peer.Peer, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.candidate(p).nextAttempt = time.Now().Add(d)
+}
+
+// hasRoom tells if the torrent and the session can take one more
+// connection
+func (m *PeerManager2) hasRoom() bool {
+	m.mu.Lock()
+	dialing := m.dialing
+	m.mu.Unlock()
+	limit := m.MaxConnections
+	if limit == 0 {
+		limit = DefaultMaxConnections
+	}
+	if limit > 0 && len(m.ConnectedPeers())+dialing >= limit {
+		return false
+	}
+	return m.CanConnect == nil || m.CanConnect()
+}
+
+// roomFor is true when there is a free slot for the candidate or when the
+// worst connected peer can be evicted for it. That peer is returned for
+// the caller to close.
+func (m *PeerManager2) roomFor(p *peer.Peer) (*peer.Peer, bool) {
+	if m.hasRoom() {
+		return nil, true
+	}
+	worst := m.worstConnected(time.Now())
+	if worst == nil {
+		return nil, false
+	}
+	m.mu.Lock()
+	better := m.candidate(p).better(m.candidate(worst))
+	m.mu.Unlock()
+	if !better {
+		return nil, false
+	}
+	return worst, true
+}
+
+// worstConnected is the lowest ranked connection that is not useful, nil
+// when every connection is. Useful ones sent us data or got data from us
+// lately, or are too new to tell.
+func (m *PeerManager2) worstConnected(now time.Time) *peer.Peer {
+	var worst *peer.Peer
+	for _, p := range m.ConnectedPeers() {
+		stats := p.Stats()
+		if now.Sub(stats.ConnectedAt) < evictGrace || now.Sub(stats.LastPieceAt) < evictGrace {
+			continue
+		}
+		if !stats.AmChoking && stats.PeerInterested {
+			continue
+		}
+		m.mu.Lock()
+		worse := worst == nil || m.candidate(worst).better(m.candidate(p))
+		m.mu.Unlock()
+		if worse {
+			worst = p
+		}
+	}
+	return worst
+}
+
+func (m *PeerManager2) acquireHalfOpen() bool {
+	if m.HalfOpen == nil {
+		return true
+	}
+	select {
+	case m.HalfOpen <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (m *PeerManager2) releaseHalfOpen() {
+	if m.HalfOpen != nil {
+		<-m.HalfOpen
+	}
+}
+
+// Ban stops talking to the address of a peer that sent corrupt data, in
+// every torrent sharing the ban list
+func (m *PeerManager2) Ban(id string) {
+	host, _, err := net.SplitHostPort(id)
+	if err != nil {
+		return
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || m.Banned.Banned(ip) {
+		return
+	}
+	fmt.Println("banning", ip)
+	m.Banned.Ban(ip)
+	for _, p := range m.ConnectedPeers() {
+		if p.IP.Equal(ip) {
+			p.CloseConnection()
+		}
+	}
+}
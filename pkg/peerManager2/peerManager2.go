@@ -1,6 +1,7 @@
 package peermanager2
 
 import (
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -8,15 +9,21 @@ import (
 	"net"
 	"net/http"
 	"net/url"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/TheLox95/go-torrent-client/pkg/bencode"
 	"github.com/TheLox95/go-torrent-client/pkg/bitfield"
 	clientidentifier "github.com/TheLox95/go-torrent-client/pkg/clientIdentifier"
+	ipfilter "github.com/TheLox95/go-torrent-client/pkg/ipFilter"
 	"github.com/TheLox95/go-torrent-client/pkg/peer"
-	"github.com/jackpal/bencode-go"
+	"github.com/TheLox95/go-torrent-client/pkg/proxy"
+	ratelimiter "github.com/TheLox95/go-torrent-client/pkg/rateLimiter"
+	resumedata "github.com/TheLox95/go-torrent-client/pkg/resumeData"
 )
 
 const ProtocolID = 0x41727101980 // The protocol ID for BitTorrent
@@ -25,6 +32,20 @@ const AnnounceAction = 1
 
 const Port = 6969
 
+// announce events, numbered as in the UDP tracker protocol
+const (
+	EventNone      = 0
+	EventCompleted = 1
+	EventStarted   = 2
+	EventStopped   = 3
+)
+
+var httpEvents = map[int]string{
+	EventCompleted: "completed",
+	EventStarted:   "started",
+	EventStopped:   "stopped",
+}
+
 type bencodeTrackerResp struct {
 	Interval int    `bencode:"interval"`
 	Peers    string `bencode:"peers"`
@@ -36,9 +57,20 @@ type GetPeersFromUDPParams struct {
 	PeerID        [20]byte
 	Url           string
 	TorrentLen    int
+	// Port is where we accept peers, the default one is announced when unset
+	Port int
+	// Event tells the tracker we started, completed or stopped
+	Event int
 }
 
-type PeerFetcher func(name *GetPeersFromUDPParams) error
+type PeerFetcher func(ctx context.Context, name *GetPeersFromUDPParams) error
+
+// PeerFinder finds peers outside the trackers, a session hands its DHT
+type PeerFinder interface {
+	// Announce gives the peers of a torrent and tells the network we
+	// accept connections for it on port
+	Announce(ctx context.Context, infoHash [20]byte, port int) ([]*net.TCPAddr, error)
+}
 
 type PeerManager2 struct {
 	Peers            map[string]*peer.Peer
@@ -46,26 +78,114 @@ type PeerManager2 struct {
 	unconnectedPeers []*peer.Peer
 	Urls             []string
 	Client           *(clientidentifier.ClientIdentifier)
+	Proxy            *proxy.Proxy
+	// GlobalLimits is shared by every torrent, TorrentLimits by the peers
+	// of this torrent
+	GlobalLimits      *ratelimiter.Pair
+	TorrentLimits     *ratelimiter.Pair
+	PeerDownloadLimit int
+	PeerUploadLimit   int
+	trackers          map[string]*resumedata.TrackerState
+	trackersMu        sync.Mutex
+	availability      []int
+	availabilityAt    time.Time
+	availabilityMu    sync.Mutex
+	// pooled holds the ids of the peers in availablePeers or
+	// unconnectedPeers, a peer handed out by GetPeer is in neither until it
+	// comes back through AddPeer
+	pooled map[string]bool
+	// wake is closed and replaced every time a connected peer joins the
+	// pool, GetPeer waits on it
+	wake chan struct{}
+	// CanConnect is asked before dialing a peer, a session uses it to share
+	// one connection limit between its torrents
+	CanConnect func() bool
+	// OnEvent gets the messages of every connection, the torrent serves
+	// uploads from it
+	OnEvent func(e peer.Event)
+	// Interesting tells if a peer has pieces we want, we stay interested
+	// in every peer when unset
+	Interesting func(p *peer.Peer) bool
+	// IdleTimeout closes connections where neither side is interested and
+	// no data moved for that long, DefaultIdleTimeout when 0 and never
+	// when negative
+	IdleTimeout time.Duration
+	// MaxConnections caps the connections of this torrent, on top of the
+	// session wide CanConnect. DefaultMaxConnections when 0, no limit when
+	// negative.
+	MaxConnections int
+	// HalfOpen is a semaphore shared by every torrent bounding the dials in
+	// progress, no limit when nil
+	HalfOpen chan struct{}
+	// ExternalIP and ListenPort are our address as other peers see it,
+	// used for the BEP 40 priority of the candidates
+	ExternalIP net.IP
+	ListenPort int
+	// candidates ranks every known peer, dialing counts the dials of this
+	// torrent in progress
+	candidates        map[string]*candidate
+	candidatesChanged chan struct{}
+	dialing           int
+	// Banned is shared by every torrent of a session, banned peers are not
+	// dialed or accepted
+	Banned *BanList
+	// AllowClient decides by the client software of a peer if we keep its
+	// connection, every client is allowed when unset
+	AllowClient func(p *peer.Peer) bool
+	// Private torrents (BEP 27) only get peers from their own trackers,
+	// DHT is not asked for them and PEX and LSD must stay off once the
+	// client has them
+	Private bool
+	// DHT is asked for peers along with the trackers, nil to only use the
+	// trackers
+	DHT PeerFinder
+	// Filter blocks address ranges, consulted before dialing or accepting
+	// a peer
+	Filter *ipfilter.Filter
+	// ctx lives while the trackers are polled, cancel ends it
+	ctx    context.Context
+	cancel context.CancelFunc
+	// parent and params are the ones of the last PoolTrackers, reused by
+	// Resume
+	parent context.Context
+	params *GetPeersFromUDPParams
+	mu     sync.Mutex
 }
 
-func (m *PeerManager2) getPeersFromUDP(params *GetPeersFromUDPParams) error {
-	fmt.Printf("fetching %s\n", params.Url)
-	url, _ := url.Parse(params.Url)
-	addr, err := net.ResolveUDPAddr("udp", url.Host)
-	if err != nil {
-		return fmt.Errorf("failed to resolve UDP: %w", err)
-	}
+// StoppedAnnounceTimeout bounds the stopped announces, they are sent
+// while shutting down and must not hold it up
+const StoppedAnnounceTimeout = 5 * time.Second
+
+// availabilityTTL bounds how stale the piece availability can get, it is
+// rebuilt from every bitfield so it is not computed on each pick
+const availabilityTTL = time.Second
 
-	conn, err := net.DialUDP("udp", nil, addr)
+// DefaultIdleTimeout frees the slot of a peer nobody wants anything from
+const DefaultIdleTimeout = 5 * time.Minute
+
+// idleCheckInterval is how often interest is updated and idle peers are
+// looked for
+const idleCheckInterval = 30 * time.Second
+
+// MaxResumePeers caps how many peers are remembered for the next run
+const MaxResumePeers = 200
+
+// DHTAnnounceInterval is how often the DHT is asked for peers and told
+// about us
+const DHTAnnounceInterval = 5 * time.Minute
+
+func (m *PeerManager2) getPeersFromUDP(ctx context.Context, params *GetPeersFromUDPParams) error {
+	fmt.Printf("fetching %s\n", RedactURL(params.Url))
+	url, _ := url.Parse(params.Url)
+	conn, err := m.Proxy.DialUDP(ctx, url.Host, time.Second*5)
 	if err != nil {
 		return fmt.Errorf("failed to call UDP: %w", err)
 	}
 	defer conn.Close()
-
-	err = conn.SetReadBuffer(4096)
-	if err != nil {
-		return fmt.Errorf("failed to set buffer for UDP: %w", err)
-	}
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Now())
+	})
+	defer stop()
 
 	connBody := make([]byte, 16)
 	binary.BigEndian.PutUint64(connBody[0:8], uint64(ProtocolID))     // Protocol ID
@@ -80,7 +200,7 @@ func (m *PeerManager2) getPeersFromUDP(params *GetPeersFromUDPParams) error {
 	}
 
 	announceBody := make([]byte, 16)
-	n, _, _, _, err := conn.ReadMsgUDP(announceBody, nil)
+	n, err := conn.Read(announceBody)
 	if err != nil {
 		return fmt.Errorf("failed to read conn response: %w", err)
 	}
@@ -105,15 +225,15 @@ func (m *PeerManager2) getPeersFromUDP(params *GetPeersFromUDPParams) error {
 	binary.BigEndian.PutUint64(announceMsg[64:72], 0) // left, unknown w/ magnet links
 	binary.BigEndian.PutUint64(announceMsg[72:80], 0) // uploaded
 
-	binary.BigEndian.PutUint32(announceMsg[80:84], 0) // event 0:none; 1:completed; 2:started; 3:stopped
-	binary.BigEndian.PutUint32(announceMsg[84:88], 0) // IP address, default: 0
+	binary.BigEndian.PutUint32(announceMsg[80:84], uint32(params.Event)) // event 0:none; 1:completed; 2:started; 3:stopped
+	binary.BigEndian.PutUint32(announceMsg[84:88], 0)                    // IP address, default: 0
 
 	binary.BigEndian.PutUint32(announceMsg[88:92], rand.Uint32()) // key - for tracker's statistics
 
 	// trick go into allowing a negative unsigned int, it underflows
 	neg1 := -1
-	binary.BigEndian.PutUint32(announceMsg[92:96], uint32(neg1)) // num_want -1 default
-	binary.BigEndian.PutUint16(announceMsg[96:98], uint16(Port)) // port
+	binary.BigEndian.PutUint32(announceMsg[92:96], uint32(neg1))                       // num_want -1 default
+	binary.BigEndian.PutUint16(announceMsg[96:98], uint16(announcePort(params, Port))) // port
 
 	conn.SetDeadline(time.Now().Add(time.Second * 5))
 	defer conn.SetDeadline(time.Time{}) // clear deadlines
@@ -130,33 +250,41 @@ func (m *PeerManager2) getPeersFromUDP(params *GetPeersFromUDPParams) error {
 	}
 	resp = resp[:n]
 
+	if len(resp) >= 12 {
+		interval := int(binary.BigEndian.Uint32(resp[8:12]))
+		m.updateTracker(params.Url, func(state *resumedata.TrackerState) {
+			state.Interval = interval
+		})
+	}
+	if params.Event == EventStopped {
+		// we are leaving, the peers it sent back are of no use
+		return nil
+	}
 	//action = binary.BigEndian.Uint32(resp[0:4])
 	//secondTransactionId := binary.BigEndian.Uint32(resp[4:8])
-	//interval := binary.BigEndian.Uint32(resp[8:12])
 	//leachers := binary.BigEndian.Uint32(resp[12:16])
 	//seeders := binary.BigEndian.Uint32(resp[16:20])
 
 	for i := 20; i < len(resp); i += 6 {
-		peer := peer.Peer{IP: net.IP((resp[i : i+4])), Port: binary.BigEndian.Uint16(resp[i+4 : i+6]), Bitfield: &bitfield.Bitfield{}}
+		peer := m.newPeer(net.IP(resp[i:i+4]), binary.BigEndian.Uint16(resp[i+4:i+6]))
 
-		_, ok := m.Peers[peer.GetID()]
-		if ok == false {
-			m.Peers[peer.GetID()] = &peer
-			go m.stablishConnection(&peer)
+		if m.remember(peer, SourceTracker) {
+			m.AddPeer(peer)
 		}
 	}
+	m.signalCandidates()
 
 	return nil
 }
 
-func (m *PeerManager2) getPeersFromHttp(params *GetPeersFromUDPParams) error {
-	fmt.Printf("pooling %s\n", params.Url)
+func (m *PeerManager2) getPeersFromHttp(ctx context.Context, params *GetPeersFromUDPParams) error {
+	fmt.Printf("pooling %s\n", RedactURL(params.Url))
 	base, err := url.Parse(params.Url)
 	if err != nil {
 		return fmt.Errorf("could not parse http Announce: %w", err)
 	}
 
-	Port := 6881
+	Port := announcePort(params, 6881)
 
 	fmt.Println("Default format:\n", params.InfoHash)
 	announceParams := url.Values{
@@ -168,13 +296,30 @@ func (m *PeerManager2) getPeersFromHttp(params *GetPeersFromUDPParams) error {
 		"compact":    []string{"1"},
 		"left":       []string{strconv.Itoa(params.TorrentLen)},
 	}
+	if event, ok := httpEvents[params.Event]; ok {
+		announceParams.Set("event", event)
+	}
+	if params.Event == EventStopped {
+		announceParams.Set("numwant", "0")
+	}
 	base.RawQuery = announceParams.Encode()
 
 	url := base.String()
-	c := &http.Client{Timeout: 15 * time.Second}
-	resp, err := c.Get(url)
+	c := m.Proxy.HTTPClient(15 * time.Second)
+	if m.Private {
+		// a redirect elsewhere would hand the passkey to another host
+		c.CheckRedirect = sameHostRedirect
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 	if err != nil {
-		return fmt.Errorf("http peer request failed: %w", err)
+		return fmt.Errorf("could not build http announce: %w", err)
+	}
+	if m.Client != nil && m.Client.UserAgent != "" {
+		req.Header.Set("User-Agent", m.Client.UserAgent)
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		return fmt.Errorf("http peer request failed: %w", redactError(err))
 	}
 	defer resp.Body.Close()
 
@@ -183,6 +328,12 @@ func (m *PeerManager2) getPeersFromHttp(params *GetPeersFromUDPParams) error {
 	if err != nil {
 		return fmt.Errorf("could not parse http response: %w", err)
 	}
+	m.updateTracker(params.Url, func(state *resumedata.TrackerState) {
+		state.Interval = trackerResp.Interval
+	})
+	if params.Event == EventStopped {
+		return nil
+	}
 	peersBin := []byte(trackerResp.Peers)
 	const peerSize = 6 // 4 for IP, 2 for port
 	totalOfPeers := len(peersBin) / peerSize
@@ -191,41 +342,128 @@ func (m *PeerManager2) getPeersFromHttp(params *GetPeersFromUDPParams) error {
 	}
 	for i := range totalOfPeers {
 		offset := i * peerSize
-		peer := peer.Peer{IP: net.IP(peersBin[offset : offset+4]), Port: binary.BigEndian.Uint16(peersBin[offset+4 : offset+6]), Bitfield: &bitfield.Bitfield{}}
-		_, ok := m.Peers[peer.GetID()]
-		if ok == false {
-			m.Peers[peer.GetID()] = &peer
-			go m.stablishConnection(&peer)
+		peer := m.newPeer(net.IP(peersBin[offset:offset+4]), binary.BigEndian.Uint16(peersBin[offset+4:offset+6]))
+		if m.remember(peer, SourceTracker) {
+			m.AddPeer(peer)
 		}
 	}
+	m.signalCandidates()
 	return nil
 }
 
-func (m *PeerManager2) stablishConnection(peer *peer.Peer) {
-	err := peer.Connect(m.Client)
+// remember adds a peer we learned about, false if it was already known
+func (m *PeerManager2) remember(p *peer.Peer, source PeerSource) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.Peers[p.GetID()]; ok {
+		return false
+	}
+	m.Peers[p.GetID()] = p
+	m.candidate(p).source = source
+	return true
+}
+
+func (m *PeerManager2) newPeer(ip net.IP, port uint16) *peer.Peer {
+	p := &peer.Peer{
+		IP:         ip,
+		Port:       port,
+		Bitfield:   &bitfield.Bitfield{},
+		Proxy:      m.Proxy,
+		RateLimits: []*ratelimiter.Pair{m.GlobalLimits, m.TorrentLimits},
+		OnEvent:    m.handleEvent,
+	}
+	m.mu.Lock()
+	// every peer gets its own pair, even unlimited, so the wrapped
+	// connection keeps following SetPeerRateLimits
+	p.OwnLimits = ratelimiter.NewPair(m.PeerDownloadLimit, m.PeerUploadLimit)
+	m.mu.Unlock()
+	return p
+}
+
+// SetPeerRateLimits changes the per peer limits of current and future
+// connections, in bytes per second
+func (m *PeerManager2) SetPeerRateLimits(download, upload int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.PeerDownloadLimit = download
+	m.PeerUploadLimit = upload
+	for _, p := range m.Peers {
+		p.OwnLimits.SetLimits(download, upload)
+	}
+}
+
+func announcePort(params *GetPeersFromUDPParams, fallback int) int {
+	if params.Port != 0 {
+		return params.Port
+	}
+	return fallback
+}
+
+// stablishConnection dials a candidate taken by the connect loop
+func (m *PeerManager2) stablishConnection(ctx context.Context, peer *peer.Peer) {
+	err := peer.Connect(ctx, m.Client)
+	m.finishDial(peer)
 	if err == nil {
-		m.availablePeers = append(m.availablePeers, peer)
-	} else {
-		m.unconnectedPeers = append(m.unconnectedPeers, peer)
+		fmt.Println("connected to", peer.GetID(), peer.Client())
+		m.allowClient(peer)
 	}
+	if ctx.Err() == nil {
+		// a dial cut short by Stop says nothing about the peer
+		m.recordConnect(peer, err)
+	}
+	// connected or not, AddPeer puts it in the right list
+	m.AddPeer(peer)
 }
 
-func (m *PeerManager2) watchUnconnectedPeers() {
+// allowClient closes the connection of a peer AllowClient refuses, it is
+// not dialed again
+func (m *PeerManager2) allowClient(p *peer.Peer) bool {
+	if m.AllowClient == nil || m.AllowClient(p) {
+		return true
+	}
+	fmt.Println("refusing client", p.Client(), "of", p.GetID())
+	p.CloseConnection()
+	m.backOff(p, maxConnectBackoff)
+	return false
+}
+
+// watchIdlePeers keeps our interest in every peer up to date and closes
+// the connections that stayed idle past IdleTimeout
+func (m *PeerManager2) watchIdlePeers(ctx context.Context) {
+	timeout := m.IdleTimeout
+	if timeout == 0 {
+		timeout = DefaultIdleTimeout
+	}
 	go func() {
+		ticker := time.NewTicker(idleCheckInterval)
+		defer ticker.Stop()
 		for {
-			unconnectedCount := len(m.unconnectedPeers)
-			for _ = range unconnectedCount {
-				peer := m.unconnectedPeers[0]
-				m.unconnectedPeers = m.unconnectedPeers[1:]
-				m.stablishConnection(peer)
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				for _, p := range m.ConnectedPeers() {
+					// the filter may have been reloaded with new ranges
+					if m.Banned.Banned(p.IP) || m.Filter.Blocked(p.IP) {
+						p.CloseConnection()
+						continue
+					}
+					if m.Interesting != nil {
+						p.SetInterested(m.Interesting(p))
+					}
+					if timeout > 0 && p.Idle(now) >= timeout {
+						fmt.Println("closing idle connection to", p.GetID())
+						p.CloseConnection()
+						// not dialed again until it could be useful
+						m.backOff(p, timeout)
+					}
+				}
 			}
-			time.Sleep(time.Second * 30)
 		}
 	}()
 }
 
 func (m *PeerManager2) ResolvePeerFetching(url string) (PeerFetcher, error) {
-	m.watchUnconnectedPeers()
 	if strings.Contains(url, "udp") {
 		return m.getPeersFromUDP, nil
 	} else if strings.Contains(url, "http") {
@@ -234,41 +472,457 @@ func (m *PeerManager2) ResolvePeerFetching(url string) (PeerFetcher, error) {
 	return nil, errors.New("tracker protocol not support")
 }
 
-func (m *PeerManager2) GetPeer() *peer.Peer {
-	if len(m.availablePeers) == 0 {
-		return nil
+// GetPeer hands out the unchoked peer that gave us the most pieces,
+// waiting for one until ctx is done. The peer is out of the pool until it
+// is given back with AddPeer.
+func (m *PeerManager2) GetPeer(ctx context.Context) (*peer.Peer, error) {
+	for {
+		m.mu.Lock()
+		if p := m.takeUnchoked(); p != nil {
+			m.mu.Unlock()
+			return p, nil
+		}
+		wake := m.wakeChan()
+		m.mu.Unlock()
+
+		select {
+		case <-wake:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
 	}
+}
+
+// takeUnchoked must be called with mu held, connections that closed while
+// pooled go back to the unconnected peers
+func (m *PeerManager2) takeUnchoked() *peer.Peer {
 	sort.Slice(m.availablePeers, func(i, j int) bool {
-		return m.availablePeers[i].PiecesDownloaded > m.availablePeers[j].PiecesDownloaded
+		return m.availablePeers[i].PiecesCompleted() > m.availablePeers[j].PiecesCompleted()
 	})
-	peer := m.availablePeers[0]
-	m.availablePeers = m.availablePeers[1:]
-	return peer
+	for i, p := range m.availablePeers {
+		if !p.HasConnection() {
+			m.availablePeers = append(m.availablePeers[:i], m.availablePeers[i+1:]...)
+			m.unconnectedPeers = append(m.unconnectedPeers, p)
+			return m.takeUnchoked()
+		}
+		if m.Banned.Banned(p.IP) {
+			p.CloseConnection()
+			m.availablePeers = append(m.availablePeers[:i], m.availablePeers[i+1:]...)
+			delete(m.pooled, p.GetID())
+			return m.takeUnchoked()
+		}
+		if p.IsConnected() {
+			m.availablePeers = append(m.availablePeers[:i], m.availablePeers[i+1:]...)
+			delete(m.pooled, p.GetID())
+			return p
+		}
+	}
+	return nil
+}
+
+// wakeChan must be called with mu held
+func (m *PeerManager2) wakeChan() chan struct{} {
+	if m.wake == nil {
+		m.wake = make(chan struct{})
+	}
+	return m.wake
 }
 
+// AddPeer puts a peer back in the pool, connected ones are handed out by
+// GetPeer once they unchoke us and the rest wait for the next connection
+// attempt. A peer already in the pool is not added twice.
 func (m *PeerManager2) AddPeer(p *peer.Peer) {
-	if p.IsConnected() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.pooled == nil {
+		m.pooled = make(map[string]bool)
+	}
+	if m.pooled[p.GetID()] {
+		return
+	}
+	m.pooled[p.GetID()] = true
+	if p.HasConnection() {
 		m.availablePeers = append(m.availablePeers, p)
+		m.broadcast()
 	} else {
 		m.unconnectedPeers = append(m.unconnectedPeers, p)
 	}
 }
 
+// broadcast wakes every GetPeer waiting, must be called with mu held
+func (m *PeerManager2) broadcast() {
+	close(m.wakeChan())
+	m.wake = nil
+}
+
+// handleEvent runs on the reader goroutine of every connection
+func (m *PeerManager2) handleEvent(e peer.Event) {
+	switch e.Kind {
+	case peer.EventUnchoke:
+		// the peer may be waiting in the pool for it
+		m.mu.Lock()
+		m.broadcast()
+		m.mu.Unlock()
+	case peer.EventExtension:
+		// the BEP 10 handshake may name the client better than its id
+		m.allowClient(e.Peer)
+	case peer.EventClosed:
+		if time.Since(e.Peer.Stats().ConnectedAt) < evictGrace {
+			// it keeps hanging up on us, no point in dialing right back
+			m.backOff(e.Peer, connectBackoff)
+		}
+		// a pooled peer becomes a candidate again, the slot is free
+		m.mu.Lock()
+		idx := slices.Index(m.availablePeers, e.Peer)
+		if idx != -1 {
+			m.availablePeers = slices.Delete(m.availablePeers, idx, idx+1)
+			m.unconnectedPeers = append(m.unconnectedPeers, e.Peer)
+		}
+		m.mu.Unlock()
+		m.signalCandidates()
+	}
+	if m.OnEvent != nil {
+		m.OnEvent(e)
+	}
+}
+
+// ConnectedPeers lists every peer with an open connection, including the
+// ones currently downloading a piece
+func (m *PeerManager2) ConnectedPeers() []*peer.Peer {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	peers := make([]*peer.Peer, 0)
+	for _, p := range m.Peers {
+		if p.HasConnection() {
+			peers = append(peers, p)
+		}
+	}
+	return peers
+}
+
+// Availability counts for every piece how many connected peers have it
+func (m *PeerManager2) Availability(pieceCount int) []int {
+	m.availabilityMu.Lock()
+	defer m.availabilityMu.Unlock()
+	if len(m.availability) == pieceCount && time.Since(m.availabilityAt) < availabilityTTL {
+		return m.availability
+	}
+	availability := make([]int, pieceCount)
+	for _, p := range m.ConnectedPeers() {
+		pieces := p.Pieces()
+		for i := range pieceCount {
+			if pieces.HasPiece(i) {
+				availability[i]++
+			}
+		}
+	}
+	m.availability = availability
+	m.availabilityAt = time.Now()
+	return availability
+}
+
+// Transferred sums what every peer of this torrent sent and received,
+// disconnected ones included
+func (m *PeerManager2) Transferred() (downloaded int64, uploaded int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, p := range m.Peers {
+		stats := p.Stats()
+		downloaded += stats.Downloaded
+		uploaded += stats.Uploaded
+	}
+	return downloaded, uploaded
+}
+
 func (m *PeerManager2) AvailablePeers() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	return len(m.Peers)
 }
-func (m *PeerManager2) PoolTrackers(params *GetPeersFromUDPParams) {
+
+// PoolTrackers announces to every tracker until ctx is done or Stop is
+// called, new peers are connected as they come
+func (m *PeerManager2) PoolTrackers(ctx context.Context, params *GetPeersFromUDPParams) {
+	m.mu.Lock()
+	if m.cancel != nil {
+		// already polling
+		m.mu.Unlock()
+		return
+	}
+	m.parent = ctx
+	m.params = params
+	if m.candidatesChanged == nil {
+		m.candidatesChanged = make(chan struct{}, 1)
+	}
+	m.ctx, m.cancel = context.WithCancel(ctx)
+	ctx = m.ctx
+	m.mu.Unlock()
+	m.connectPeers(ctx)
+	m.watchIdlePeers(ctx)
+	if m.DHT != nil && !m.Private {
+		go m.pollDHT(ctx, params)
+	}
 	go func() {
+		announce := *params
+		announce.Event = EventStarted
 		for {
 			for i := range len(m.Urls) {
 				url := m.Urls[i]
 				fn, err := m.ResolvePeerFetching(url)
 				if err == nil {
-					params.Url = url
-					fn(params)
+					announce.Url = url
+					err = fn(ctx, &announce)
+					if ctx.Err() != nil {
+						return
+					}
+					m.recordAnnounce(url, err)
 				}
 			}
-			time.Sleep(time.Second * 20)
+			announce.Event = EventNone
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(time.Second * 20):
+			}
 		}
 	}()
 }
+
+// pollDHT announces to the DHT until ctx is done, the peers it finds are
+// dialed like the ones of the trackers
+func (m *PeerManager2) pollDHT(ctx context.Context, params *GetPeersFromUDPParams) {
+	port := announcePort(params, Port)
+	for {
+		addrs, err := m.DHT.Announce(ctx, params.InfoHash, port)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			fmt.Println("dht announce failed:", err)
+		}
+		for _, addr := range addrs {
+			peer := m.newPeer(addr.IP, uint16(addr.Port))
+			if m.remember(peer, SourceDHT) {
+				m.AddPeer(peer)
+			}
+		}
+		m.signalCandidates()
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(DHTAnnounceInterval):
+		}
+	}
+}
+
+// announceStopped tells every tracker we are leaving the swarm, all at
+// once so a slow tracker does not hold the others back
+func (m *PeerManager2) announceStopped() {
+	m.mu.Lock()
+	params := m.params
+	m.mu.Unlock()
+	if params == nil {
+		return
+	}
+	// the polling context is gone by now
+	ctx, cancel := context.WithTimeout(context.Background(), StoppedAnnounceTimeout)
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, url := range m.Urls {
+		fn, err := m.ResolvePeerFetching(url)
+		if err != nil {
+			continue
+		}
+		announce := *params
+		announce.Url = url
+		announce.Event = EventStopped
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := fn(ctx, &announce)
+			if err != nil {
+				fmt.Println("could not announce stop to", RedactURL(url), err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// Pause leaves the swarm: trackers get a stopped announce and every
+// connection is closed
+func (m *PeerManager2) Pause() {
+	m.Stop()
+	m.announceStopped()
+}
+
+// Resume polls the trackers again with the parameters of the last
+// PoolTrackers, peers reconnect as they are found
+func (m *PeerManager2) Resume() {
+	m.mu.Lock()
+	parent, params := m.parent, m.params
+	m.mu.Unlock()
+	if params != nil && parent.Err() == nil {
+		m.PoolTrackers(parent, params)
+	}
+}
+
+// Stop ends tracker polling and closes every peer connection, PoolTrackers
+// starts over afterwards
+func (m *PeerManager2) Stop() {
+	m.mu.Lock()
+	if m.cancel != nil {
+		m.cancel()
+		m.cancel = nil
+	}
+	peers := make([]*peer.Peer, 0, len(m.Peers))
+	for _, p := range m.Peers {
+		peers = append(peers, p)
+	}
+	m.availablePeers = nil
+	m.unconnectedPeers = nil
+	m.pooled = nil
+	m.mu.Unlock()
+	for _, p := range peers {
+		if p.HasConnection() {
+			p.CloseConnection()
+		}
+		m.AddPeer(p)
+	}
+}
+
+// AcceptPeer takes over a connection a remote peer opened for this torrent
+// once its handshake was read
+func (m *PeerManager2) AcceptPeer(ctx context.Context, conn net.Conn, handshake peer.Handshake, ourBitfield bitfield.Bitfield) error {
+	addr, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		conn.Close()
+		return errors.New("peer is not on tcp")
+	}
+	if m.Banned.Banned(addr.IP) {
+		conn.Close()
+		return errors.New("peer is banned")
+	}
+	if m.Filter.Blocked(addr.IP) {
+		conn.Close()
+		return errors.New("peer is blocked by the ip filter")
+	}
+	if !m.hasRoom() {
+		conn.Close()
+		return errors.New("connection limit reached")
+	}
+	p := m.newPeer(addr.IP, uint16(addr.Port))
+	m.mu.Lock()
+	known, ok := m.Peers[p.GetID()]
+	if ok && (known.HasConnection() || m.candidate(known).dialing) {
+		m.mu.Unlock()
+		conn.Close()
+		return errors.New("peer already connected")
+	}
+	if ok {
+		// the new connection replaces the peer waiting to be dialed
+		m.unconnectedPeers = slices.DeleteFunc(m.unconnectedPeers, func(pooled *peer.Peer) bool {
+			return pooled == known
+		})
+		delete(m.pooled, known.GetID())
+	} else {
+		m.candidate(p).source = SourceIncoming
+	}
+	m.Peers[p.GetID()] = p
+	m.mu.Unlock()
+
+	err := p.Accept(ctx, conn, m.Client, handshake, ourBitfield)
+	if err != nil {
+		return err
+	}
+	fmt.Println("accepted", p.GetID(), p.Client())
+	if !m.allowClient(p) {
+		return errors.New("client not allowed")
+	}
+	m.recordConnect(p, nil)
+	m.AddPeer(p)
+	return nil
+}
+
+// trackerState must be called with trackersMu held
+func (m *PeerManager2) trackerState(url string) *resumedata.TrackerState {
+	if m.trackers == nil {
+		m.trackers = make(map[string]*resumedata.TrackerState)
+	}
+	state, ok := m.trackers[url]
+	if !ok {
+		state = &resumedata.TrackerState{Url: url}
+		m.trackers[url] = state
+	}
+	return state
+}
+
+func (m *PeerManager2) updateTracker(url string, update func(state *resumedata.TrackerState)) {
+	m.trackersMu.Lock()
+	defer m.trackersMu.Unlock()
+	update(m.trackerState(url))
+}
+
+func (m *PeerManager2) recordAnnounce(url string, err error) {
+	m.updateTracker(url, func(state *resumedata.TrackerState) {
+		if err != nil {
+			state.Failures++
+			state.LastError = err.Error()
+			return
+		}
+		state.Failures = 0
+		state.LastError = ""
+		state.LastAnnounce = time.Now().Unix()
+	})
+}
+
+// RestoreResume reconnects to the peers of the previous run and picks up
+// the tracker state where it was left
+func (m *PeerManager2) RestoreResume(r *resumedata.ResumeData) {
+	for i := range r.Trackers {
+		restored := r.Trackers[i]
+		m.updateTracker(restored.Url, func(state *resumedata.TrackerState) {
+			*state = restored
+		})
+	}
+	peers := r.Peers
+	if m.Private {
+		// only the trackers hand out peers of a private torrent
+		peers = nil
+	}
+	for _, addr := range peers {
+		host, portStr, err := net.SplitHostPort(addr)
+		if err != nil {
+			continue
+		}
+		ip := net.ParseIP(host)
+		port, err := strconv.Atoi(portStr)
+		if ip == nil || err != nil || port <= 0 || port > 0xffff {
+			continue
+		}
+		peer := m.newPeer(ip, uint16(port))
+		if m.remember(peer, SourceResume) {
+			// dialed by the connect loop while the trackers are polled
+			m.AddPeer(peer)
+		}
+	}
+	m.signalCandidates()
+}
+
+// FillResume stores the peers worth reconnecting to and the tracker state
+func (m *PeerManager2) FillResume(r *resumedata.ResumeData) {
+	r.Peers = r.Peers[:0]
+	for _, p := range m.ConnectedPeers() {
+		if len(r.Peers) >= MaxResumePeers {
+			break
+		}
+		r.Peers = append(r.Peers, p.GetID())
+	}
+	r.Trackers = r.Trackers[:0]
+	m.trackersMu.Lock()
+	defer m.trackersMu.Unlock()
+	for _, url := range m.Urls {
+		if state, ok := m.trackers[url]; ok {
+			r.Trackers = append(r.Trackers, *state)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package peermanager2
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	clientidentifier "github.com/TheLox95/go-torrent-client/pkg/clientIdentifier"
+	"github.com/TheLox95/go-torrent-client/pkg/peer"
+	"github.com/TheLox95/go-torrent-client/pkg/peerMessage"
+)
+
+var testInfoHash = [20]byte{1, 2, 3}
+
+func newTestManager() *PeerManager2 {
+	return &PeerManager2{
+		Peers:  make(map[string]*peer.Peer),
+		Client: &clientidentifier.ClientIdentifier{InfoHash: testInfoHash, PeerID: [20]byte{9}},
+	}
+}
+
+// acceptTestPeer connects a remote peer that unchokes us right away and
+// ignores everything we send, it ends when the connection is closed
+func acceptTestPeer(t *testing.T, m *PeerManager2, ln net.Listener) {
+	t.Helper()
+	remote, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { remote.Close() })
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go io.Copy(io.Discard, remote)
+	go remote.Write(peerMessage.Encode(peerMessage.MsgUnchoke, nil))
+
+	handshake := peer.Handshake{Protocol: "BitTorrent protocol", InfoHash: testInfoHash}
+	err = m.AcceptPeer(context.Background(), conn, handshake, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func listen(t *testing.T) net.Listener {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	return ln
+}
+
+func TestGetPeerUnblocksWhenCancelled(t *testing.T) {
+	m := newTestManager()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		_, err := m.GetPeer(ctx)
+		done <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("GetPeer returned %v, want context.Canceled", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("GetPeer did not return after cancel")
+	}
+}
+
+func TestGetPeerWaitsForAddPeer(t *testing.T) {
+	m := newTestManager()
+	acceptTestPeer(t, m, listen(t))
+	defer m.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	p, err := m.GetPeer(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(chan *peer.Peer)
+	go func() {
+		again, err := m.GetPeer(ctx)
+		if err != nil {
+			t.Error(err)
+		}
+		got <- again
+	}()
+	select {
+	case <-got:
+		t.Fatal("GetPeer handed out a peer that was not given back")
+	case <-time.After(50 * time.Millisecond):
+	}
+	m.AddPeer(p)
+	if again := <-got; again != p {
+		t.Fatalf("GetPeer returned %v, want %v", again, p)
+	}
+}
+
+func TestConcurrentGetAddStop(t *testing.T) {
+	m := newTestManager()
+	ln := listen(t)
+	for range 4 {
+		acceptTestPeer(t, m, ln)
+	}
+
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 50 {
+				ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+				p, err := m.GetPeer(ctx)
+				cancel()
+				if err != nil {
+					continue
+				}
+				// askPiece gives the peer back before it is done with it
+				m.AddPeer(p)
+				p.FinishPiece(true)
+			}
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for range 3 {
+			time.Sleep(10 * time.Millisecond)
+			m.Stop()
+		}
+	}()
+	wg.Wait()
+
+	for _, p := range m.ConnectedPeers() {
+		t.Errorf("peer %s still connected after Stop", p.GetID())
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.pooled) != len(m.Peers) {
+		t.Errorf("%d peers pooled, want all %d back", len(m.pooled), len(m.Peers))
+	}
+}
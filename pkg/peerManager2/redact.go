@@ -0,0 +1,80 @@
+package peermanager2
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// secretParams are the query parameters private trackers put passkeys in
+var secretParams = []string{"passkey", "authkey", "pk", "key", "token", "secret", "auth"}
+
+// minSecretSegment is the shortest path segment taken for a passkey, as
+// in http://tracker/0123456789abcdef0123456789abcdef/announce
+const minSecretSegment = 16
+
+const redacted = "REDACTED"
+
+// RedactURL hides the passkeys and credentials of a tracker url so it can
+// be logged
+func RedactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return redacted
+	}
+	if u.User != nil {
+		u.User = url.User(redacted)
+	}
+	segments := strings.Split(u.Path, "/")
+	for i, segment := range segments {
+		if isSecretSegment(segment) {
+			segments[i] = redacted
+		}
+	}
+	u.Path = strings.Join(segments, "/")
+	u.RawPath = ""
+	query := u.Query()
+	for key := range query {
+		for _, secret := range secretParams {
+			if strings.EqualFold(key, secret) {
+				query.Set(key, redacted)
+			}
+		}
+	}
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+func isSecretSegment(segment string) bool {
+	if len(segment) < minSecretSegment {
+		return false
+	}
+	for _, c := range segment {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z') {
+			return false
+		}
+	}
+	return true
+}
+
+// redactError hides the tracker url the http client puts in its errors
+func redactError(err error) error {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		urlErr.URL = RedactURL(urlErr.URL)
+	}
+	return err
+}
+
+// sameHostRedirect keeps the announces of private torrents on the host of
+// their tracker
+func sameHostRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= 10 {
+		return errors.New("stopped after 10 redirects")
+	}
+	if req.URL.Host != via[0].URL.Host {
+		return errors.New("tracker redirected to another host")
+	}
+	return nil
+}
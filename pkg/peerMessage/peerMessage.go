@@ -2,7 +2,6 @@ package peerMessage
 
 import (
 	"encoding/binary"
-	"errors"
 	"io"
 	"net"
 )
@@ -28,10 +27,13 @@ const (
 	MsgPiece MessageID = 7
 	// MsgCancel cancels a request
 	MsgCancel MessageID = 8
+	// MsgExtended carries the extension protocol messages of BEP 10
+	MsgExtended MessageID = 20
+	// MsgKeepAlive is the zero length message, it has no ID on the wire
+	MsgKeepAlive MessageID = -1
 )
 
 const NON_EXPECTED_MSG_ID = "received unexpected message ID"
-const KEEP_ALIVE_MESSAGE = "received keep alive message"
 
 // PeerMessage stores ID and payload of a message
 type PeerMessage struct {
@@ -54,7 +56,7 @@ func (r *PeerMessageResponse) Read() (*PeerMessage, error) {
 
 	// keep-alive message
 	if length == 0 {
-		return nil, errors.New(KEEP_ALIVE_MESSAGE)
+		return &PeerMessage{ID: MsgKeepAlive}, nil
 	}
 
 	messageBuf := make([]byte, length)
@@ -80,7 +82,7 @@ func Read(c *net.Conn) (*PeerMessage, error) {
 
 	// keep-alive message
 	if length == 0 {
-		return nil, errors.New(KEEP_ALIVE_MESSAGE)
+		return &PeerMessage{ID: MsgKeepAlive}, nil
 	}
 
 	messageBuf := make([]byte, length)
@@ -97,14 +99,21 @@ func Read(c *net.Conn) (*PeerMessage, error) {
 	return msg, nil
 }
 
-func SendMessage(c *net.Conn, id MessageID, payload []byte) (*PeerMessageResponse, error) {
+// Encode frames a message the way it goes on the wire
+func Encode(id MessageID, payload []byte) []byte {
+	if id == MsgKeepAlive {
+		return make([]byte, 4)
+	}
 	length := uint32(len(payload) + 1) // +1 for id
 	buf := make([]byte, 4+length)
 	binary.BigEndian.PutUint32(buf[0:4], length)
 	buf[4] = byte(id)
 	copy(buf[5:], payload)
+	return buf
+}
 
-	_, err := (*c).Write(buf)
+func SendMessage(c *net.Conn, id MessageID, payload []byte) (*PeerMessageResponse, error) {
+	_, err := (*c).Write(Encode(id, payload))
 	if err != nil {
 		return nil, err
 	}
@@ -7,17 +7,113 @@ import (
 	"errors"
 	"fmt"
 
+	"github.com/TheLox95/go-torrent-client/pkg/bitfield"
 	"github.com/TheLox95/go-torrent-client/pkg/peerMessage"
 )
 
 // MaxBlockSize is the largest number of bytes a request can ask for
 const MaxBlockSize = 16384
 
+// Priority orders pieces for download, PrioritySkip ones are never asked
+type Priority int
+
+const (
+	PrioritySkip   Priority = 0
+	PriorityLow    Priority = 1
+	PriorityNormal Priority = 2
+	PriorityHigh   Priority = 3
+)
+
+func ParsePriority(s string) (Priority, error) {
+	switch s {
+	case "skip", "0":
+		return PrioritySkip, nil
+	case "low", "1":
+		return PriorityLow, nil
+	case "normal", "2":
+		return PriorityNormal, nil
+	case "high", "3":
+		return PriorityHigh, nil
+	}
+	return PriorityNormal, fmt.Errorf("unknown priority %q", s)
+}
+
+func (p Priority) String() string {
+	switch p {
+	case PrioritySkip:
+		return "skip"
+	case PriorityLow:
+		return "low"
+	case PriorityHigh:
+		return "high"
+	}
+	return "normal"
+}
+
 type Piece struct {
 	Idx    int
 	Hash   [20]byte
 	Buf    []byte
 	Length int
+	// Blocks marks which MaxBlockSize blocks of Buf hold received data
+	Blocks bitfield.Bitfield
+	// OnBlock is called after a new block was copied into Buf
+	OnBlock func(p *Piece, begin int, data []byte)
+	// BlockSources has the id of the peer that sent each block, empty for
+	// blocks restored from a previous run
+	BlockSources []string
+}
+
+func (p *Piece) BlockCount() int {
+	return (p.Length + MaxBlockSize - 1) / MaxBlockSize
+}
+
+// Prepare allocates the buffer, keeping blocks restored from a previous run
+func (p *Piece) Prepare() {
+	if len(p.Buf) != p.Length || len(p.Blocks) != (p.BlockCount()+7)/8 {
+		p.Reset()
+	}
+	if len(p.BlockSources) != p.BlockCount() {
+		p.BlockSources = make([]string, p.BlockCount())
+	}
+}
+
+// Reset drops every received block, used when the piece failed its hash
+func (p *Piece) Reset() {
+	p.Buf = make([]byte, p.Length)
+	p.Blocks = make(bitfield.Bitfield, (p.BlockCount()+7)/8)
+	p.BlockSources = make([]string, p.BlockCount())
+}
+
+// SetBlockSource records which peer sent the block at begin
+func (p *Piece) SetBlockSource(begin int, peerID string) {
+	idx := begin / MaxBlockSize
+	if idx < len(p.BlockSources) {
+		p.BlockSources[idx] = peerID
+	}
+}
+
+func (p *Piece) HasBlock(begin int) bool {
+	idx := begin / MaxBlockSize
+	if idx >= p.BlockCount() || len(p.Blocks) == 0 {
+		return false
+	}
+	return p.Blocks.HasPiece(idx)
+}
+
+func (p *Piece) MarkBlock(begin int) {
+	p.Blocks.SetPiece(begin / MaxBlockSize)
+}
+
+// ReceivedBytes counts the bytes of Buf already filled by received blocks
+func (p *Piece) ReceivedBytes() int {
+	total := 0
+	for begin := 0; begin < p.Length; begin += MaxBlockSize {
+		if p.HasBlock(begin) {
+			total += p.CalculateBlockSize(begin)
+		}
+	}
+	return total
 }
 
 func (p *Piece) CalculateBounds(torrentLength, basePieceLen int) (begin int, end int) {
@@ -71,6 +167,17 @@ func (r *Piece) ParsePiece(msg *peerMessage.PeerMessage) (int, error) {
 	if begin+len(data) > len(r.Buf) {
 		return 0, fmt.Errorf("Data too long [%d] for offset %d with length %d", len(data), begin, len(r.Buf))
 	}
+	if begin%MaxBlockSize != 0 || len(data) != r.CalculateBlockSize(begin) {
+		return 0, fmt.Errorf("Block at offset %d with length %d is not aligned", begin, len(data))
+	}
+	if r.HasBlock(begin) {
+		// duplicate, the data is already accounted for
+		return 0, nil
+	}
 	copy(r.Buf[begin:], data)
+	r.MarkBlock(begin)
+	if r.OnBlock != nil {
+		r.OnBlock(r, begin, data)
+	}
 	return len(data), nil
 }
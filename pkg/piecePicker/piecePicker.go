@@ -0,0 +1,236 @@
+package piecepicker
+
+import (
+	"sync"
+	"time"
+
+	"github.com/TheLox95/go-torrent-client/pkg/piece"
+)
+
+// SlowPeerGrace is how close a deadline has to be before a slow peer is
+// trusted with the piece, until then it is kept for the fast ones
+const SlowPeerGrace = 2 * time.Second
+
+// PiecePicker decides which piece a peer is asked for next. Pieces stay
+// registered until they are verified, skipped ones are simply never
+// handed out so raising their priority later brings them back.
+//
+// Pieces with a deadline come first, earliest deadline first. The rest go
+// by priority and then rarest first, or by index in sequential mode.
+type PiecePicker struct {
+	mu       sync.Mutex
+	pending  map[int]*piece.Piece
+	inFlight map[int]*piece.Piece
+	priority []piece.Priority
+	deadline map[int]time.Time
+	done     int
+	wanted   int
+	// Sequential downloads in index order instead of rarest first
+	Sequential bool
+	// Availability reports how many peers have each piece
+	Availability func() []int
+}
+
+func New(pieceCount int) *PiecePicker {
+	priority := make([]piece.Priority, pieceCount)
+	for i := range priority {
+		priority[i] = piece.PriorityNormal
+	}
+	return &PiecePicker{
+		pending:  make(map[int]*piece.Piece),
+		inFlight: make(map[int]*piece.Piece),
+		priority: priority,
+		deadline: make(map[int]time.Time),
+	}
+}
+
+func (pp *PiecePicker) Add(p *piece.Piece) {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	pp.pending[p.Idx] = p
+	if pp.priority[p.Idx] != piece.PrioritySkip {
+		pp.wanted++
+	}
+}
+
+func (pp *PiecePicker) isOpen(idx int) bool {
+	_, pending := pp.pending[idx]
+	_, inFlight := pp.inFlight[idx]
+	return pending || inFlight
+}
+
+func (pp *PiecePicker) SetPriority(idx int, priority piece.Priority) {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	if idx < 0 || idx >= len(pp.priority) {
+		return
+	}
+	old := pp.priority[idx]
+	pp.priority[idx] = priority
+	if pp.isOpen(idx) {
+		if old == piece.PrioritySkip && priority != piece.PrioritySkip {
+			pp.wanted++
+		} else if old != piece.PrioritySkip && priority == piece.PrioritySkip {
+			pp.wanted--
+		}
+	}
+}
+
+func (pp *PiecePicker) Priority(idx int) piece.Priority {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	return pp.priority[idx]
+}
+
+// SetDeadline asks for a piece to be verified by the given time, it is
+// picked before anything without a deadline even if its file is skipped
+func (pp *PiecePicker) SetDeadline(idx int, deadline time.Time) {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	if idx < 0 || idx >= len(pp.priority) || !pp.isOpen(idx) {
+		return
+	}
+	pp.deadline[idx] = deadline
+}
+
+func (pp *PiecePicker) ClearDeadline(idx int) {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	delete(pp.deadline, idx)
+}
+
+// SetSequential switches between index order and rarest first while
+// pieces are being picked
+func (pp *PiecePicker) SetSequential(sequential bool) {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	pp.Sequential = sequential
+}
+
+func (pp *PiecePicker) ClearDeadlines() {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	pp.deadline = make(map[int]time.Time)
+}
+
+func (pp *PiecePicker) HasDeadlines() bool {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	return len(pp.deadline) > 0
+}
+
+// better tells if piece a should be downloaded before piece b
+func (pp *PiecePicker) better(a, b int, availability []int) bool {
+	if pp.priority[a] != pp.priority[b] {
+		return pp.priority[a] > pp.priority[b]
+	}
+	if !pp.Sequential && availability != nil && a < len(availability) && b < len(availability) {
+		if availability[a] != availability[b] {
+			return availability[a] < availability[b]
+		}
+	}
+	return a < b
+}
+
+// Pick hands out the most important pending piece the peer has. A slow
+// peer only gets a deadline piece once the deadline is close, so urgent
+// data comes from the fastest peers.
+func (pp *PiecePicker) Pick(has func(idx int) bool, fast bool) *piece.Piece {
+	pp.mu.Lock()
+	sequential := pp.Sequential
+	pp.mu.Unlock()
+	// Availability takes the peer manager locks, never call it holding mu
+	var availability []int
+	if pp.Availability != nil && !sequential {
+		availability = pp.Availability()
+	}
+
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	now := time.Now()
+
+	var urgent *piece.Piece
+	for idx, deadline := range pp.deadline {
+		p, ok := pp.pending[idx]
+		if !ok || !has(idx) {
+			continue
+		}
+		if !fast && deadline.Sub(now) > SlowPeerGrace {
+			continue
+		}
+		if urgent == nil || deadline.Before(pp.deadline[urgent.Idx]) || (deadline.Equal(pp.deadline[urgent.Idx]) && idx < urgent.Idx) {
+			urgent = p
+		}
+	}
+	if urgent != nil {
+		delete(pp.pending, urgent.Idx)
+		pp.inFlight[urgent.Idx] = urgent
+		return urgent
+	}
+
+	var best *piece.Piece
+	for idx, p := range pp.pending {
+		if pp.priority[idx] == piece.PrioritySkip || !has(idx) {
+			continue
+		}
+		if _, ok := pp.deadline[idx]; ok {
+			// reserved for a fast peer
+			continue
+		}
+		if best == nil || pp.better(idx, best.Idx, availability) {
+			best = p
+		}
+	}
+	if best != nil {
+		delete(pp.pending, best.Idx)
+		pp.inFlight[best.Idx] = best
+	}
+	return best
+}
+
+// Has tells if a piece is still registered, pending or in flight
+func (pp *PiecePicker) Has(idx int) bool {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	return pp.isOpen(idx)
+}
+
+// Wanted tells if a piece still has to be downloaded
+func (pp *PiecePicker) Wanted(idx int) bool {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	return pp.isOpen(idx) && idx < len(pp.priority) && pp.priority[idx] != piece.PrioritySkip
+}
+
+// Return puts back a piece whose download failed
+func (pp *PiecePicker) Return(p *piece.Piece) {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	if _, ok := pp.inFlight[p.Idx]; !ok {
+		return
+	}
+	delete(pp.inFlight, p.Idx)
+	pp.pending[p.Idx] = p
+}
+
+func (pp *PiecePicker) Done(idx int) {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	if !pp.isOpen(idx) {
+		return
+	}
+	delete(pp.inFlight, idx)
+	delete(pp.pending, idx)
+	delete(pp.deadline, idx)
+	pp.done++
+	if pp.priority[idx] != piece.PrioritySkip {
+		pp.wanted--
+	}
+}
+
+// Remaining counts the wanted pieces that are not verified yet
+func (pp *PiecePicker) Remaining() int {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	return pp.wanted
+}
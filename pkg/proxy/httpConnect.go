@@ -0,0 +1,48 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// bufferedConn keeps bytes the proxy sent right after its response headers
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (p *Proxy) httpConnect(conn net.Conn, addr string) (net.Conn, error) {
+	req := "CONNECT " + addr + " HTTP/1.1\r\nHost: " + addr + "\r\n"
+	if p.Username != "" {
+		credentials := base64.StdEncoding.EncodeToString([]byte(p.Username + ":" + p.Password))
+		req += "Proxy-Authorization: Basic " + credentials + "\r\n"
+	}
+	req += "\r\n"
+
+	_, err := conn.Write([]byte(req))
+	if err != nil {
+		return conn, fmt.Errorf("could not send CONNECT: %w", err)
+	}
+
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		return conn, fmt.Errorf("could not read CONNECT response: %w", err)
+	}
+	// the body of a successful CONNECT is the tunnel itself, never drain it
+	if resp.StatusCode != http.StatusOK {
+		return conn, fmt.Errorf("CONNECT rejected: %s", resp.Status)
+	}
+
+	if r.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: r}, nil
+	}
+	return conn, nil
+}
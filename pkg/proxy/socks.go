@@ -0,0 +1,329 @@
+package proxy
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+const socks4Version = 0x04
+const socks5Version = 0x05
+
+const (
+	socksCmdConnect      = 0x01
+	socksCmdUDPAssociate = 0x03
+)
+
+const (
+	socks5AddrIPv4   = 0x01
+	socks5AddrDomain = 0x03
+	socks5AddrIPv6   = 0x04
+)
+
+const (
+	socks5AuthNone     = 0x00
+	socks5AuthPassword = 0x02
+	socks5NoAcceptable = 0xff
+)
+
+func splitHostPort(addr string) (string, uint16, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", 0, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 0 || port > 0xffff {
+		return "", 0, fmt.Errorf("invalid port %q", portStr)
+	}
+	return host, uint16(port), nil
+}
+
+func (p *Proxy) socks4Connect(conn net.Conn, addr string) error {
+	host, port, err := splitHostPort(addr)
+	if err != nil {
+		return err
+	}
+
+	req := []byte{socks4Version, socksCmdConnect, 0, 0}
+	binary.BigEndian.PutUint16(req[2:4], port)
+
+	ip := net.ParseIP(host).To4()
+	if ip == nil {
+		// SOCKS4a, let the proxy resolve the name
+		req = append(req, 0, 0, 0, 1)
+	} else {
+		req = append(req, ip...)
+	}
+	req = append(req, []byte(p.Username)...)
+	req = append(req, 0)
+	if ip == nil {
+		req = append(req, []byte(host)...)
+		req = append(req, 0)
+	}
+
+	_, err = conn.Write(req)
+	if err != nil {
+		return fmt.Errorf("could not send socks4 request: %w", err)
+	}
+
+	resp := make([]byte, 8)
+	_, err = io.ReadFull(conn, resp)
+	if err != nil {
+		return fmt.Errorf("could not read socks4 response: %w", err)
+	}
+	if resp[1] != 0x5a {
+		return fmt.Errorf("socks4 request rejected with code %d", resp[1])
+	}
+	return nil
+}
+
+func (p *Proxy) socks5Handshake(conn net.Conn) error {
+	methods := []byte{socks5AuthNone}
+	if p.Username != "" {
+		methods = append(methods, socks5AuthPassword)
+	}
+	req := append([]byte{socks5Version, byte(len(methods))}, methods...)
+	_, err := conn.Write(req)
+	if err != nil {
+		return fmt.Errorf("could not send socks5 greeting: %w", err)
+	}
+
+	resp := make([]byte, 2)
+	_, err = io.ReadFull(conn, resp)
+	if err != nil {
+		return fmt.Errorf("could not read socks5 greeting: %w", err)
+	}
+	if resp[0] != socks5Version {
+		return fmt.Errorf("unexpected socks version %d", resp[0])
+	}
+
+	switch resp[1] {
+	case socks5AuthNone:
+		return nil
+	case socks5AuthPassword:
+		if len(p.Username) > 255 || len(p.Password) > 255 {
+			return errors.New("socks5 credentials too long")
+		}
+		auth := []byte{0x01, byte(len(p.Username))}
+		auth = append(auth, []byte(p.Username)...)
+		auth = append(auth, byte(len(p.Password)))
+		auth = append(auth, []byte(p.Password)...)
+		_, err = conn.Write(auth)
+		if err != nil {
+			return fmt.Errorf("could not send socks5 credentials: %w", err)
+		}
+		_, err = io.ReadFull(conn, resp)
+		if err != nil {
+			return fmt.Errorf("could not read socks5 auth response: %w", err)
+		}
+		if resp[1] != 0 {
+			return errors.New("socks5 authentication failed")
+		}
+		return nil
+	case socks5NoAcceptable:
+		return errors.New("socks5 proxy accepted none of our auth methods")
+	}
+	return fmt.Errorf("socks5 proxy chose unsupported auth method %d", resp[1])
+}
+
+func appendSocks5Addr(buf []byte, host string, port uint16) ([]byte, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			buf = append(buf, socks5AddrIPv4)
+			buf = append(buf, ip4...)
+		} else {
+			buf = append(buf, socks5AddrIPv6)
+			buf = append(buf, ip.To16()...)
+		}
+	} else {
+		if len(host) > 255 {
+			return nil, fmt.Errorf("host name too long: %s", host)
+		}
+		buf = append(buf, socks5AddrDomain, byte(len(host)))
+		buf = append(buf, []byte(host)...)
+	}
+	return binary.BigEndian.AppendUint16(buf, port), nil
+}
+
+func readSocks5Addr(r io.Reader) (net.IP, uint16, error) {
+	kind := make([]byte, 1)
+	_, err := io.ReadFull(r, kind)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var ip net.IP
+	switch kind[0] {
+	case socks5AddrIPv4:
+		ip = make(net.IP, 4)
+		_, err = io.ReadFull(r, ip)
+	case socks5AddrIPv6:
+		ip = make(net.IP, 16)
+		_, err = io.ReadFull(r, ip)
+	case socks5AddrDomain:
+		length := make([]byte, 1)
+		_, err = io.ReadFull(r, length)
+		if err == nil {
+			_, err = io.ReadFull(r, make([]byte, length[0]))
+		}
+	default:
+		return nil, 0, fmt.Errorf("unknown socks5 address type %d", kind[0])
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	portBuf := make([]byte, 2)
+	_, err = io.ReadFull(r, portBuf)
+	if err != nil {
+		return nil, 0, err
+	}
+	return ip, binary.BigEndian.Uint16(portBuf), nil
+}
+
+func (p *Proxy) socks5Request(conn net.Conn, cmd byte, addr string) (net.IP, uint16, error) {
+	host, port, err := splitHostPort(addr)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	err = p.socks5Handshake(conn)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	req, err := appendSocks5Addr([]byte{socks5Version, cmd, 0}, host, port)
+	if err != nil {
+		return nil, 0, err
+	}
+	_, err = conn.Write(req)
+	if err != nil {
+		return nil, 0, fmt.Errorf("could not send socks5 request: %w", err)
+	}
+
+	resp := make([]byte, 3)
+	_, err = io.ReadFull(conn, resp)
+	if err != nil {
+		return nil, 0, fmt.Errorf("could not read socks5 response: %w", err)
+	}
+	if resp[1] != 0 {
+		return nil, 0, fmt.Errorf("socks5 request rejected with code %d", resp[1])
+	}
+	boundIP, boundPort, err := readSocks5Addr(conn)
+	if err != nil {
+		return nil, 0, fmt.Errorf("could not read socks5 bound address: %w", err)
+	}
+	return boundIP, boundPort, nil
+}
+
+func (p *Proxy) socks5Connect(conn net.Conn, addr string) error {
+	_, _, err := p.socks5Request(conn, socksCmdConnect, addr)
+	return err
+}
+
+// socks5UDPConn wraps datagrams to and from a single target in the SOCKS5
+// UDP request header. The control connection must stay open for the relay
+// to remain valid.
+type socks5UDPConn struct {
+	*net.UDPConn
+	control net.Conn
+	header  []byte
+}
+
+func (c *socks5UDPConn) Write(b []byte) (int, error) {
+	datagram := append(append([]byte{}, c.header...), b...)
+	_, err := c.UDPConn.Write(datagram)
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *socks5UDPConn) Read(b []byte) (int, error) {
+	buf := make([]byte, len(b)+262)
+	n, err := c.UDPConn.Read(buf)
+	if err != nil {
+		return 0, err
+	}
+	buf = buf[:n]
+	if len(buf) < 4 || buf[2] != 0 {
+		return 0, errors.New("malformed or fragmented socks5 datagram")
+	}
+	headerLen := 0
+	switch buf[3] {
+	case socks5AddrIPv4:
+		headerLen = 4 + 4 + 2
+	case socks5AddrIPv6:
+		headerLen = 4 + 16 + 2
+	case socks5AddrDomain:
+		if len(buf) < 5 {
+			return 0, errors.New("malformed socks5 datagram")
+		}
+		headerLen = 4 + 1 + int(buf[4]) + 2
+	default:
+		return 0, fmt.Errorf("unknown socks5 address type %d", buf[3])
+	}
+	if len(buf) < headerLen {
+		return 0, errors.New("malformed socks5 datagram")
+	}
+	return copy(b, buf[headerLen:]), nil
+}
+
+func (c *socks5UDPConn) Close() error {
+	c.control.Close()
+	return c.UDPConn.Close()
+}
+
+func (p *Proxy) socks5UDPAssociate(ctx context.Context, addr string, timeout time.Duration) (net.Conn, error) {
+	host, port, err := splitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	control, err := dialContext(ctx, "tcp", p.Address, timeout)
+	if err != nil {
+		return nil, fmt.Errorf("could not reach proxy: %w", err)
+	}
+	control.SetDeadline(time.Now().Add(timeout))
+	stop := context.AfterFunc(ctx, func() {
+		control.SetDeadline(time.Now())
+	})
+	relayIP, relayPort, err := p.socks5Request(control, socksCmdUDPAssociate, "0.0.0.0:0")
+	stop()
+	control.SetDeadline(time.Time{})
+	if err != nil {
+		control.Close()
+		return nil, err
+	}
+
+	// a zero address means the relay lives on the proxy host itself
+	if relayIP == nil || relayIP.IsUnspecified() {
+		proxyHost, _, _ := net.SplitHostPort(p.Address)
+		ips, err := net.LookupIP(proxyHost)
+		if err != nil || len(ips) == 0 {
+			control.Close()
+			return nil, fmt.Errorf("could not resolve proxy host: %w", err)
+		}
+		relayIP = ips[0]
+	}
+
+	udpConn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: relayIP, Port: int(relayPort)})
+	if err != nil {
+		control.Close()
+		return nil, fmt.Errorf("could not reach socks5 udp relay: %w", err)
+	}
+
+	header, err := appendSocks5Addr([]byte{0, 0, 0}, host, port)
+	if err != nil {
+		udpConn.Close()
+		control.Close()
+		return nil, err
+	}
+
+	return &socks5UDPConn{UDPConn: udpConn, control: control, header: header}, nil
+}
@@ -0,0 +1,53 @@
+package ratelimiter
+
+import "net"
+
+// chunkSize bounds how much a single Read or Write moves before asking the
+// limiters again, so traffic stays smooth instead of bursting
+const chunkSize = 16 * 1024
+
+// Conn throttles a peer connection through every limiter it belongs to
+type Conn struct {
+	net.Conn
+	pairs []*Pair
+}
+
+func WrapConn(c net.Conn, pairs ...*Pair) net.Conn {
+	active := make([]*Pair, 0, len(pairs))
+	for _, p := range pairs {
+		if p != nil {
+			active = append(active, p)
+		}
+	}
+	if len(active) == 0 {
+		return c
+	}
+	return &Conn{Conn: c, pairs: active}
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	if len(b) > chunkSize {
+		b = b[:chunkSize]
+	}
+	n, err := c.Conn.Read(b)
+	for _, p := range c.pairs {
+		p.Download.WaitN(n)
+	}
+	return n, err
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+	written := 0
+	for written < len(b) {
+		end := min(written+chunkSize, len(b))
+		for _, p := range c.pairs {
+			p.Upload.WaitN(end - written)
+		}
+		n, err := c.Conn.Write(b[written:end])
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
@@ -0,0 +1,108 @@
+package ratelimiter
+
+import (
+	"sync"
+	"time"
+)
+
+// Unlimited disables a limiter
+const Unlimited = 0
+
+// MinBurst keeps very low limits from stalling on a single block
+const MinBurst = 16 * 1024
+
+// Limiter is a token bucket measured in bytes. A nil *Limiter never blocks.
+type Limiter struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func NewLimiter(bytesPerSecond int) *Limiter {
+	l := &Limiter{}
+	l.SetLimit(bytesPerSecond)
+	return l
+}
+
+// SetLimit changes the rate, it takes effect for the next wait
+func (l *Limiter) SetLimit(bytesPerSecond int) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refill(time.Now())
+	if bytesPerSecond < 0 {
+		bytesPerSecond = Unlimited
+	}
+	l.rate = float64(bytesPerSecond)
+	l.burst = max(l.rate, MinBurst)
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+}
+
+func (l *Limiter) Limit() int {
+	if l == nil {
+		return Unlimited
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return int(l.rate)
+}
+
+func (l *Limiter) refill(now time.Time) {
+	if !l.last.IsZero() && l.rate > 0 {
+		l.tokens += now.Sub(l.last).Seconds() * l.rate
+		if l.tokens > l.burst {
+			l.tokens = l.burst
+		}
+	}
+	l.last = now
+}
+
+// WaitN blocks until n bytes may pass. The bucket can go into debt, so a
+// large transfer pays for itself with a longer wait instead of starving.
+func (l *Limiter) WaitN(n int) {
+	if l == nil || n <= 0 {
+		return
+	}
+	l.mu.Lock()
+	if l.rate <= 0 {
+		l.mu.Unlock()
+		return
+	}
+	now := time.Now()
+	l.refill(now)
+	l.tokens -= float64(n)
+	var wait time.Duration
+	if l.tokens < 0 {
+		wait = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+// Pair groups the download and upload limiter of one scope (global,
+// torrent or peer)
+type Pair struct {
+	Download *Limiter
+	Upload   *Limiter
+}
+
+func NewPair(download, upload int) *Pair {
+	return &Pair{Download: NewLimiter(download), Upload: NewLimiter(upload)}
+}
+
+func (p *Pair) SetLimits(download, upload int) {
+	if p == nil {
+		return
+	}
+	p.Download.SetLimit(download)
+	p.Upload.SetLimit(upload)
+}
@@ -0,0 +1,228 @@
+package ratelimiter
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ScheduleRule applies its limits between From and To, both measured
+// from midnight. A rule where To is before From wraps past midnight.
+type ScheduleRule struct {
+	From     time.Duration
+	To       time.Duration
+	Days     []time.Weekday
+	Download int
+	Upload   int
+}
+
+func (r *ScheduleRule) Matches(now time.Time) bool {
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	since := now.Sub(midnight)
+	day := now.Weekday()
+
+	inWindow := false
+	if r.From <= r.To {
+		inWindow = since >= r.From && since < r.To
+	} else {
+		inWindow = since >= r.From || since < r.To
+		// the early morning part belongs to the day the rule started
+		if since < r.To {
+			day = (day + 6) % 7
+		}
+	}
+	if !inWindow {
+		return false
+	}
+	if len(r.Days) == 0 {
+		return true
+	}
+	for _, d := range r.Days {
+		if d == day {
+			return true
+		}
+	}
+	return false
+}
+
+func parseClock(s string) (time.Duration, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 2 {
+		return 0, fmt.Errorf("expected HH:MM, got %q", s)
+	}
+	h, err := strconv.Atoi(parts[0])
+	if err != nil || h < 0 || h > 24 {
+		return 0, fmt.Errorf("invalid hour in %q", s)
+	}
+	m, err := strconv.Atoi(parts[1])
+	if err != nil || m < 0 || m > 59 {
+		return 0, fmt.Errorf("invalid minute in %q", s)
+	}
+	// 24:00 ends a day, nothing comes after it
+	if h == 24 && m != 0 {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	return time.Duration(h)*time.Hour + time.Duration(m)*time.Minute, nil
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+func parseWeekday(s string) (time.Weekday, error) {
+	day, ok := weekdays[strings.ToLower(s)]
+	if !ok {
+		return 0, fmt.Errorf("invalid day %q", s)
+	}
+	return day, nil
+}
+
+// parseDays reads days joined by "+", each one a day or a range of them
+// like "mon-fri". A range can wrap past the end of the week ("fri-mon").
+func parseDays(s string) ([]time.Weekday, error) {
+	days := []time.Weekday{}
+	for _, item := range strings.Split(s, "+") {
+		first, last, isRange := strings.Cut(item, "-")
+		from, err := parseWeekday(first)
+		if err != nil {
+			return nil, err
+		}
+		to := from
+		if isRange {
+			to, err = parseWeekday(last)
+			if err != nil {
+				return nil, err
+			}
+		}
+		for day := from; ; day = (day + 1) % 7 {
+			if !slices.Contains(days, day) {
+				days = append(days, day)
+			}
+			if day == to {
+				break
+			}
+		}
+	}
+	return days, nil
+}
+
+// ParseScheduleRule reads rules shaped like "08:00-18:00=512/128" with
+// limits in KiB/s (download/upload, 0 for unlimited). The rule can be
+// narrowed to some days with a prefix like "mon-fri@" or "sat+sun@".
+func ParseScheduleRule(s string) (ScheduleRule, error) {
+	rule := ScheduleRule{}
+	if days, rest, ok := strings.Cut(s, "@"); ok {
+		var err error
+		rule.Days, err = parseDays(days)
+		if err != nil {
+			return rule, fmt.Errorf("schedule rule %q: %w", s, err)
+		}
+		s = rest
+	}
+	window, limits, ok := strings.Cut(s, "=")
+	if !ok {
+		return rule, fmt.Errorf("schedule rule %q has no limits", s)
+	}
+	from, to, ok := strings.Cut(window, "-")
+	if !ok {
+		return rule, fmt.Errorf("schedule rule %q has no time range", s)
+	}
+	var err error
+	rule.From, err = parseClock(from)
+	if err != nil {
+		return rule, err
+	}
+	rule.To, err = parseClock(to)
+	if err != nil {
+		return rule, err
+	}
+	down, up, ok := strings.Cut(limits, "/")
+	if !ok {
+		return rule, fmt.Errorf("schedule rule %q needs download/upload limits", s)
+	}
+	downKiB, err := strconv.Atoi(down)
+	if err != nil {
+		return rule, fmt.Errorf("invalid download limit in %q", s)
+	}
+	upKiB, err := strconv.Atoi(up)
+	if err != nil {
+		return rule, fmt.Errorf("invalid upload limit in %q", s)
+	}
+	rule.Download = downKiB * 1024
+	rule.Upload = upKiB * 1024
+	return rule, nil
+}
+
+// Scheduler switches Target between the rule matching the time of day and
+// the default limits. The first matching rule wins. Limits set on Target
+// by hand last until the schedule moves to another rule.
+type Scheduler struct {
+	Target          *Pair
+	Rules           []ScheduleRule
+	DefaultDownload int
+	DefaultUpload   int
+	stop            chan struct{}
+	// applied are the limits last set, valid once hasApplied
+	applied    [2]int
+	hasApplied bool
+	mu         sync.Mutex
+}
+
+func (s *Scheduler) Apply(now time.Time) {
+	download, upload := s.DefaultDownload, s.DefaultUpload
+	for i := range s.Rules {
+		if s.Rules[i].Matches(now) {
+			download, upload = s.Rules[i].Download, s.Rules[i].Upload
+			break
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.hasApplied && s.applied == [2]int{download, upload} {
+		return
+	}
+	s.applied = [2]int{download, upload}
+	s.hasApplied = true
+	fmt.Printf("scheduled rate limits: download %d B/s upload %d B/s\n", download, upload)
+	s.Target.SetLimits(download, upload)
+}
+
+func (s *Scheduler) Start() {
+	if s.stop != nil {
+		return
+	}
+	stop := make(chan struct{})
+	s.stop = stop
+	s.mu.Lock()
+	s.hasApplied = false
+	s.mu.Unlock()
+	s.Apply(time.Now())
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case now := <-ticker.C:
+				s.Apply(now)
+			}
+		}
+	}()
+}
+
+func (s *Scheduler) Stop() {
+	if s.stop != nil {
+		close(s.stop)
+		s.stop = nil
+	}
+}
@@ -0,0 +1,81 @@
+package ratelimiter
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseScheduleRule(t *testing.T) {
+	// 2026-10-19 is a monday
+	monday := func(clock string) time.Time {
+		at, err := time.Parse("2006-01-02 15:04", "2026-10-19 "+clock)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return at
+	}
+	tests := []struct {
+		rule  string
+		at    time.Time
+		match bool
+	}{
+		{"08:00-18:00=512/128", monday("08:00"), true},
+		{"08:00-18:00=512/128", monday("18:00"), false},
+		{"22:00-06:00=0/0", monday("23:30"), true},
+		{"22:00-06:00=0/0", monday("05:59"), true},
+		{"22:00-06:00=0/0", monday("12:00"), false},
+		{"mon-fri@08:00-18:00=512/128", monday("09:00"), true},
+		{"sat+sun@08:00-18:00=512/128", monday("09:00"), false},
+		// the night after sunday belongs to sunday
+		{"sun@22:00-06:00=0/0", monday("01:00"), true},
+		{"fri-mon@00:00-24:00=1/1", monday("12:00"), true},
+	}
+	for _, tt := range tests {
+		rule, err := ParseScheduleRule(tt.rule)
+		if err != nil {
+			t.Fatalf("ParseScheduleRule(%q): %v", tt.rule, err)
+		}
+		if rule.Matches(tt.at) != tt.match {
+			t.Errorf("%q matches %s: %v, want %v", tt.rule, tt.at.Format("Mon 15:04"), !tt.match, tt.match)
+		}
+	}
+
+	for _, invalid := range []string{"08:00-18:00", "0800=1/1", "24:30-01:00=1/1", "moon@08:00-18:00=1/1", "08:00-18:00=a/1"} {
+		if _, err := ParseScheduleRule(invalid); err == nil {
+			t.Errorf("ParseScheduleRule(%q) was accepted", invalid)
+		}
+	}
+}
+
+func TestSchedulerKeepsManualLimitsUntilTheNextRule(t *testing.T) {
+	rule, err := ParseScheduleRule("08:00-18:00=512/128")
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := NewPair(Unlimited, Unlimited)
+	s := &Scheduler{Target: target, Rules: []ScheduleRule{rule}}
+	day := time.Date(2026, 10, 19, 9, 0, 0, 0, time.UTC)
+
+	s.Apply(day)
+	if target.Download.Limit() != 512*1024 || target.Upload.Limit() != 128*1024 {
+		t.Fatalf("limits %d/%d after the rule started", target.Download.Limit(), target.Upload.Limit())
+	}
+	target.SetLimits(1024, 1024)
+	s.Apply(day.Add(time.Minute))
+	if target.Download.Limit() != 1024 {
+		t.Fatalf("the schedule replaced the limits set by hand with %d", target.Download.Limit())
+	}
+	s.Apply(day.Add(10 * time.Hour))
+	if target.Download.Limit() != Unlimited || target.Upload.Limit() != Unlimited {
+		t.Fatalf("limits %d/%d after the rule ended", target.Download.Limit(), target.Upload.Limit())
+	}
+}
+
+func TestSchedulerStop(t *testing.T) {
+	s := &Scheduler{Target: NewPair(Unlimited, Unlimited)}
+	for range 3 {
+		s.Start()
+		s.Stop()
+	}
+	s.Stop()
+}
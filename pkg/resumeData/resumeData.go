@@ -0,0 +1,189 @@
+package resumedata
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/TheLox95/go-torrent-client/pkg/bencode"
+	"github.com/TheLox95/go-torrent-client/pkg/bitfield"
+)
+
+// Version is bumped whenever the layout changes in a way older code
+// cannot read
+const Version = 1
+
+const fileType = "go-torrent-client resume"
+
+type FileState struct {
+	Path  string `bencode:"path"`
+	Size  int64  `bencode:"size"`
+	Mtime int64  `bencode:"mtime"`
+}
+
+type TrackerState struct {
+	Url          string `bencode:"url"`
+	LastAnnounce int64  `bencode:"last announce"`
+	Interval     int    `bencode:"interval"`
+	Failures     int    `bencode:"failures"`
+	LastError    string `bencode:"last error"`
+}
+
+type ResumeData struct {
+	FileType   string         `bencode:"file-format"`
+	Version    int            `bencode:"file-version"`
+	InfoHash   string         `bencode:"info-hash"`
+	PieceCount int            `bencode:"piece count"`
+	Pieces     string         `bencode:"pieces"`
+	Files      []FileState    `bencode:"files"`
+	Uploaded   int64          `bencode:"uploaded"`
+	Downloaded int64          `bencode:"downloaded"`
+	Peers      []string       `bencode:"peers"`
+	Trackers   []TrackerState `bencode:"trackers"`
+}
+
+func New(infoHash [20]byte, pieceCount int) *ResumeData {
+	return &ResumeData{
+		FileType:   fileType,
+		Version:    Version,
+		InfoHash:   string(infoHash[:]),
+		PieceCount: pieceCount,
+		Pieces:     string(make([]byte, (pieceCount+7)/8)),
+	}
+}
+
+// Path returns where the resume file of a torrent lives under root
+func Path(root string, infoHash [20]byte) string {
+	return filepath.Join(root, ".resume", hex.EncodeToString(infoHash[:])+".resume")
+}
+
+func (r *ResumeData) Bitfield() bitfield.Bitfield {
+	return bitfield.Bitfield(r.Pieces)
+}
+
+func (r *ResumeData) HasPiece(idx int) bool {
+	if idx < 0 || idx >= r.PieceCount {
+		return false
+	}
+	return r.Bitfield().HasPiece(idx)
+}
+
+func (r *ResumeData) SetPiece(idx int) {
+	if idx < 0 || idx >= r.PieceCount {
+		return
+	}
+	bf := r.Bitfield()
+	bf.SetPiece(idx)
+	r.Pieces = string(bf)
+}
+
+func (r *ResumeData) ClearPiece(idx int) {
+	if idx < 0 || idx >= r.PieceCount {
+		return
+	}
+	bf := []byte(r.Pieces)
+	bf[idx/8] &^= 1 << (7 - idx%8)
+	r.Pieces = string(bf)
+}
+
+func (r *ResumeData) CompletedPieces() int {
+	total := 0
+	for i := range r.PieceCount {
+		if r.HasPiece(i) {
+			total++
+		}
+	}
+	return total
+}
+
+// Load reads and validates the resume file of a torrent. A missing file
+// returns os.ErrNotExist, every other problem is reported so the caller
+// can fall back to a fresh state instead of trusting bad data.
+func Load(path string, infoHash [20]byte, pieceCount int) (*ResumeData, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	r := &ResumeData{}
+	err = bencode.Unmarshal(bytes.NewReader(content), r)
+	if err != nil {
+		return nil, fmt.Errorf("could not decode resume file: %w", err)
+	}
+	if r.FileType != fileType {
+		return nil, fmt.Errorf("not a resume file: %q", r.FileType)
+	}
+	if r.Version != Version {
+		return nil, fmt.Errorf("unsupported resume file version %d", r.Version)
+	}
+	if r.InfoHash != string(infoHash[:]) {
+		return nil, errors.New("resume file belongs to another torrent")
+	}
+	if r.PieceCount != pieceCount {
+		return nil, fmt.Errorf("resume file has %d pieces, torrent has %d", r.PieceCount, pieceCount)
+	}
+	if len(r.Pieces) != (pieceCount+7)/8 {
+		return nil, fmt.Errorf("resume bitfield has %d bytes, expected %d", len(r.Pieces), (pieceCount+7)/8)
+	}
+	// spare bits past the last piece must be zero
+	if pieceCount%8 != 0 && r.Pieces[len(r.Pieces)-1]&(0xff>>(pieceCount%8)) != 0 {
+		return nil, errors.New("resume bitfield has spare bits set")
+	}
+	if r.Uploaded < 0 || r.Downloaded < 0 {
+		return nil, errors.New("resume file has negative totals")
+	}
+	return r, nil
+}
+
+// Save writes the resume file atomically: the data goes to a temporary
+// file that is synced and then renamed over the old one, so a crash leaves
+// either the old or the new version on disk, never a torn one.
+func (r *ResumeData) Save(path string) error {
+	var buf bytes.Buffer
+	err := bencode.Marshal(&buf, *r)
+	if err != nil {
+		return fmt.Errorf("could not encode resume data: %w", err)
+	}
+
+	dir := filepath.Dir(path)
+	err = os.MkdirAll(dir, os.ModePerm)
+	if err != nil {
+		return fmt.Errorf("could not create resume folder: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(dir, filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("could not create temporary resume file: %w", err)
+	}
+	tmpPath := tmp.Name()
+	err = tmp.Chmod(0644)
+	if err == nil {
+		_, err = tmp.Write(buf.Bytes())
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	closeErr := tmp.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("could not write resume file: %w", err)
+	}
+
+	err = os.Rename(tmpPath, path)
+	if err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("could not replace resume file: %w", err)
+	}
+
+	// persist the rename itself
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
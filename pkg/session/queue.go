@@ -0,0 +1,164 @@
+package session
+
+import (
+	"time"
+)
+
+// queueInterval is how often rates are sampled and the queue rebalanced,
+// a torrent finishing rebalances right away
+const queueInterval = 5 * time.Second
+
+// DefaultSlowGrace is how long a torrent has to stay below the slow rates
+// before it stops counting as active, so one that just started and is
+// still finding peers is not skipped over
+const DefaultSlowGrace = time.Minute
+
+// QueuePosition is the place of a torrent in the queue, 0 is the first to
+// be started. -1 for unknown torrents.
+func (s *Session) QueuePosition(infoHash [20]byte) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for idx, t := range s.queue {
+		if t.InfoHash == infoHash {
+			return idx
+		}
+	}
+	return -1
+}
+
+// SetQueuePosition moves a torrent in the queue, positions past the end
+// put it last
+func (s *Session) SetQueuePosition(infoHash [20]byte, position int) error {
+	s.mu.Lock()
+	current := -1
+	for idx, t := range s.queue {
+		if t.InfoHash == infoHash {
+			current = idx
+		}
+	}
+	if current == -1 {
+		s.mu.Unlock()
+		return ErrUnknownTorrent
+	}
+	t := s.queue[current]
+	s.queue = append(s.queue[:current], s.queue[current+1:]...)
+	position = min(max(position, 0), len(s.queue))
+	s.queue = append(s.queue[:position], append([]*Torrent{t}, s.queue[position:]...)...)
+	s.mu.Unlock()
+
+	s.rebalance()
+	return nil
+}
+
+func (s *Session) QueueUp(infoHash [20]byte) error {
+	return s.SetQueuePosition(infoHash, s.QueuePosition(infoHash)-1)
+}
+
+func (s *Session) QueueDown(infoHash [20]byte) error {
+	return s.SetQueuePosition(infoHash, s.QueuePosition(infoHash)+1)
+}
+
+func (s *Session) QueueTop(infoHash [20]byte) error {
+	return s.SetQueuePosition(infoHash, 0)
+}
+
+func (s *Session) QueueBottom(infoHash [20]byte) error {
+	s.mu.Lock()
+	last := len(s.queue)
+	s.mu.Unlock()
+	return s.SetQueuePosition(infoHash, last)
+}
+
+func (s *Session) startQueue() {
+	if s.queueStop != nil {
+		return
+	}
+	stop := make(chan struct{})
+	s.queueStop = stop
+	go func() {
+		ticker := time.NewTicker(queueInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case now := <-ticker.C:
+				for _, t := range s.Torrents() {
+					t.sampleRates(now)
+				}
+				s.rebalance()
+			}
+		}
+	}()
+}
+
+func (s *Session) stopQueue() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.queueStop != nil {
+		close(s.queueStop)
+		s.queueStop = nil
+	}
+}
+
+// rebalance walks the queue in order starting torrents while there is room
+// for them and queueing the ones past the limits. Slow torrents keep
+// running without taking a slot.
+func (s *Session) rebalance() {
+	s.rebalanceMu.Lock()
+	defer s.rebalanceMu.Unlock()
+
+	s.mu.Lock()
+	queue := append([]*Torrent(nil), s.queue...)
+	s.mu.Unlock()
+
+	now := time.Now()
+	downloads, seeds := 0, 0
+	for _, t := range queue {
+		state := t.State()
+		if state == Paused || state == Failed {
+			continue
+		}
+		count, limit := &downloads, s.MaxActiveDownloads
+		if t.Complete() {
+			count, limit = &seeds, s.MaxActiveSeeds
+		}
+		running := t.Running()
+		if running && s.isSlow(t, now) {
+			continue
+		}
+		if limit <= 0 || *count < limit {
+			*count++
+			if !running {
+				t.start()
+			}
+		} else if running {
+			t.pause(Queued)
+		}
+	}
+}
+
+// isSlow tells if a running torrent has been under the slow rate for the
+// whole grace period
+func (s *Session) isSlow(t *Torrent, now time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	threshold := s.SlowDownloadRate
+	rate := t.downloadRate
+	if t.state == Seeding {
+		threshold = s.SlowUploadRate
+		rate = t.uploadRate
+	}
+	if threshold <= 0 || rate >= float64(threshold) {
+		t.slowSince = time.Time{}
+		return false
+	}
+	if t.slowSince.IsZero() || t.slowSince.Before(t.startedAt) {
+		t.slowSince = now
+	}
+	grace := s.SlowGrace
+	if grace == 0 {
+		grace = DefaultSlowGrace
+	}
+	return now.Sub(t.slowSince) >= grace
+}
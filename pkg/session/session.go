@@ -0,0 +1,467 @@
+package session
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	bencodetorrent "github.com/TheLox95/go-torrent-client/pkg/bencodeTorrent"
+	"github.com/TheLox95/go-torrent-client/pkg/choker"
+	clientidentifier "github.com/TheLox95/go-torrent-client/pkg/clientIdentifier"
+	"github.com/TheLox95/go-torrent-client/pkg/dht"
+	downloadmanager "github.com/TheLox95/go-torrent-client/pkg/downloadManager"
+	filemanager "github.com/TheLox95/go-torrent-client/pkg/fileManager"
+	ipfilter "github.com/TheLox95/go-torrent-client/pkg/ipFilter"
+	"github.com/TheLox95/go-torrent-client/pkg/peer"
+	peerid "github.com/TheLox95/go-torrent-client/pkg/peerID"
+	peermanager2 "github.com/TheLox95/go-torrent-client/pkg/peerManager2"
+	"github.com/TheLox95/go-torrent-client/pkg/piece"
+	"github.com/TheLox95/go-torrent-client/pkg/proxy"
+	ratelimiter "github.com/TheLox95/go-torrent-client/pkg/rateLimiter"
+)
+
+const DefaultListenPort = 6881
+
+// DefaultMaxConnections is the peer connection limit shared by every torrent
+const DefaultMaxConnections = 200
+
+// DefaultMaxHalfOpen caps the peer dials in progress of every torrent
+// together
+const DefaultMaxHalfOpen = 20
+
+// handshakeTimeout bounds how long an incoming connection may take to say
+// which torrent it wants
+const handshakeTimeout = 10 * time.Second
+
+var ErrUnknownTorrent = errors.New("unknown torrent")
+var ErrDuplicateTorrent = errors.New("torrent already added")
+
+// Session owns what torrents share: the listen socket, the DHT, the
+// storage root, the global rate limits and the connection limit
+type Session struct {
+	ListenPort  int
+	StorageRoot string
+	PeerID      [20]byte
+	// PeerIDPrefix starts the peer ids made when RotatePeerID gives every
+	// torrent its own, so swarms cannot tell they share a client
+	PeerIDPrefix string
+	RotatePeerID bool
+	// UserAgent names the client to trackers and peers
+	UserAgent string
+	Proxy     *proxy.Proxy
+	// GlobalLimits is shared by every connection of every torrent
+	GlobalLimits *ratelimiter.Pair
+	// MaxConnections caps the open peer connections of all torrents
+	// together, 0 for no limit
+	MaxConnections int
+	// MaxTorrentConnections caps the connections of each torrent, see
+	// PeerManager2.MaxConnections
+	MaxTorrentConnections int
+	// MaxHalfOpen caps the dials in progress, 0 for no limit
+	MaxHalfOpen int
+	// ExternalIP is our address as peers see it, when known it ranks the
+	// peers we dial by BEP 40 priority
+	ExternalIP        net.IP
+	UploadSlots       int
+	PeerDownloadLimit int
+	PeerUploadLimit   int
+	// MaxActiveDownloads and MaxActiveSeeds cap how many torrents run at
+	// once, the rest wait in the queue. 0 for no limit.
+	MaxActiveDownloads int
+	MaxActiveSeeds     int
+	// SlowDownloadRate and SlowUploadRate are in bytes per second, a torrent
+	// below them for SlowGrace does not count against the active limits
+	SlowDownloadRate int
+	SlowUploadRate   int
+	SlowGrace        time.Duration
+	// IdleTimeout closes connections no side is interested in, see
+	// PeerManager2.IdleTimeout
+	IdleTimeout time.Duration
+	// Banned are the peers caught sending corrupt data, every torrent
+	// refuses them until the session ends
+	Banned *peermanager2.BanList
+	// Filter blocks address ranges for every torrent, nil to allow all
+	Filter *ipfilter.Filter
+	// BlockedClients are client names, as peer.Client tells them, whose
+	// connections are closed. A name matches every version of the client.
+	BlockedClients []string
+	// DHT finds peers for every public torrent, nil until StartDHT
+	DHT *dht.DHT
+
+	torrents map[[20]byte]*Torrent
+	// queue is every torrent in the order they get started
+	queue         []*Torrent
+	queueStop     chan struct{}
+	rebalanceMu   sync.Mutex
+	listener      net.Listener
+	halfOpen      chan struct{}
+	transactionID uint32
+	// ctx is cancelled by Close, everything the session runs derives from it
+	ctx    context.Context
+	cancel context.CancelFunc
+	mu     sync.Mutex
+}
+
+const DefaultMaxActiveDownloads = 3
+const DefaultMaxActiveSeeds = 5
+
+// TorrentOptions are the per torrent settings given when it is added
+type TorrentOptions struct {
+	// FilePriorities by file index, files not listed stay normal
+	FilePriorities map[int]piece.Priority
+	Sequential     bool
+	// DownloadLimit and UploadLimit are in bytes per second, 0 for unlimited
+	DownloadLimit int
+	UploadLimit   int
+	// Paused adds the torrent without queueing it
+	Paused bool
+}
+
+func New(peerID [20]byte) *Session {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Session{
+		ctx:                ctx,
+		cancel:             cancel,
+		ListenPort:         DefaultListenPort,
+		PeerID:             peerID,
+		PeerIDPrefix:       peerid.Prefix(),
+		UserAgent:          peerid.UserAgent(),
+		GlobalLimits:       ratelimiter.NewPair(ratelimiter.Unlimited, ratelimiter.Unlimited),
+		Banned:             peermanager2.NewBanList(),
+		MaxConnections:     DefaultMaxConnections,
+		MaxHalfOpen:        DefaultMaxHalfOpen,
+		UploadSlots:        choker.DefaultUploadSlots,
+		MaxActiveDownloads: DefaultMaxActiveDownloads,
+		MaxActiveSeeds:     DefaultMaxActiveSeeds,
+		torrents:           make(map[[20]byte]*Torrent),
+		transactionID:      rand.Uint32(),
+	}
+}
+
+// AddFile adds the torrent stored at path
+func (s *Session) AddFile(path string, opts TorrentOptions) (*Torrent, error) {
+	meta, err := bencodetorrent.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return s.Add(meta, opts)
+}
+
+// Add queues a torrent after the ones already in the session
+func (s *Session) Add(meta *bencodetorrent.BencodeTorrent, opts TorrentOptions) (*Torrent, error) {
+	infoHash, err := meta.InfoHash()
+	if err != nil {
+		return nil, err
+	}
+	hashes, err := meta.Info.SplitPieceHashes()
+	if err != nil {
+		return nil, fmt.Errorf("could not parse pieces hashes: %w", err)
+	}
+	files, err := filemanager.LayoutFromInfo(&meta.Info)
+	if err != nil {
+		return nil, fmt.Errorf("could not lay out files: %w", err)
+	}
+	for idx, priority := range opts.FilePriorities {
+		if idx < 0 || idx >= len(files) {
+			return nil, fmt.Errorf("invalid file index %d", idx)
+		}
+		files[idx].Priority = priority
+	}
+
+	s.mu.Lock()
+	if s.torrents == nil {
+		s.torrents = make(map[[20]byte]*Torrent)
+	}
+	if _, ok := s.torrents[infoHash]; ok {
+		s.mu.Unlock()
+		return nil, ErrDuplicateTorrent
+	}
+
+	if s.halfOpen == nil && s.MaxHalfOpen > 0 {
+		s.halfOpen = make(chan struct{}, s.MaxHalfOpen)
+	}
+
+	peerID := s.PeerID
+	if s.RotatePeerID {
+		var err error
+		peerID, err = peerid.Generate(s.PeerIDPrefix)
+		if err != nil {
+			s.mu.Unlock()
+			return nil, err
+		}
+	}
+	identifier := &clientidentifier.ClientIdentifier{
+		PeerID:    peerID,
+		InfoHash:  infoHash,
+		UserAgent: s.UserAgent,
+	}
+	limits := ratelimiter.NewPair(opts.DownloadLimit, opts.UploadLimit)
+	peers := &peermanager2.PeerManager2{
+		Urls:              meta.Trackers(),
+		Peers:             make(map[string]*peer.Peer),
+		Client:            identifier,
+		Proxy:             s.Proxy,
+		GlobalLimits:      s.GlobalLimits,
+		TorrentLimits:     limits,
+		PeerDownloadLimit: s.PeerDownloadLimit,
+		PeerUploadLimit:   s.PeerUploadLimit,
+		CanConnect:        s.canConnect,
+		IdleTimeout:       s.IdleTimeout,
+		MaxConnections:    s.MaxTorrentConnections,
+		HalfOpen:          s.halfOpen,
+		ExternalIP:        s.ExternalIP,
+		ListenPort:        s.ListenPort,
+		Banned:            s.Banned,
+		Filter:            s.Filter,
+		AllowClient:       s.allowClient,
+		Private:           meta.Info.IsPrivate(),
+	}
+	if s.DHT != nil && !peers.Private {
+		peers.DHT = s.DHT
+		for _, node := range meta.DHTNodes() {
+			s.DHT.AddNode(node)
+		}
+	}
+	manager := &downloadmanager.DownloadManager{
+		PeerManager: peers,
+		Client:      identifier,
+		FileManager: &filemanager.FileManager{
+			Filename:      meta.Info.Name,
+			BasePieceSize: meta.Info.PieceLength,
+			InfoHash:      infoHash,
+			Files:         files,
+			Root:          s.StorageRoot,
+		},
+		MaxParallelDownload: 100,
+		Sequential:          opts.Sequential,
+	}
+	peers.OnEvent = manager.HandleEvent
+	peers.Interesting = manager.Interesting
+	t := &Torrent{
+		InfoHash: infoHash,
+		Meta:     meta,
+		Manager:  manager,
+		Peers:    peers,
+		Choker: &choker.Choker{
+			UploadSlots: s.UploadSlots,
+			Peers:       peers.ConnectedPeers,
+			Seeding:     manager.Completed,
+		},
+		Limits:  limits,
+		hashes:  hashes,
+		session: s,
+		state:   Queued,
+		done:    make(chan struct{}),
+	}
+	if opts.Paused {
+		t.state = Paused
+	}
+	s.torrents[infoHash] = t
+	s.queue = append(s.queue, t)
+	s.startQueue()
+	s.mu.Unlock()
+
+	s.rebalance()
+	return t, nil
+}
+
+// Remove stops a torrent and forgets it, its data stays on disk
+func (s *Session) Remove(infoHash [20]byte) error {
+	s.mu.Lock()
+	t, ok := s.torrents[infoHash]
+	delete(s.torrents, infoHash)
+	for idx, queued := range s.queue {
+		if queued == t {
+			s.queue = append(s.queue[:idx], s.queue[idx+1:]...)
+			break
+		}
+	}
+	s.mu.Unlock()
+	if !ok {
+		return ErrUnknownTorrent
+	}
+	t.close()
+	s.rebalance()
+	return nil
+}
+
+// Pause stops a torrent until Resume, it keeps its place in the queue
+func (s *Session) Pause(infoHash [20]byte) error {
+	t := s.Torrent(infoHash)
+	if t == nil {
+		return ErrUnknownTorrent
+	}
+	t.pause(Paused)
+	s.rebalance()
+	return nil
+}
+
+// Resume puts a paused torrent back in the queue, it starts as soon as
+// the active limits allow it
+func (s *Session) Resume(infoHash [20]byte) error {
+	t := s.Torrent(infoHash)
+	if t == nil {
+		return ErrUnknownTorrent
+	}
+	t.mu.Lock()
+	if t.state == Paused || t.state == Failed {
+		t.state = Queued
+	}
+	t.mu.Unlock()
+	s.rebalance()
+	return nil
+}
+
+func (s *Session) Torrent(infoHash [20]byte) *Torrent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.torrents[infoHash]
+}
+
+// Torrents lists the torrents in queue order
+func (s *Session) Torrents() []*Torrent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*Torrent(nil), s.queue...)
+}
+
+// Connections counts the open peer connections of every torrent
+func (s *Session) Connections() int {
+	count := 0
+	for _, t := range s.Torrents() {
+		count += len(t.Peers.ConnectedPeers())
+	}
+	return count
+}
+
+func (s *Session) canConnect() bool {
+	return s.MaxConnections <= 0 || s.Connections() < s.MaxConnections
+}
+
+func (s *Session) allowClient(p *peer.Peer) bool {
+	client := strings.ToLower(p.Client())
+	for _, blocked := range s.BlockedClients {
+		if blocked != "" && strings.HasPrefix(client, strings.ToLower(blocked)) {
+			return false
+		}
+	}
+	return true
+}
+
+// Listen accepts peers on ListenPort and hands each one to the torrent its
+// handshake asks for
+func (s *Session) Listen() error {
+	listener, err := net.Listen("tcp", net.JoinHostPort("", strconv.Itoa(s.ListenPort)))
+	if err != nil {
+		return fmt.Errorf("could not listen on port %d: %w", s.ListenPort, err)
+	}
+	s.mu.Lock()
+	s.listener = listener
+	s.mu.Unlock()
+	fmt.Println("accepting peers on", listener.Addr().String())
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
+				fmt.Println("could not accept peer:", err)
+				continue
+			}
+			go s.handleIncoming(conn)
+		}
+	}()
+	return nil
+}
+
+func (s *Session) handleIncoming(conn net.Conn) {
+	addr, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if ok && s.Filter.Blocked(addr.IP) {
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	handshake, err := peer.ReadHandshake(conn)
+	conn.SetDeadline(time.Time{})
+	if err != nil {
+		conn.Close()
+		return
+	}
+	t := s.Torrent(handshake.InfoHash)
+	if t == nil || !t.Running() || !s.canConnect() {
+		conn.Close()
+		return
+	}
+	err = t.Peers.AcceptPeer(s.ctx, conn, handshake, t.Manager.FileManager.Bitfield())
+	if err != nil {
+		fmt.Println("could not accept peer", conn.RemoteAddr().String(), err)
+	}
+}
+
+// StartDHT joins the DHT on the UDP side of ListenPort, torrents added
+// afterwards look for peers in it. Behind a proxy it would give our
+// address away, callers decide whether that is fine.
+func (s *Session) StartDHT() error {
+	node, err := dht.New(s.ListenPort)
+	if err != nil {
+		return err
+	}
+	node.Filter = s.Filter
+	err = node.Start(s.ctx)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.DHT = node
+	s.mu.Unlock()
+	return nil
+}
+
+// Close stops listening, then every torrent leaves its swarm with a
+// stopped announce and flushes its data and resume file
+func (s *Session) Close() error {
+	s.stopQueue()
+	s.mu.Lock()
+	listener, node := s.listener, s.DHT
+	s.listener = nil
+	s.mu.Unlock()
+	var err error
+	if listener != nil {
+		err = listener.Close()
+	}
+	// every torrent sends its stopped announces at the same time
+	var wg sync.WaitGroup
+	for _, t := range s.Torrents() {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			t.close()
+		}()
+	}
+	wg.Wait()
+	if node != nil {
+		node.Close()
+	}
+	s.cancel()
+	return err
+}
+
+// Wait blocks until every torrent in the session finished downloading or
+// failed, queued ones included, or until ctx is done
+func (s *Session) Wait(ctx context.Context) error {
+	for _, t := range s.Torrents() {
+		select {
+		case <-t.Done():
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
@@ -0,0 +1,247 @@
+package session
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	bencodetorrent "github.com/TheLox95/go-torrent-client/pkg/bencodeTorrent"
+	"github.com/TheLox95/go-torrent-client/pkg/choker"
+	downloadmanager "github.com/TheLox95/go-torrent-client/pkg/downloadManager"
+	peermanager2 "github.com/TheLox95/go-torrent-client/pkg/peerManager2"
+	ratelimiter "github.com/TheLox95/go-torrent-client/pkg/rateLimiter"
+)
+
+type State int
+
+const (
+	Paused State = iota
+	// Queued waits for a free slot under the active limits
+	Queued
+	Downloading
+	Seeding
+	Failed
+)
+
+func (s State) String() string {
+	switch s {
+	case Paused:
+		return "paused"
+	case Queued:
+		return "queued"
+	case Downloading:
+		return "downloading"
+	case Seeding:
+		return "seeding"
+	case Failed:
+		return "failed"
+	}
+	return "unknown"
+}
+
+// Torrent is one torrent of a session with everything running for it
+type Torrent struct {
+	InfoHash [20]byte
+	Meta     *bencodetorrent.BencodeTorrent
+	Manager  *downloadmanager.DownloadManager
+	Peers    *peermanager2.PeerManager2
+	Choker   *choker.Choker
+	// Limits only apply to this torrent, on top of the session ones
+	Limits *ratelimiter.Pair
+
+	hashes  [][20]byte
+	session *Session
+	state   State
+	err     error
+	// done is closed once the download finished or failed
+	done chan struct{}
+	// exited is closed when the goroutine running Download returns,
+	// cancel interrupts it
+	exited   chan struct{}
+	cancel   context.CancelFunc
+	complete bool
+	// rates are sampled by the session queue to find slow torrents
+	startedAt      time.Time
+	sampledAt      time.Time
+	lastDownloaded int64
+	lastUploaded   int64
+	downloadRate   float64
+	uploadRate     float64
+	slowSince      time.Time
+	mu             sync.Mutex
+}
+
+func (t *Torrent) State() State {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.state
+}
+
+// Err is why the torrent failed, nil otherwise
+func (t *Torrent) Err() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.err
+}
+
+// Complete is true once every wanted piece is verified
+func (t *Torrent) Complete() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.complete
+}
+
+// Rates are the download and upload speeds in bytes per second over the
+// last queue interval
+func (t *Torrent) Rates() (download float64, upload float64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.downloadRate, t.uploadRate
+}
+
+func (t *Torrent) sampleRates(now time.Time) {
+	downloaded, uploaded := t.Peers.Transferred()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.sampledAt.IsZero() {
+		elapsed := now.Sub(t.sampledAt).Seconds()
+		if elapsed > 0 {
+			t.downloadRate = float64(max(downloaded-t.lastDownloaded, 0)) / elapsed
+			t.uploadRate = float64(max(uploaded-t.lastUploaded, 0)) / elapsed
+		}
+	}
+	t.sampledAt = now
+	t.lastDownloaded = downloaded
+	t.lastUploaded = uploaded
+}
+
+func (t *Torrent) Running() bool {
+	state := t.State()
+	return state == Downloading || state == Seeding
+}
+
+func (t *Torrent) Done() <-chan struct{} {
+	return t.done
+}
+
+func (t *Torrent) Name() string {
+	return t.Meta.Info.Name
+}
+
+func (t *Torrent) start() {
+	t.mu.Lock()
+	if t.state == Downloading || t.state == Seeding {
+		t.mu.Unlock()
+		return
+	}
+	t.state = Downloading
+	if t.complete {
+		t.state = Seeding
+	}
+	t.err = nil
+	t.startedAt = time.Now()
+	t.downloadRate = 0
+	t.uploadRate = 0
+	launch := !t.complete && (t.exited == nil || isClosed(t.exited))
+	var exited chan struct{}
+	var ctx context.Context
+	if launch {
+		exited = make(chan struct{})
+		t.exited = exited
+		ctx, t.cancel = context.WithCancel(t.session.ctx)
+	}
+	t.mu.Unlock()
+
+	if t.Manager.Paused() {
+		err := t.Manager.Resume()
+		if err != nil {
+			fmt.Println(err)
+		}
+	} else {
+		t.Peers.PoolTrackers(t.session.ctx, &peermanager2.GetPeersFromUDPParams{
+			TransactionID: t.session.transactionID,
+			InfoHash:      t.InfoHash,
+			PeerID:        t.Peers.Client.PeerID,
+			TorrentLen:    t.Meta.Info.TotalLength(),
+			Port:          t.session.ListenPort,
+		})
+	}
+	t.Choker.Start()
+	if launch {
+		go t.run(ctx, exited)
+	}
+}
+
+func isClosed(ch chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
+
+func (t *Torrent) run(ctx context.Context, exited chan struct{}) {
+	defer close(exited)
+	err := t.Manager.Download(ctx, t.Meta.Info.PieceLength, t.Meta.Info.TotalLength(), t.hashes)
+	if errors.Is(err, downloadmanager.ErrStopped) {
+		return
+	}
+
+	if err != nil {
+		fmt.Printf("torrent %s failed: %v\n", t.Meta.Info.Name, err)
+		t.Choker.Stop()
+		t.Manager.Pause()
+	}
+	t.mu.Lock()
+	if err != nil {
+		t.state = Failed
+		t.err = err
+	} else {
+		t.state = Seeding
+		t.complete = true
+	}
+	select {
+	case <-t.done:
+	default:
+		close(t.done)
+	}
+	t.mu.Unlock()
+
+	// a seed may not fit under the seed limit, and a download slot is free
+	go t.session.rebalance()
+}
+
+// pause leaves the swarm and keeps the torrent in state, Paused or Queued.
+// Download stays blocked until start resumes it.
+func (t *Torrent) pause(state State) {
+	t.mu.Lock()
+	running := t.state == Downloading || t.state == Seeding
+	if t.state != Failed || state == Paused {
+		t.state = state
+	}
+	t.mu.Unlock()
+	if !running {
+		return
+	}
+	t.Choker.Stop()
+	err := t.Manager.Pause()
+	if err != nil {
+		fmt.Printf("could not flush %s: %v\n", t.Meta.Info.Name, err)
+	}
+}
+
+// close ends Download for good, used when the torrent leaves the session
+func (t *Torrent) close() {
+	t.pause(Paused)
+	t.mu.Lock()
+	exited, cancel := t.exited, t.cancel
+	t.exited, t.cancel = nil, nil
+	t.mu.Unlock()
+	if cancel != nil {
+		cancel()
+		<-exited
+	}
+}
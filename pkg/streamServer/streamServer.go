@@ -0,0 +1,168 @@
+package streamserver
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	filemanager "github.com/TheLox95/go-torrent-client/pkg/fileManager"
+	filereader "github.com/TheLox95/go-torrent-client/pkg/fileReader"
+)
+
+// Torrent is an active torrent whose files can be streamed
+type Torrent interface {
+	InfoHash() [20]byte
+	Name() string
+	Files() []filemanager.File
+	NewFileReader(fileIdx int) (*filereader.Reader, error)
+}
+
+// StreamServer exposes every file of the active torrents at
+// /torrents/<info hash>/<file index>/<file name>. The name is only there
+// for players that guess the format from the url.
+type StreamServer struct {
+	Addr     string
+	Torrents func() []Torrent
+	server   *http.Server
+	started  time.Time
+}
+
+type fileEntry struct {
+	Index  int    `json:"index"`
+	Path   string `json:"path"`
+	Length int64  `json:"length"`
+	Url    string `json:"url"`
+}
+
+type torrentEntry struct {
+	InfoHash string      `json:"info_hash"`
+	Name     string      `json:"name"`
+	Files    []fileEntry `json:"files"`
+}
+
+func FileUrl(infoHash [20]byte, fileIdx int, filePath string) string {
+	return "/torrents/" + hex.EncodeToString(infoHash[:]) + "/" + strconv.Itoa(fileIdx) + "/" + url.PathEscape(filepath.Base(filePath))
+}
+
+func (s *StreamServer) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", s.serveIndex)
+	mux.HandleFunc("/torrents/", s.serveFile)
+	return mux
+}
+
+// Start listens in the background, the error only covers binding
+func (s *StreamServer) Start() error {
+	listener, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		return fmt.Errorf("could not listen on %s: %w", s.Addr, err)
+	}
+	s.started = time.Now()
+	s.server = &http.Server{Handler: s.Handler(), ReadHeaderTimeout: 10 * time.Second}
+	fmt.Println("streaming server on", listener.Addr().String())
+	go func() {
+		err := s.server.Serve(listener)
+		if err != nil && err != http.ErrServerClosed {
+			fmt.Println("streaming server stopped:", err)
+		}
+	}()
+	return nil
+}
+
+func (s *StreamServer) Stop() error {
+	if s.server == nil {
+		return nil
+	}
+	return s.server.Close()
+}
+
+func (s *StreamServer) lookup(infoHash string) Torrent {
+	if s.Torrents == nil {
+		return nil
+	}
+	for _, t := range s.Torrents() {
+		hash := t.InfoHash()
+		if strings.EqualFold(hex.EncodeToString(hash[:]), infoHash) {
+			return t
+		}
+	}
+	return nil
+}
+
+func (s *StreamServer) serveIndex(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	entries := make([]torrentEntry, 0)
+	if s.Torrents != nil {
+		for _, t := range s.Torrents() {
+			hash := t.InfoHash()
+			entry := torrentEntry{InfoHash: hex.EncodeToString(hash[:]), Name: t.Name(), Files: make([]fileEntry, 0)}
+			for idx, f := range t.Files() {
+				entry.Files = append(entry.Files, fileEntry{Index: idx, Path: f.Path, Length: f.Length, Url: FileUrl(hash, idx, f.Path)})
+			}
+			entries = append(entries, entry)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
+
+func (s *StreamServer) serveFile(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	// /torrents/<hash>/<index>[/<name>]
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/torrents/"), "/", 3)
+	if len(parts) < 2 {
+		http.NotFound(w, r)
+		return
+	}
+	t := s.lookup(parts[0])
+	if t == nil {
+		http.Error(w, "unknown torrent", http.StatusNotFound)
+		return
+	}
+	fileIdx, err := strconv.Atoi(parts[1])
+	files := t.Files()
+	if err != nil || fileIdx < 0 || fileIdx >= len(files) {
+		http.Error(w, "unknown file", http.StatusNotFound)
+		return
+	}
+
+	reader, err := t.NewFileReader(fileIdx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer reader.Close()
+	// a player that hangs up unblocks the pending read, and closing the
+	// reader gives up the priority of its pieces
+	go func() {
+		<-r.Context().Done()
+		reader.Close()
+	}()
+
+	name := path.Base(filepath.ToSlash(files[fileIdx].Path))
+	contentType := mime.TypeByExtension(path.Ext(name))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Accept-Ranges", "bytes")
+	// ServeContent answers Range requests and sets Content-Length, it seeks
+	// to the start of the range so the reader prioritises the right pieces
+	http.ServeContent(w, r, name, s.started, reader)
+}
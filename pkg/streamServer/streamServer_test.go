@@ -0,0 +1,169 @@
+package streamserver
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	filemanager "github.com/TheLox95/go-torrent-client/pkg/fileManager"
+	filereader "github.com/TheLox95/go-torrent-client/pkg/fileReader"
+)
+
+// payload holds both files of fakeTorrent back to back
+const payload = "0123456789{\"hello\": \"stream\"}"
+
+// fakeTorrent has every piece verified already
+type fakeTorrent struct{}
+
+func (fakeTorrent) InfoHash() [20]byte {
+	return [20]byte{0xab}
+}
+
+func (fakeTorrent) Name() string {
+	return "fake"
+}
+
+func (fakeTorrent) Files() []filemanager.File {
+	return []filemanager.File{
+		{Path: "fake/digits.bin", Length: 10, Offset: 0},
+		{Path: "fake/data.json", Length: int64(len(payload) - 10), Offset: 10},
+	}
+}
+
+func (t fakeTorrent) NewFileReader(fileIdx int) (*filereader.Reader, error) {
+	f := t.Files()[fileIdx]
+	return filereader.New(fakeStorage{}, f.Offset, f.Length), nil
+}
+
+type fakeStorage struct{}
+
+func (fakeStorage) WaitRange(ctx context.Context, offset int64, length int64) error {
+	return nil
+}
+
+func (fakeStorage) ReadAt(p []byte, offset int64) (int, error) {
+	return copy(p, payload[offset:]), nil
+}
+
+func (fakeStorage) SetReadPosition(reader any, offset int64, readahead int64) {}
+
+func (fakeStorage) ClearReadPosition(reader any) {}
+
+func newTestServer(t *testing.T) *httptest.Server {
+	s := &StreamServer{Torrents: func() []Torrent { return []Torrent{fakeTorrent{}} }}
+	server := httptest.NewServer(s.Handler())
+	t.Cleanup(server.Close)
+	return server
+}
+
+func fileUrl(server *httptest.Server, fileIdx int, name string) string {
+	return server.URL + FileUrl(fakeTorrent{}.InfoHash(), fileIdx, name)
+}
+
+func TestRangeRequest(t *testing.T) {
+	server := newTestServer(t)
+	req, err := http.NewRequest(http.MethodGet, fileUrl(server, 0, "digits.bin"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Range", "bytes=2-5")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusPartialContent {
+		t.Fatalf("status %s, want 206", resp.Status)
+	}
+	if got := resp.Header.Get("Content-Range"); got != "bytes 2-5/10" {
+		t.Fatalf("Content-Range %q, want %q", got, "bytes 2-5/10")
+	}
+	if got := resp.Header.Get("Content-Length"); got != "4" {
+		t.Fatalf("Content-Length %q, want 4", got)
+	}
+	if string(body) != "2345" {
+		t.Fatalf("body %q, want %q", body, "2345")
+	}
+}
+
+func TestContentType(t *testing.T) {
+	server := newTestServer(t)
+	tests := []struct {
+		fileIdx     int
+		contentType string
+		body        string
+	}{
+		{0, "application/octet-stream", payload[:10]},
+		{1, "application/json", payload[10:]},
+	}
+	for _, tt := range tests {
+		// the type comes from the file, not from the name in the url
+		resp, err := http.Get(fileUrl(server, tt.fileIdx, "anything.html"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("file %d: status %s", tt.fileIdx, resp.Status)
+		}
+		if got := resp.Header.Get("Content-Type"); !strings.HasPrefix(got, tt.contentType) {
+			t.Fatalf("file %d: Content-Type %q, want %q", tt.fileIdx, got, tt.contentType)
+		}
+		if string(body) != tt.body {
+			t.Fatalf("file %d: body %q, want %q", tt.fileIdx, body, tt.body)
+		}
+	}
+}
+
+func TestUnknownFile(t *testing.T) {
+	server := newTestServer(t)
+	hash := strings.Repeat("cd", 20)
+	for _, url := range []string{
+		server.URL + "/torrents/" + hash + "/0/x",
+		fileUrl(server, 2, "x"),
+		strings.Replace(fileUrl(server, 0, "x"), "/0/", "/-1/", 1),
+		strings.Replace(fileUrl(server, 0, "x"), "/0/", "/a/", 1),
+	} {
+		resp, err := http.Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound {
+			t.Fatalf("%s: status %s, want 404", url, resp.Status)
+		}
+	}
+}
+
+func TestHead(t *testing.T) {
+	server := newTestServer(t)
+	resp, err := http.Head(fileUrl(server, 1, "data.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %s, want 200", resp.Status)
+	}
+	if resp.ContentLength != int64(len(payload)-10) {
+		t.Fatalf("Content-Length %d, want %d", resp.ContentLength, len(payload)-10)
+	}
+	if resp.Header.Get("Accept-Ranges") != "bytes" {
+		t.Fatal("HEAD does not announce range support")
+	}
+	if len(body) != 0 {
+		t.Fatalf("HEAD answered with a body %q", body)
+	}
+}